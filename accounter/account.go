@@ -24,6 +24,7 @@ package accounter
 
 import (
 	"encoding/hex"
+	"fmt"
 	"strconv"
 
 	"github.com/pasl-project/pasl/crypto"
@@ -61,8 +62,11 @@ func (this *Account) GetTimestamp() uint32 {
 	return this.Timestamp
 }
 
-func (this *Account) BalanceSub(amount uint64, index uint32) []Micro {
-	newBalance := this.Balance - amount
+func (this *Account) BalanceSub(amount uint64, index uint32) ([]Micro, error) {
+	newBalance, err := utils.SubUint64(this.Balance, amount)
+	if err != nil {
+		return nil, fmt.Errorf("Account %d balance %d can't cover %d: %v", this.Number, this.Balance, amount, err)
+	}
 	newOperations := this.Operations + 1
 
 	result := []Micro{
@@ -87,7 +91,7 @@ func (this *Account) BalanceSub(amount uint64, index uint32) []Micro {
 	this.UpdatedIndex = index
 	this.Operations = newOperations
 
-	return result
+	return result, nil
 }
 
 func (this *Account) BalanceAdd(amount uint64, index uint32) []Micro {
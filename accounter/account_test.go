@@ -0,0 +1,140 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestBalanceAdd(t *testing.T) {
+	account := Account{
+		Number:       10,
+		Balance:      100,
+		UpdatedIndex: 3,
+		Operations:   2,
+	}
+
+	micro := account.BalanceAdd(50, 7)
+	if account.Balance != 150 || account.UpdatedIndex != 7 || account.Operations != 2 {
+		t.Fatalf("%v", account)
+	}
+
+	expected := []Micro{
+		Micro{Opcode: CompareSwapBalance, ValueOld: "100", ValueNew: "150"},
+		Micro{Opcode: CompareSwapUpdatedIndex, ValueOld: "3", ValueNew: "7"},
+	}
+	if len(micro) != len(expected) {
+		t.Fatalf("%v", micro)
+	}
+	for index := range expected {
+		if micro[index] != expected[index] {
+			t.Fatalf("%v != %v", micro[index], expected[index])
+		}
+	}
+}
+
+func getTestPublic(t *testing.T) crypto.Public {
+	curve, err := crypto.CurveById(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.Public{
+		TypeId: crypto.NIDsecp256k1,
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     curve.Params().Gx,
+			Y:     curve.Params().Gy,
+		},
+	}
+}
+
+func TestAccountHashBuffer(t *testing.T) {
+	account := Account{
+		Number:       10,
+		PublicKey:    getTestPublic(t),
+		Balance:      100,
+		UpdatedIndex: 2,
+		Operations:   3,
+		Timestamp:    1500000600,
+	}
+
+	// Little endian Number, raw key (uint16 curve id, uint16 length prefixed X and Y),
+	// Balance, UpdatedIndex and Operations. Timestamp is not a part of the buffer.
+	expected := "0a000000" +
+		"ca02" + "2000" + "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" + "2000" + "483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8" +
+		"6400000000000000" + "02000000" + "03000000"
+	buffer := account.GetHashBuffer()
+	if serialized := hex.EncodeToString(utils.Serialize(&buffer)); serialized != expected {
+		t.Fatalf("%s != %s", serialized, expected)
+	}
+}
+
+func TestBalanceSubUnderflow(t *testing.T) {
+	account := Account{
+		Number:       10,
+		Balance:      100,
+		UpdatedIndex: 3,
+		Operations:   2,
+	}
+
+	if _, err := account.BalanceSub(101, 7); err == nil {
+		t.FailNow()
+	}
+	if account.Balance != 100 || account.UpdatedIndex != 3 || account.Operations != 2 {
+		t.Fatalf("%v", account)
+	}
+
+	if _, err := account.BalanceSub(100, 7); err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 0 || account.UpdatedIndex != 7 || account.Operations != 3 {
+		t.Fatalf("%v", account)
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	account := Account{Number: 5, Balance: 100, UpdatedIndex: 3, Operations: 1}
+	history, err := account.BalanceSub(10, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckHistory(account.Number, append(history, account.BalanceAdd(5, 7)...)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, micro := range []Micro{
+		Micro{Opcode: CompareSwapOperations, ValueOld: "2", ValueNew: "2"},
+		Micro{Opcode: CompareSwapOperations, ValueOld: "2", ValueNew: "1"},
+		Micro{Opcode: CompareSwapUpdatedIndex, ValueOld: "7", ValueNew: "6"},
+		Micro{Opcode: CompareSwapUpdatedIndex, ValueOld: "7", ValueNew: "x"},
+	} {
+		if err := CheckHistory(account.Number, []Micro{micro}); err == nil {
+			t.Fatalf("%v", micro)
+		}
+	}
+}
@@ -24,6 +24,8 @@ package accounter
 
 import (
 	"crypto/sha256"
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/pasl-project/pasl/crypto"
@@ -31,20 +33,26 @@ import (
 )
 
 type Accounter struct {
-	hash  []byte
-	packs []packBase
-	dirty bool
-	lock  sync.RWMutex
+	genesis [32]byte
+	hash    []byte
+	packs   []packBase
+	dirty   bool
+	lock    sync.RWMutex
 }
 
 func NewAccounter() *Accounter {
+	return NewAccounterWithGenesis(defaults.GenesisSafeBox)
+}
+
+func NewAccounterWithGenesis(genesisSafeBox [32]byte) *Accounter {
 	hash := make([]byte, 32)
-	copy(hash[:], defaults.GenesisSafeBox[:])
+	copy(hash[:], genesisSafeBox[:])
 
 	return &Accounter{
-		hash:  hash,
-		packs: make([]packBase, 0),
-		dirty: false,
+		genesis: genesisSafeBox,
+		hash:    hash,
+		packs:   make([]packBase, 0),
+		dirty:   false,
 	}
 }
 
@@ -59,9 +67,10 @@ func (this *Accounter) Copy() *Accounter {
 	copy(packs[:], this.packs)
 
 	return &Accounter{
-		hash:  hash,
-		packs: packs,
-		dirty: this.dirty,
+		genesis: this.genesis,
+		hash:    hash,
+		packs:   packs,
+		dirty:   this.dirty,
 	}
 }
 
@@ -131,3 +140,122 @@ func (this *Accounter) NewPack(miner *crypto.Public, timestamp uint32) (newAccou
 	pack := NewPack(this.getHeightUnsafe(), miner, timestamp)
 	return this.appendPackUnsafe(pack), newIndex
 }
+
+// Copy without the top pack, the accounts modified by its block are set back to the previous state
+func (this *Accounter) Revert(previous []Account) (*Accounter, error) {
+	reverted := this.Copy()
+
+	reverted.lock.Lock()
+	defer reverted.lock.Unlock()
+
+	height := reverted.getHeightUnsafe()
+	if height == 0 {
+		return nil, fmt.Errorf("Nothing to revert")
+	}
+	for index := range previous {
+		if number := previous[index].Number; number/uint32(defaults.AccountsPerBlock) >= height-1 {
+			return nil, fmt.Errorf("Account %d doesn't exist before block %d", number, height-1)
+		}
+	}
+
+	reverted.packs = reverted.packs[:height-1]
+	reverted.dirty = true
+	if height == 1 {
+		copy(reverted.hash, reverted.genesis[:])
+		reverted.dirty = false
+	}
+	for index := range previous {
+		number := previous[index].Number
+		pack := reverted.getPackContainingAccountUnsafe(number)
+		*pack.GetAccounts()[number%uint32(defaults.AccountsPerBlock)] = previous[index]
+		pack.MarkDirty()
+	}
+	return reverted, nil
+}
+
+// Either every compare-and-swap of the block changes succeeds or the accounts are left intact
+func (this *Accounter) Commit(blockIndex uint32, changes map[uint32][]Micro) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	height := this.getHeightUnsafe()
+	if blockIndex >= height {
+		return fmt.Errorf("Block %d is beyond the tip %d", blockIndex, int64(height)-1)
+	}
+
+	numbers := make([]uint32, 0, len(changes))
+	for number := range changes {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	type applied struct {
+		account *Account
+		micro   *Micro
+	}
+	done := make([]applied, 0)
+	rollback := func() {
+		for index := len(done) - 1; index >= 0; index-- {
+			setMicroValue(done[index].account, done[index].micro.Opcode, done[index].micro.ValueOld)
+		}
+	}
+
+	for _, number := range numbers {
+		if number/uint32(defaults.AccountsPerBlock) >= height {
+			rollback()
+			return fmt.Errorf("Block %d: account %d not found", blockIndex, number)
+		}
+		account := this.getPackContainingAccountUnsafe(number).GetAccounts()[number%uint32(defaults.AccountsPerBlock)]
+		history := changes[number]
+		for index := range history {
+			micro := &history[index]
+			current, err := getMicroValue(account, micro.Opcode)
+			if err == nil && current != micro.ValueOld {
+				err = fmt.Errorf("value %s != %s expected", current, micro.ValueOld)
+			}
+			if err == nil {
+				err = setMicroValue(account, micro.Opcode, micro.ValueNew)
+			}
+			if err != nil {
+				rollback()
+				return fmt.Errorf("Block %d: account %d micro #%d: %v", blockIndex, number, index, err)
+			}
+			done = append(done, applied{account, micro})
+		}
+	}
+
+	for _, number := range numbers {
+		this.getPackContainingAccountUnsafe(number).MarkDirty()
+	}
+	this.dirty = len(numbers) > 0 || this.dirty
+	return nil
+}
+
+// Reports the first account updated past the tip
+func (this *Accounter) CheckAccounts() error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	height := this.getHeightUnsafe()
+	for _, pack := range this.packs {
+		for _, account := range pack.GetAccounts() {
+			if account.UpdatedIndex >= height {
+				return fmt.Errorf("Account %d updated at block %d beyond the tip %d", account.Number, account.UpdatedIndex, int64(height)-1)
+			}
+		}
+	}
+	return nil
+}
+
+func (this *Accounter) TotalBalance() uint64 {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	var total uint64
+	for _, pack := range this.packs {
+		for _, account := range pack.GetAccounts() {
+			total += account.Balance
+		}
+	}
+	return total
+}
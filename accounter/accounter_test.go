@@ -0,0 +1,133 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pasl-project/pasl/crypto"
+)
+
+func TestCommit(t *testing.T) {
+	public := getTestPublic(t)
+	accounter := NewAccounter()
+	for index := uint32(0); index < 3; index++ {
+		accounts, _ := accounter.NewPack(&public, 1500000000+index*300)
+		accounts[0].Balance = 500000
+	}
+	_, hash := accounter.GetState()
+	hash = append([]byte{}, hash...)
+
+	source := *accounter.GetAccount(0)
+	destination := *accounter.GetAccount(7)
+	changed := *accounter.GetAccount(10)
+	changes := make(map[uint32][]Micro)
+	subMicros, err := source.BalanceSub(100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes[source.Number] = subMicros
+	changes[destination.Number] = destination.BalanceAdd(100, 2)
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes[changed.Number] = changed.KeyChange(key.Public, 2)
+
+	// Stale value in the middle of the change set, nothing must be applied
+	broken := make(map[uint32][]Micro)
+	for number, history := range changes {
+		broken[number] = history
+	}
+	broken[destination.Number] = []Micro{changes[destination.Number][0], Micro{Opcode: CompareSwapUpdatedIndex, ValueOld: "5", ValueNew: "2"}}
+	if err := accounter.Commit(2, broken); err == nil {
+		t.FailNow()
+	}
+	if account := accounter.GetAccount(0); account.Balance != 500000 || account.Operations != 0 {
+		t.Fatalf("%+v", account)
+	}
+	if account := accounter.GetAccount(7); account.Balance != 0 {
+		t.Fatalf("%+v", account)
+	}
+	if _, afterFailure := accounter.GetState(); !bytes.Equal(afterFailure, hash) {
+		t.FailNow()
+	}
+
+	if err := accounter.Commit(3, changes); err == nil {
+		t.FailNow()
+	}
+	if err := accounter.Commit(2, changes); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []Account{source, destination, changed} {
+		account := accounter.GetAccount(expected.Number)
+		if account.Balance != expected.Balance || account.UpdatedIndex != expected.UpdatedIndex || account.Operations != expected.Operations || !account.PublicKey.Equal(&expected.PublicKey) {
+			t.Fatalf("%+v != %+v", account, expected)
+		}
+	}
+	if _, committed := accounter.GetState(); bytes.Equal(committed, hash) {
+		t.FailNow()
+	}
+}
+
+func TestRevert(t *testing.T) {
+	public := getTestPublic(t)
+	accounter := NewAccounter()
+	_, genesis := accounter.GetState()
+	genesis = append([]byte{}, genesis...)
+
+	accounts, _ := accounter.NewPack(&public, 1500000000)
+	accounts[0].Balance = 500000
+	_, hash := accounter.GetState()
+	hash = append([]byte{}, hash...)
+	previous := *accounter.GetAccount(0)
+
+	accounter.NewPack(&public, 1500000300)
+	account := accounter.GetAccount(0)
+	account.BalanceSub(100, 1)
+	accounter.MarkAccountDirty(0)
+
+	if _, err := accounter.Revert([]Account{*accounter.GetAccount(5)}); err == nil {
+		t.FailNow()
+	}
+	reverted, err := accounter.Revert([]Account{previous})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height, revertedHash := reverted.GetState(); height != 1 || !bytes.Equal(revertedHash, hash) {
+		t.FailNow()
+	}
+
+	// Reverting the first block brings back the genesis safebox hash
+	reverted, err = reverted.Revert(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height, revertedHash := reverted.GetState(); height != 0 || !bytes.Equal(revertedHash, genesis) {
+		t.FailNow()
+	}
+	if _, err := reverted.Revert(nil); err == nil {
+		t.FailNow()
+	}
+}
@@ -22,6 +22,16 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package accounter
 
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
 const (
 	CompareSwapBalance uint8 = iota
 	CompareSwapUpdatedIndex
@@ -36,3 +46,77 @@ type Micro struct {
 }
 
 type HistoryPack map[uint32]Micro
+
+func getMicroValue(account *Account, opcode uint8) (string, error) {
+	switch opcode {
+	case CompareSwapBalance:
+		return strconv.FormatUint(account.Balance, 10), nil
+	case CompareSwapUpdatedIndex:
+		return strconv.FormatUint(uint64(account.UpdatedIndex), 10), nil
+	case CompareSwapKey:
+		return hex.EncodeToString(utils.Serialize(&account.PublicKey)), nil
+	case CompareSwapOperations:
+		return strconv.FormatUint(uint64(account.Operations), 10), nil
+	}
+	return "", fmt.Errorf("Unknown micro opcode %d", opcode)
+}
+
+func setMicroValue(account *Account, opcode uint8, value string) error {
+	switch opcode {
+	case CompareSwapBalance:
+		balance, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		account.Balance = balance
+	case CompareSwapUpdatedIndex:
+		index, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		account.UpdatedIndex = uint32(index)
+	case CompareSwapKey:
+		serialized, err := hex.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		var public crypto.Public
+		if err := utils.Deserialize(&public, bytes.NewBuffer(serialized)); err != nil {
+			return err
+		}
+		account.PublicKey = public
+	case CompareSwapOperations:
+		operations, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		account.Operations = uint32(operations)
+	default:
+		return fmt.Errorf("Unknown micro opcode %d", opcode)
+	}
+	return nil
+}
+
+// Operations counter has to grow with every change and UpdatedIndex may never go back
+func CheckHistory(number uint32, history []Micro) error {
+	for _, micro := range history {
+		if micro.Opcode != CompareSwapUpdatedIndex && micro.Opcode != CompareSwapOperations {
+			continue
+		}
+		valueOld, err := strconv.ParseUint(micro.ValueOld, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Account %d: %v", number, err)
+		}
+		valueNew, err := strconv.ParseUint(micro.ValueNew, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Account %d: %v", number, err)
+		}
+		if micro.Opcode == CompareSwapOperations && valueNew <= valueOld {
+			return fmt.Errorf("Account %d operations counter %d -> %d is not increasing", number, valueOld, valueNew)
+		}
+		if micro.Opcode == CompareSwapUpdatedIndex && valueNew < valueOld {
+			return fmt.Errorf("Account %d updated index %d -> %d goes back", number, valueOld, valueNew)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+type accountHashBufferSerialized struct {
+	Number       uint32
+	PublicKey    crypto.PublicSerialized
+	Balance      uint64
+	UpdatedIndex uint32
+	Operations   uint32
+}
+
+// The safebox hash is a plain sha256 over all the pack hashes, the consensus doesn't allow a merkle tree here.
+// The proof consists of the pack buffer around the account followed by the hashes of all the other packs.
+func (this *Accounter) GetAccountProof(number uint32) (AccountHashBuffer, [][]byte, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	packIndex := number / defaults.AccountsPerBlock
+	if packIndex >= this.getHeightUnsafe() {
+		return AccountHashBuffer{}, nil, fmt.Errorf("Account %d not found", number)
+	}
+	offset := number % defaults.AccountsPerBlock
+	accounts := this.packs[packIndex].GetAccounts()
+
+	prefix := utils.Serialize(packIndex)
+	suffix := []byte{}
+	for index, account := range accounts {
+		buffer := account.GetHashBuffer()
+		switch {
+		case uint32(index) < offset:
+			prefix = append(prefix, utils.Serialize(&buffer)...)
+		case uint32(index) > offset:
+			suffix = append(suffix, utils.Serialize(&buffer)...)
+		}
+	}
+	suffix = append(suffix, utils.Serialize(accounts[0].GetTimestamp())...)
+
+	proof := [][]byte{prefix, suffix}
+	for index, pack := range this.packs {
+		if uint32(index) != packIndex {
+			proof = append(proof, pack.GetHash())
+		}
+	}
+
+	return accounts[offset].GetHashBuffer(), proof, nil
+}
+
+func VerifyAccountProof(root []byte, number uint32, account AccountHashBuffer, proof [][]byte) bool {
+	if account.Number != number || len(proof) < 2 {
+		return false
+	}
+	packIndex := number / defaults.AccountsPerBlock
+	offset := number % defaults.AccountsPerBlock
+	hashes := proof[2:]
+	if uint32(len(hashes)) < packIndex {
+		return false
+	}
+	if !checkProofAccounts(proof[0], packIndex, 0, offset, false) || !checkProofAccounts(proof[1], packIndex, offset+1, defaults.AccountsPerBlock, true) {
+		return false
+	}
+
+	packHash := sha256.New()
+	packHash.Write(proof[0])
+	packHash.Write(utils.Serialize(&account))
+	packHash.Write(proof[1])
+
+	hash := sha256.New()
+	for index, it := range hashes {
+		if len(it) != sha256.Size {
+			return false
+		}
+		if uint32(index) == packIndex {
+			hash.Write(packHash.Sum(nil))
+		}
+		hash.Write(it)
+	}
+	if uint32(len(hashes)) == packIndex {
+		hash.Write(packHash.Sum(nil))
+	}
+
+	return bytes.Equal(hash.Sum(nil), root)
+}
+
+// Makes sure the account boundaries inside the pack buffer can't be shifted
+func checkProofAccounts(data []byte, packIndex uint32, from uint32, to uint32, withTimestamp bool) bool {
+	reader := bytes.NewReader(data)
+	serialized := []byte{}
+
+	if from == 0 {
+		var index uint32
+		if err := utils.Deserialize(&index, reader); err != nil || index != packIndex {
+			return false
+		}
+		serialized = append(serialized, utils.Serialize(index)...)
+	}
+	for offset := from; offset < to; offset++ {
+		var account accountHashBufferSerialized
+		if err := utils.Deserialize(&account, reader); err != nil || account.Number != packIndex*defaults.AccountsPerBlock+offset {
+			return false
+		}
+		serialized = append(serialized, utils.Serialize(&account)...)
+	}
+	if withTimestamp {
+		var timestamp uint32
+		if err := utils.Deserialize(&timestamp, reader); err != nil {
+			return false
+		}
+		serialized = append(serialized, utils.Serialize(timestamp)...)
+	}
+
+	return reader.Len() == 0 && bytes.Equal(serialized, data)
+}
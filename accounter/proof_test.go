@@ -0,0 +1,88 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"testing"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+func TestAccountProof(t *testing.T) {
+	public := getTestPublic(t)
+	accounter := NewAccounter()
+	for index := uint32(0); index < 4; index++ {
+		accounts, _ := accounter.NewPack(&public, 1500000000+index*300)
+		accounts[0].Balance = 500000
+	}
+	_, root := accounter.GetState()
+
+	for _, number := range []uint32{0, 7, 2*defaults.AccountsPerBlock + 4, 4*defaults.AccountsPerBlock - 1} {
+		account, proof, err := accounter.GetAccountProof(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyAccountProof(root, number, account, proof) {
+			t.Fatalf("%d", number)
+		}
+	}
+	if _, _, err := accounter.GetAccountProof(4 * defaults.AccountsPerBlock); err == nil {
+		t.FailNow()
+	}
+
+	number := defaults.AccountsPerBlock
+	account, proof, err := accounter.GetAccountProof(number)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := account
+	tampered.Balance++
+	if VerifyAccountProof(root, number, tampered, proof) {
+		t.FailNow()
+	}
+	if VerifyAccountProof(root, number+1, account, proof) {
+		t.FailNow()
+	}
+
+	copyProof := func() [][]byte {
+		result := make([][]byte, len(proof))
+		for index := range proof {
+			result[index] = append([]byte{}, proof[index]...)
+		}
+		return result
+	}
+	tamperedProof := copyProof()
+	tamperedProof[2][0] ^= 1
+	if VerifyAccountProof(root, number, account, tamperedProof) {
+		t.FailNow()
+	}
+	tamperedProof = copyProof()
+	tamperedProof[1] = tamperedProof[1][:len(tamperedProof[1])-1]
+	if VerifyAccountProof(root, number, account, tamperedProof) {
+		t.FailNow()
+	}
+	if VerifyAccountProof(root, number, account, proof[:len(proof)-1]) {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,143 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+var ErrSnapshotChecksum = errors.New("Snapshot checksum mismatch")
+
+type AccountDiff struct {
+	Number uint32
+	// Nil when the account doesn't exist in that state
+	Ours   *Account
+	Theirs *Account
+}
+
+type snapshot struct {
+	Accounts []Account
+}
+
+// Writes all the accounts followed by SHA-256 of the serialized accounts
+func (this *Accounter) Serialize(w io.Writer) error {
+	this.lock.RLock()
+	accounts := make([]Account, 0, len(this.packs)*int(defaults.AccountsPerBlock))
+	for _, pack := range this.packs {
+		for _, account := range pack.GetAccounts() {
+			accounts = append(accounts, *account)
+		}
+	}
+	this.lock.RUnlock()
+
+	body := utils.Serialize(&snapshot{Accounts: accounts})
+	checksum := sha256.Sum256(body)
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	_, err := w.Write(checksum[:])
+	return err
+}
+
+// Replaces the accounts, truncated or corrupted snapshots fail with ErrSnapshotChecksum
+func (this *Accounter) Deserialize(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < sha256.Size {
+		return ErrSnapshotChecksum
+	}
+	body := data[:len(data)-sha256.Size]
+	if checksum := sha256.Sum256(body); !bytes.Equal(checksum[:], data[len(body):]) {
+		return ErrSnapshotChecksum
+	}
+
+	var snapshot snapshot
+	if err := utils.Deserialize(&snapshot, bytes.NewBuffer(body)); err != nil {
+		return err
+	}
+	if len(snapshot.Accounts)%int(defaults.AccountsPerBlock) != 0 {
+		return errors.New("Accounts count doesn't fit the blockchain requirement")
+	}
+
+	packs := make([]packBase, 0, len(snapshot.Accounts)/int(defaults.AccountsPerBlock))
+	accounts := make([]*Account, defaults.AccountsPerBlock)
+	for offset := 0; offset < len(snapshot.Accounts); offset += int(defaults.AccountsPerBlock) {
+		for i := range accounts {
+			accounts[i] = &snapshot.Accounts[offset+i]
+		}
+		packs = append(packs, NewPackWithAccounts(uint32(len(packs)), accounts))
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.packs = packs
+	this.dirty = len(packs) > 0
+	return nil
+}
+
+func (this *Accounter) getPacks() []packBase {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	packs := make([]packBase, len(this.packs))
+	copy(packs, this.packs)
+	return packs
+}
+
+// Accounts with different balance, key or operations counter, and the ones present in one state only
+func (this *Accounter) Diff(other *Accounter) []AccountDiff {
+	ours := this.getPacks()
+	theirs := other.getPacks()
+
+	diff := make([]AccountDiff, 0)
+	for index := 0; index < len(ours) || index < len(theirs); index++ {
+		for offset := 0; offset < int(defaults.AccountsPerBlock); offset++ {
+			var our, their *Account
+			if index < len(ours) {
+				our = ours[index].GetAccounts()[offset]
+			}
+			if index < len(theirs) {
+				their = theirs[index].GetAccounts()[offset]
+			}
+			if our != nil && their != nil && our.Balance == their.Balance && our.Operations == their.Operations && our.PublicKey.Equal(&their.PublicKey) {
+				continue
+			}
+			diff = append(diff, AccountDiff{
+				Number: uint32(index)*defaults.AccountsPerBlock + uint32(offset),
+				Ours:   our,
+				Theirs: their,
+			})
+		}
+	}
+	return diff
+}
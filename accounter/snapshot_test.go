@@ -0,0 +1,104 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+func TestSnapshot(t *testing.T) {
+	public := getTestPublic(t)
+	original := NewAccounter()
+	for index := uint32(0); index < 3; index++ {
+		accounts, _ := original.NewPack(&public, 1500000000+index*300)
+		accounts[0].Balance = 500000
+		accounts[1].Operations = index
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := original.Serialize(buffer); err != nil {
+		t.Fatal(err)
+	}
+	saved := buffer.Bytes()
+
+	loaded := NewAccounter()
+	if err := loaded.Deserialize(bytes.NewReader(saved)); err != nil {
+		t.Fatal(err)
+	}
+	height, hash := original.GetState()
+	if loadedHeight, loadedHash := loaded.GetState(); loadedHeight != height || !bytes.Equal(loadedHash, hash) {
+		t.Fatalf("%d %x != %d %x", loadedHeight, loadedHash, height, hash)
+	}
+
+	corrupted := append([]byte{}, saved...)
+	corrupted[len(corrupted)/2] ^= 1
+	if err := NewAccounter().Deserialize(bytes.NewReader(corrupted)); err != ErrSnapshotChecksum {
+		t.Fatal(err)
+	}
+	if err := NewAccounter().Deserialize(bytes.NewReader(saved[:len(saved)-1])); err != ErrSnapshotChecksum {
+		t.Fatal(err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	public := getTestPublic(t)
+	ours := NewAccounter()
+	for index := uint32(0); index < 3; index++ {
+		accounts, _ := ours.NewPack(&public, 1500000000+index*300)
+		accounts[0].Balance = 500000
+	}
+	buffer := &bytes.Buffer{}
+	if err := ours.Serialize(buffer); err != nil {
+		t.Fatal(err)
+	}
+	theirs := NewAccounter()
+	if err := theirs.Deserialize(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if diff := ours.Diff(theirs); len(diff) != 0 {
+		t.Fatalf("%v", diff)
+	}
+
+	theirs.GetAccount(5).Balance--
+	theirs.GetAccount(12).Operations++
+	theirs.GetAccount(14).UpdatedIndex++
+	diff := ours.Diff(theirs)
+	if len(diff) != 2 || diff[0].Number != 5 || diff[1].Number != 12 {
+		t.Fatalf("%v", diff)
+	}
+	if diff[0].Ours.Balance != 500000 || diff[0].Theirs.Balance != 499999 {
+		t.FailNow()
+	}
+
+	theirs.NewPack(&public, 1500000900)
+	diff = ours.Diff(theirs)
+	if len(diff) != 2+int(defaults.AccountsPerBlock) {
+		t.Fatalf("%d", len(diff))
+	}
+	if extra := diff[len(diff)-1]; extra.Number != 4*defaults.AccountsPerBlock-1 || extra.Ours != nil || extra.Theirs == nil {
+		t.Fatalf("%+v", extra)
+	}
+}
@@ -27,8 +27,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/pasl-project/pasl/storage"
 
@@ -41,19 +43,86 @@ import (
 	"github.com/pasl-project/pasl/utils"
 )
 
+// Blocks received while paused are neither accepted nor rejected yet
+var ErrBlockQueued = errors.New("Block processing paused, block queued")
+
+// Blocks failing with it are invalid whatever the node state is, unlike the orphan or future ones
+var ErrInvalidBlock = errors.New("Invalid block")
+
+type OperationFilter func(operation *tx.Tx) error
+
+func NewBlacklistFilter(accounts ...uint32) OperationFilter {
+	blacklist := make(map[uint32]struct{})
+	for _, number := range accounts {
+		blacklist[number] = struct{}{}
+	}
+	return func(operation *tx.Tx) error {
+		source, _, _ := operation.GetSourceInfo()
+		if _, ok := blacklist[source]; ok {
+			return fmt.Errorf("Source account %d is blacklisted", source)
+		}
+		return nil
+	}
+}
+
+// Operations must pay at least base plus perByte for every byte of their serialized form
+func NewFeeFilter(base uint64, perByte uint64) OperationFilter {
+	return func(operation *tx.Tx) error {
+		size := uint64(operation.SerializedSize())
+		if perByte != 0 && size > (0xFFFFFFFFFFFFFFFF-base)/perByte {
+			return fmt.Errorf("Operation size %d is too large", size)
+		}
+		if minimum := base + perByte*size; operation.GetFee() < minimum {
+			return fmt.Errorf("Operation fee %d is below %d minimum for %d bytes", operation.GetFee(), minimum, size)
+		}
+		return nil
+	}
+}
+
 type Blockchain struct {
-	txPool  sync.Map
-	storage *storage.Storage
-	safebox *safebox.Safebox
-	lock    sync.RWMutex
-	target  common.TargetBase
+	txPool          sync.Map
+	txPoolHasher    *safebox.OperationsHasher
+	operationFilter OperationFilter
+	storage         *storage.Storage
+	safebox         *safebox.Safebox
+	lock            sync.RWMutex
+	target          common.TargetBase
+	cumulativeWork  []*big.Int
+	workLock        sync.Mutex
+	sideBranches    []*sideBranch
+	pendingHeader   *pendingHeader
+	pendingLock     sync.Mutex
+	clock           utils.Clock
+	paused          bool
+	pausedBlocks    []safebox.SerializedBlock
+	pauseLock       sync.Mutex
+	bestPeerHeight  uint32
+	maxPendingOps   int
+	maxPendingSize  int
+}
+
+type SyncStatus struct {
+	Height              uint32
+	BestKnownPeerHeight uint32
+	Synced              bool
+}
+
+type pendingHeader struct {
+	height         uint32
+	safeboxHash    []byte
+	operationsHash [32]byte
+	header         *safebox.SerializedBlockHeader
 }
 
 func NewBlockchain(storage *storage.Storage) (*Blockchain, error) {
-	accounter := accounter.NewAccounter()
+	return NewBlockchainWithParams(storage, defaults.MainnetParams())
+}
+
+func NewBlockchainWithParams(storage *storage.Storage, params *defaults.NetworkParams) (*Blockchain, error) {
+	accounter := accounter.NewAccounterWithGenesis(params.GenesisSafeBox)
 	var topBlock *safebox.BlockMetadata
 	var err error
-	if topBlock, err = load(storage, accounter); err != nil {
+	if topBlock, err = load(storage, accounter, params); err != nil {
 		utils.Tracef("Error loading blockchain: %s", err.Error())
 		return nil, err
 	}
@@ -61,24 +130,26 @@ func NewBlockchain(storage *storage.Storage) (*Blockchain, error) {
 	height, safeboxHash := accounter.GetState()
 	utils.Tracef("Blockchain loaded, height %d safeboxHash %s", height, hex.EncodeToString(safeboxHash))
 
-	getPrevTarget := func() common.TargetBase {
-		if topBlock != nil {
-			return common.NewTarget(topBlock.Target)
-		}
-		return common.NewTarget(defaults.MinTarget)
+	txPoolHasher := safebox.NewOperationsHasher()
+	safebox := safebox.NewSafeboxWithParams(accounter, params)
+
+	blockchain := &Blockchain{
+		txPoolHasher:    txPoolHasher,
+		storage:         storage,
+		safebox:         safebox,
+		target:          getNextTarget(safebox, topBlock),
+		clock:           utils.SystemClock{},
+		operationFilter: NewFeeFilter(defaults.MinimumFee, defaults.MinimumFeePerByte),
+		maxPendingOps:   defaults.MaxBlockOperations,
+		maxPendingSize:  defaults.MaxBlockBytes,
 	}
-
-	safebox := safebox.NewSafebox(accounter)
-	target := safebox.GetFork().GetNextTarget(getPrevTarget(), safebox.GetLastTimestamps)
-
-	return &Blockchain{
-		storage: storage,
-		safebox: safebox,
-		target:  common.NewTarget(target),
-	}, nil
+	if err := blockchain.loadPendingOperations(); err != nil {
+		utils.Tracef("Error loading pending operations: %v", err)
+	}
+	return blockchain, nil
 }
 
-func load(storage *storage.Storage, accounterInstance *accounter.Accounter) (topBlock *safebox.BlockMetadata, err error) {
+func load(storage *storage.Storage, accounterInstance *accounter.Accounter, params *defaults.NetworkParams) (topBlock *safebox.BlockMetadata, err error) {
 	var index uint32 = 0
 	var i uint32 = 0
 	accounts := make([]*accounter.Account, defaults.AccountsPerBlock)
@@ -112,53 +183,106 @@ func load(storage *storage.Storage, accounterInstance *accounter.Accounter) (top
 		return
 	}
 
-	var serialized []byte
-	serialized, err = storage.GetBlock(height - 1)
+	for index := range params.Checkpoints {
+		if index > height {
+			continue
+		}
+		var prevSafeboxHash []byte
+		if index == height {
+			_, prevSafeboxHash = accounterInstance.GetState()
+		} else {
+			var meta *safebox.BlockMetadata
+			if meta, err = getBlockMeta(storage, index); err != nil {
+				return
+			}
+			prevSafeboxHash = meta.PrevSafeBoxHash
+		}
+		if err = safebox.CheckCheckpoint(params.Checkpoints, index, prevSafeboxHash); err != nil {
+			return
+		}
+	}
+
+	return getBlockMeta(storage, height-1)
+}
+
+// Target of the block following the top one, the one loaded from the storage or the reverted to
+func getNextTarget(safeboxInstance *safebox.Safebox, topBlock *safebox.BlockMetadata) common.TargetBase {
+	prevTarget := common.NewTarget(defaults.MinTarget)
+	if topBlock != nil {
+		prevTarget = common.NewTarget(topBlock.Target)
+	}
+	return common.NewTarget(safeboxInstance.GetFork().GetNextTarget(prevTarget, safeboxInstance.GetLastTimestamps))
+}
+
+func getBlockMeta(storage *storage.Storage, index uint32) (*safebox.BlockMetadata, error) {
+	serialized, err := storage.GetBlock(index)
 	if err != nil {
-		return
+		return nil, err
 	}
 	var meta safebox.BlockMetadata
 	if err = utils.Deserialize(&meta, bytes.NewBuffer(serialized)); err != nil {
-		return
+		return nil, err
 	}
-
 	return &meta, nil
 }
 
 func (this *Blockchain) AddBlock(meta *safebox.BlockMetadata) error {
+	return this.addBlock(meta, nil)
+}
+
+// Received blocks carry the Pow, it has to match the one computed from the header
+func (this *Blockchain) addBlock(meta *safebox.BlockMetadata, pow []byte) error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
-	block, err := safebox.NewBlock(meta)
+	block, err := safebox.NewBlockWithParams(this.GetParams(), meta)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w %d: %v", ErrInvalidBlock, meta.Index, err)
+	}
+	if pow != nil && !bytes.Equal(pow, block.GetPow()) {
+		return fmt.Errorf("%w %d Pow %x != %x computed", ErrInvalidBlock, block.GetIndex(), pow, block.GetPow())
 	}
 
 	// TODO: block.Header.Time, implement NAT
 	// TODO: check block hash for genesis block
 	height, safeboxHash := this.safebox.GetState()
-	if height != block.GetIndex() {
+	if block.GetIndex() > height {
 		return nil
 	}
-	if !bytes.Equal(safeboxHash, block.GetPrevSafeBoxHash()) {
-		return fmt.Errorf("Invalid block %d safeboxHash %s != %s expected", block.GetIndex(), hex.EncodeToString(block.GetPrevSafeBoxHash()), hex.EncodeToString(safeboxHash))
+	if block.GetIndex() < height || !bytes.Equal(safeboxHash, block.GetPrevSafeBoxHash()) {
+		return this.addSideBlockUnsafe(meta, block)
 	}
 
-	lastTimestamps := this.safebox.GetLastTimestamps(1)
-	if len(lastTimestamps) != 0 && block.GetTimestamp() < lastTimestamps[0] {
-		return errors.New("Invalid timestamp")
+	if err := this.applyBlockUnsafe(meta, block); err != nil {
+		return err
+	}
+	this.pruneSideBranchesUnsafe()
+	return nil
+}
+
+// Appends the block to the main chain, the accounts it modifies are saved beforehand to be able to revert it
+func (this *Blockchain) applyBlockUnsafe(meta *safebox.BlockMetadata, block safebox.BlockBase) error {
+	if _, safeboxHash := this.safebox.GetState(); !bytes.Equal(safeboxHash, block.GetPrevSafeBoxHash()) {
+		return fmt.Errorf("Invalid block %d safeboxHash %s != %s expected", block.GetIndex(), hex.EncodeToString(block.GetPrevSafeBoxHash()), hex.EncodeToString(safeboxHash))
+	}
+	if err := this.checkBlockUnsafe(block, this.safebox.GetFork(), this.target, this.safebox.GetLastTimestamps); err != nil {
+		return err
 	}
-	if err := this.safebox.GetFork().CheckBlock(this.target, block); err != nil {
-		return errors.New("Invalid block: " + err.Error())
+
+	operations := block.GetOperations()
+	affectedAccounts := make([]uint32, 0, len(operations)*2)
+	for index := range operations {
+		affectedAccounts = append(affectedAccounts, operations[index].GetAffectedAccounts()...)
 	}
+	undo := utils.Serialize(&blockUndo{Accounts: this.safebox.GetAccounts(affectedAccounts)})
 
-	newSafebox, updatedAccounts, err := this.safebox.ProcessOperations(block.GetMiner(), block.GetTimestamp(), block.GetOperations())
+	newSafebox, updatedAccounts, err := this.safebox.ProcessOperations(block.GetMiner(), block.GetTimestamp(), operations)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w %d: %v", ErrInvalidBlock, block.GetIndex(), err)
 	}
 
 	newHeight, _ := newSafebox.GetState()
-	if fork := safebox.TryActivateFork(newHeight, block.GetPrevSafeBoxHash()); fork != nil {
+	if fork := safebox.TryActivateFork(this.GetParams(), newHeight, block.GetPrevSafeBoxHash()); fork != nil {
 		this.target = block.GetTarget()
 		newSafebox.SetFork(fork)
 	}
@@ -175,15 +299,58 @@ func (this *Blockchain) AddBlock(meta *safebox.BlockMetadata) error {
 		utils.Tracef("Error storing blockchain state: %v", err)
 		return err
 	}
+	this.storage.StoreUndo(block.GetIndex(), undo)
 
-	this.txPoolCleanUpUnsafe(block.GetOperations())
+	this.txPoolCleanUpUnsafe(operations)
 	this.target.Set(newSafebox.GetFork().GetNextTarget(this.target, newSafebox.GetLastTimestamps))
 	this.safebox = newSafebox
 	return nil
 }
 
+// Checks that don't depend on the safebox, shared by the main chain and the side blocks
+func (this *Blockchain) checkBlockUnsafe(block safebox.BlockBase, fork safebox.Fork, target common.TargetBase, getLastTimestamps safebox.GetLastTimestamps) error {
+	if err := safebox.CheckCheckpoint(this.safebox.GetParams().Checkpoints, block.GetIndex(), block.GetPrevSafeBoxHash()); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	lastTimestamps := getLastTimestamps(1)
+	if len(lastTimestamps) != 0 && block.GetTimestamp() < lastTimestamps[0] {
+		return fmt.Errorf("%w %d timestamp %d is earlier than %d", ErrInvalidBlock, block.GetIndex(), block.GetTimestamp(), lastTimestamps[0])
+	}
+	// Not necessarily invalid, the clocks may differ
+	if int64(block.GetTimestamp()) > this.clock.Now().Unix()+int64(defaults.MaxFutureBlockTime) {
+		return fmt.Errorf("Block %d timestamp %d is too far in the future", block.GetIndex(), block.GetTimestamp())
+	}
+	if err := fork.CheckBlock(target, block); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	return nil
+}
+
 func (this *Blockchain) AddBlockSerialized(block *safebox.SerializedBlock) error {
-	return this.AddBlock(&safebox.BlockMetadata{
+	if err := block.Header.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	if err := safebox.CheckReward(this.GetParams(), block.Header.Index, block.Header.Reward); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	this.pauseLock.Lock()
+	defer this.pauseLock.Unlock()
+
+	if this.paused {
+		if len(this.pausedBlocks) >= defaults.MaxPausedBlocks {
+			utils.Tracef("Block processing paused, dropping block %d", block.Header.Index)
+			return fmt.Errorf("Block processing paused, block %d dropped", block.Header.Index)
+		}
+		this.pausedBlocks = append(this.pausedBlocks, *block)
+		return ErrBlockQueued
+	}
+	return this.addBlockSerialized(block)
+}
+
+func (this *Blockchain) addBlockSerialized(block *safebox.SerializedBlock) error {
+	return this.addBlock(&safebox.BlockMetadata{
 		Index:           block.Header.Index,
 		Miner:           block.Header.Miner,
 		Version:         block.Header.Version,
@@ -193,14 +360,77 @@ func (this *Blockchain) AddBlockSerialized(block *safebox.SerializedBlock) error
 		Payload:         block.Header.Payload,
 		PrevSafeBoxHash: block.Header.PrevSafeboxHash,
 		Operations:      block.Operations,
-	})
+	}, block.Header.Pow)
+}
+
+func (this *Blockchain) Pause() {
+	this.pauseLock.Lock()
+	defer this.pauseLock.Unlock()
+
+	this.paused = true
+}
+
+func (this *Blockchain) Resume() error {
+	this.pauseLock.Lock()
+	defer this.pauseLock.Unlock()
+
+	blocks := this.pausedBlocks
+	this.paused = false
+	this.pausedBlocks = nil
+
+	// Every block is processed, the failures are reported all together
+	failures := make([]string, 0)
+	for index := range blocks {
+		if err := this.addBlockSerialized(&blocks[index]); err != nil {
+			failures = append(failures, fmt.Sprintf("block %d: %v", blocks[index].Header.Index, err))
+		}
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("Failed to apply %d of %d paused blocks, %s", len(failures), len(blocks), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (this *Blockchain) SetOperationFilter(filter OperationFilter) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.operationFilter = filter
+}
+
+func (this *Blockchain) SetClock(clock utils.Clock) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.clock = clock
+}
+
+func (this *Blockchain) GetClock() utils.Clock {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.clock
 }
 
 func (this *Blockchain) AddOperation(operation *tx.Tx) (new bool, err error) {
+	this.lock.RLock()
+	filter := this.operationFilter
+	this.lock.RUnlock()
+
+	return this.addOperation(filter, operation)
+}
+
+func (this *Blockchain) addOperation(filter OperationFilter, operation *tx.Tx) (new bool, err error) {
+	if err := filter(operation); err != nil {
+		return false, err
+	}
 	if err := this.safebox.Validate(operation); err != nil {
 		return false, err
 	}
 	_, exists := this.txPool.LoadOrStore(operation.GetTxIdString(), *operation)
+	if !exists {
+		this.txPoolHasher.Add(operation.GetTxIdString(), operation)
+	}
 	return !exists, nil
 }
 
@@ -214,6 +444,7 @@ func (this *Blockchain) txPoolCleanUpUnsafe(toRemove []tx.Tx) {
 	})
 	for _, op := range toRemove {
 		this.txPool.Delete(op.GetTxIdString())
+		this.txPoolHasher.Remove(op.GetTxIdString())
 	}
 }
 
@@ -235,50 +466,146 @@ func (this *Blockchain) getPendingBlock(miner *crypto.Public, payload []byte) sa
 
 	height, safeboxHash := this.safebox.GetState()
 
-	operations := make([]tx.Tx, 0)
-	this.txPool.Range(func(key, value interface{}) bool {
-		operations = append(operations, value.(tx.Tx))
-		return true
-	})
-	block, err := safebox.NewBlock(&safebox.BlockMetadata{
+	operationsHash := this.txPoolHasher.Get()
+	operations, capped := this.getBlockOperations()
+	meta := &safebox.BlockMetadata{
 		Index: height,
 		Miner: minerSerialized,
 		Version: common.Version{
 			Major: 1,
 			Minor: 1,
 		},
-		Timestamp:       uint32(time.Now().Unix()),
+		Timestamp:       uint32(this.GetClock().Now().Unix()),
 		Target:          this.target.GetCompact(),
 		Nonce:           0,
 		Payload:         payload,
 		PrevSafeBoxHash: safeboxHash,
 		Operations:      operations,
-	})
+	}
+	if capped || operationsHash != this.txPoolHasher.Get() {
+		operationsHash = safebox.GetOperationsHash(operations)
+	}
+	block, err := safebox.NewBlockWithOperationsHash(this.GetParams(), meta, operationsHash)
 	if err != nil {
 		utils.Tracef("Error %s", err.Error())
 	}
 	return block
 }
 
-func (this *Blockchain) GetBlock(index uint32) safebox.BlockBase {
-	var serialized []byte
-	serialized, err := this.storage.GetBlock(index)
-	if err != nil {
-		return nil
+func (this *Blockchain) GetPendingHeader() *safebox.SerializedBlockHeader {
+	this.pendingLock.Lock()
+	defer this.pendingLock.Unlock()
+
+	// Equal height reorgs keep the height but change the tip
+	height, safeboxHash := this.safebox.GetState()
+	operationsHash := this.txPoolHasher.Get()
+	if cached := this.pendingHeader; cached != nil && cached.height == height && bytes.Equal(cached.safeboxHash, safeboxHash) && cached.operationsHash == operationsHash {
+		return cached.header
 	}
-	var meta safebox.BlockMetadata
-	if err = utils.Deserialize(&meta, bytes.NewBuffer(serialized)); err != nil {
+
+	header := this.GetPendingBlock().SerializeHeader(false)
+	this.pendingHeader = &pendingHeader{
+		height:         height,
+		safeboxHash:    safeboxHash,
+		operationsHash: operationsHash,
+		header:         &header,
+	}
+	return &header
+}
+
+func (this *Blockchain) GetPendingOperations() []tx.Tx {
+	operations := make([]tx.Tx, 0)
+	for _, id := range this.txPoolHasher.GetIds() {
+		if value, ok := this.txPool.Load(id); ok {
+			operations = append(operations, value.(tx.Tx))
+		}
+	}
+	return operations
+}
+
+func (this *Blockchain) SavePendingOperations() error {
+	pending := this.GetPendingOperations()
+	operations := make([]tx.Operation, len(pending))
+	for index := range pending {
+		operations[index] = &pending[index]
+	}
+	return this.storage.StorePendingOperations(tx.SerializeOperations(operations))
+}
+
+// Saved operations go through the regular validation, the ones mined or invalidated meanwhile are dropped
+func (this *Blockchain) loadPendingOperations() error {
+	data, err := this.storage.LoadPendingOperations()
+	if err == storage.ErrNotFound {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	operations, err := tx.DeserializeOperations(data)
+	if err != nil {
+		return err
+	}
 
-	block, err := safebox.NewBlock(&meta)
+	dropped := 0
+	for _, operation := range operations {
+		if _, err := this.AddOperation(operation.(*tx.Tx)); err != nil {
+			dropped++
+		}
+	}
+	utils.Tracef("Loaded %d pending operations, %d dropped", len(operations)-dropped, dropped)
+	return nil
+}
+
+// Pending operations that fit into a single block, in the pool order
+func (this *Blockchain) getBlockOperations() (operations []tx.Tx, capped bool) {
+	pending := this.GetPendingOperations()
+	size := 0
+	for index := range pending {
+		size += pending[index].SerializedSize()
+		if index >= this.maxPendingOps || size > this.maxPendingSize {
+			return pending[:index], true
+		}
+	}
+	return pending, false
+}
+
+func (this *Blockchain) GetPendingOperationsHash() [32]byte {
+	return this.txPoolHasher.Get()
+}
+
+func (this *Blockchain) GetBlock(index uint32) (safebox.BlockBase, error) {
+	meta, err := getBlockMeta(this.storage, index)
+	if err == storage.ErrNotFound {
+		if height, _ := this.GetState(); index >= height {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Block #%d is missing in storage", index)
+	}
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	return block
+	return safebox.NewBlockWithParams(this.GetParams(), meta)
+}
+
+func (this *Blockchain) GetParams() *defaults.NetworkParams {
+	return this.safebox.GetParams()
 }
 
 func (this *Blockchain) GetState() (uint32, []byte) {
 	return this.safebox.GetState()
 }
+
+func (this *Blockchain) SetBestKnownPeerHeight(height uint32) {
+	atomic.StoreUint32(&this.bestPeerHeight, height)
+}
+
+func (this *Blockchain) Status() SyncStatus {
+	height, _ := this.GetState()
+	bestPeerHeight := atomic.LoadUint32(&this.bestPeerHeight)
+	return SyncStatus{
+		Height:              height,
+		BestKnownPeerHeight: bestPeerHeight,
+		Synced:              height >= bestPeerHeight,
+	}
+}
@@ -0,0 +1,643 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/storage"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func withTestBlockchain(t *testing.T, fn func(blockchain *Blockchain)) {
+	dir, err := ioutil.TempDir("", "pasl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = storage.WithStorageFile(filepath.Join(dir, "storage.db"), defaults.AccountsPerBlock, func(storage *storage.Storage) error {
+		blockchain, err := NewBlockchain(storage)
+		if err != nil {
+			return err
+		}
+		fn(blockchain)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestBlockMeta(blockchain *Blockchain, target uint32) *safebox.BlockMetadata {
+	height, safeboxHash := blockchain.GetState()
+	return &safebox.BlockMetadata{
+		Index:           height,
+		Miner:           utils.Serialize(crypto.NewKeyNil().Public),
+		Timestamp:       1500000000 + height*300,
+		Target:          target,
+		PrevSafeBoxHash: safeboxHash,
+	}
+}
+
+func addTestBlocks(t *testing.T, blockchain *Blockchain, target uint32, count int) {
+	for i := 0; i < count; i++ {
+		if err := blockchain.AddBlock(getTestBlockMeta(blockchain, target)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddBlock(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestBlocks(t, blockchain, defaults.MinTarget, 3)
+		if height, _ := blockchain.GetState(); height != 3 {
+			t.Fatalf("%d != 3", height)
+		}
+		if block, err := blockchain.GetBlock(2); block == nil || err != nil {
+			t.FailNow()
+		}
+	})
+}
+
+func getTestTransfer(t *testing.T, source uint32, destination uint32) *tx.Tx {
+	return getTestTransferWithPayload(t, source, destination, 0, []byte{})
+}
+
+// Shared by the test transfers, their size depends on the key coordinates length
+var testTransferKey *crypto.Key
+
+func getTestTransferWithPayload(t *testing.T, source uint32, destination uint32, fee uint64, payload []byte) *tx.Tx {
+	if testTransferKey == nil {
+		key, err := crypto.NewKey(crypto.NIDsecp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testTransferKey = key
+	}
+	key := testTransferKey
+	serialized := utils.Serialize(uint32(1))
+	serialized = append(serialized, utils.Serialize(&tx.Transfer{
+		Source:      source,
+		OperationId: 1,
+		Destination: destination,
+		Amount:      1,
+		Fee:         fee,
+		Payload:     payload,
+		PublicKey:   *key.Public,
+		Signature: crypto.SignatureSerialized{
+			R: []byte{1},
+			S: []byte{1},
+		},
+	})...)
+
+	var operation tx.Tx
+	if err := operation.Deserialize(bytes.NewBuffer(serialized)); err != nil {
+		t.Fatal(err)
+	}
+	return &operation
+}
+
+func TestOperationFilter(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		rejected := errors.New("rejected")
+		blockchain.SetOperationFilter(func(operation *tx.Tx) error {
+			if source, _, _ := operation.GetSourceInfo(); source == 7 {
+				return rejected
+			}
+			return nil
+		})
+
+		if _, err := blockchain.AddOperation(getTestTransfer(t, 7, 0)); err != rejected {
+			t.Fatalf("%v", err)
+		}
+		if _, err := blockchain.AddOperation(getTestTransfer(t, 8, 0)); err == nil || err == rejected {
+			t.Fatalf("%v", err)
+		}
+	})
+}
+
+func TestBlacklistFilter(t *testing.T) {
+	filter := NewBlacklistFilter(1, 3)
+	if filter(getTestTransfer(t, 1, 0)) == nil || filter(getTestTransfer(t, 3, 0)) == nil {
+		t.FailNow()
+	}
+	if err := filter(getTestTransfer(t, 2, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeeFilter(t *testing.T) {
+	filter := NewFeeFilter(10, 1)
+	size := uint64(getTestTransfer(t, 1, 0).SerializedSize())
+
+	// The large operation pays the flat minimum but not its size
+	large := getTestTransferWithPayload(t, 1, 0, 10+size, make([]byte, 200))
+	if err := filter(large); err == nil {
+		t.FailNow()
+	}
+	large = getTestTransferWithPayload(t, 1, 0, 10+size+200, make([]byte, 200))
+	if err := filter(large); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filter(getTestTransferWithPayload(t, 1, 0, 9+size, []byte{})); err == nil {
+		t.FailNow()
+	}
+	if err := filter(getTestTransferWithPayload(t, 1, 0, 10+size, []byte{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFeeFilter(0, 0)(getTestTransfer(t, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBlockMissing(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestBlocks(t, blockchain, defaults.MinTarget, 2)
+
+		if block, err := blockchain.GetBlock(2); block != nil || err != nil {
+			t.FailNow()
+		}
+
+		corrupted := getTestBlockMeta(blockchain, defaults.MinTarget)
+		corrupted.Miner = utils.Serialize(&crypto.PublicSerialized{TypeId: 1})
+		blockchain.storage.Store(1, utils.Serialize(corrupted), func(fn func(number uint32, data []byte) error) error {
+			return nil
+		})
+		if block, err := blockchain.GetBlock(1); block != nil || err == nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestAddBlockSerializedInvalidHeader(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		block, err := safebox.NewBlock(getTestBlockMeta(blockchain, defaults.MinTarget))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized := block.Serialize()
+		serialized.Header.OperationsHash = serialized.Header.OperationsHash[:16]
+
+		if err := blockchain.AddBlockSerialized(&serialized); err == nil {
+			t.FailNow()
+		}
+		if height, _ := blockchain.GetState(); height != 0 {
+			t.Fatalf("%d", height)
+		}
+	})
+}
+
+func getTestSignedTransfer(t *testing.T, key *crypto.Key, source, operationId, destination uint32, amount uint64) tx.Tx {
+	transfer := tx.Transfer{
+		Source:      source,
+		OperationId: operationId,
+		Destination: destination,
+		Amount:      amount,
+		Payload:     []byte{},
+		PublicKey:   *key.Public,
+	}
+	deserialize := func() (operation tx.Tx) {
+		serialized := append(utils.Serialize(uint32(1)), utils.Serialize(&transfer)...)
+		if err := operation.Deserialize(bytes.NewBuffer(serialized)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	operation := deserialize()
+	private := &ecdsa.PrivateKey{
+		PublicKey: key.Public.PublicKey,
+		D:         (&big.Int{}).SetBytes(key.Private),
+	}
+	toSign, err := tx.SignableBytes(&operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, private, toSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer.Signature = crypto.SignatureSerialized{
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+	return deserialize()
+}
+
+func addTestMaturedBlocks(t *testing.T, blockchain *Blockchain, miner *crypto.Key) {
+	for i := uint32(0); i <= defaults.MaturationHeight+1; i++ {
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Miner = utils.Serialize(miner.Public)
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddBlockReplay(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestMaturedBlocks(t, blockchain, key)
+
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Operations = []tx.Tx{getTestSignedTransfer(t, key, 0, 1, 1, 1)}
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+		height, safeboxHash := blockchain.GetState()
+
+		// Replaying the tip and an older block must neither fail nor apply operations again
+		older, err := getBlockMeta(blockchain.storage, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, replay := range []*safebox.BlockMetadata{meta, older} {
+			if err := blockchain.AddBlock(replay); err != nil {
+				t.Fatal(err)
+			}
+			if replayHeight, replayHash := blockchain.GetState(); replayHeight != height || !bytes.Equal(replayHash, safeboxHash) {
+				t.Fatalf("%d %d", replayHeight, height)
+			}
+		}
+		if sideBlocks := blockchain.GetSideBlocks(meta.Index); len(sideBlocks) != 0 {
+			t.Fatalf("%d", len(sideBlocks))
+		}
+	})
+}
+
+func TestGetPendingHeader(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		header := blockchain.GetPendingHeader()
+
+		var wait sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				if blockchain.GetPendingHeader() != header {
+					t.Error("pending header recomputed")
+				}
+			}()
+		}
+		wait.Wait()
+
+		addTestBlocks(t, blockchain, defaults.MinTarget, 1)
+		if updated := blockchain.GetPendingHeader(); updated == header || updated.Index != 1 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestGetPendingHeaderReorg(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		first := getTestBlockMeta(blockchain, defaults.MinTarget)
+		second := getTestBlockMeta(blockchain, defaults.MinTarget)
+		second.Timestamp++
+		branch := getTestBranch(t, blockchain, defaults.MinTarget)
+		sibling, err := safebox.NewBlock(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The sibling with the lowest hash wins the tie, it has to arrive second to trigger the reorg
+		if bytes.Compare(branch[0].GetHash(), sibling.GetHash()) < 0 {
+			first, second = second, first
+		}
+
+		if err := blockchain.AddBlock(first); err != nil {
+			t.Fatal(err)
+		}
+		header := blockchain.GetPendingHeader()
+		if err := blockchain.AddBlock(second); err != nil {
+			t.Fatal(err)
+		}
+		updated := blockchain.GetPendingHeader()
+		if updated.Index != header.Index || bytes.Equal(updated.PrevSafeboxHash, header.PrevSafeboxHash) {
+			t.FailNow()
+		}
+		if _, safeboxHash := blockchain.GetState(); !bytes.Equal(updated.PrevSafeboxHash, safeboxHash) {
+			t.FailNow()
+		}
+	})
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (this *testClock) Now() time.Time {
+	return this.now
+}
+
+func (this *testClock) After(d time.Duration) <-chan time.Time {
+	fired := make(chan time.Time, 1)
+	fired <- this.now.Add(d)
+	return fired
+}
+
+func TestFutureBlockTimestamp(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		clock := &testClock{now: time.Unix(int64(meta.Timestamp-defaults.MaxFutureBlockTime-1), 0)}
+		blockchain.SetClock(clock)
+
+		if err := blockchain.AddBlock(meta); err == nil {
+			t.FailNow()
+		}
+		if height, _ := blockchain.GetState(); height != 0 {
+			t.Fatalf("%d", height)
+		}
+
+		clock.now = clock.now.Add(time.Second)
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPauseResume(t *testing.T) {
+	var blocks []safebox.SerializedBlock
+	withTestBlockchain(t, func(source *Blockchain) {
+		for i := 0; i < 3; i++ {
+			block, err := safebox.NewBlock(getTestBlockMeta(source, defaults.MinTarget))
+			if err != nil {
+				t.Fatal(err)
+			}
+			serialized := block.Serialize()
+			if err := source.AddBlockSerialized(&serialized); err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, serialized)
+		}
+	})
+
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		header := blockchain.GetPendingHeader()
+
+		// The broken block fails on its own, the following ones still get applied
+		broken := blocks[1]
+		broken.Header.Pow = make([]byte, 32)
+		queued := []safebox.SerializedBlock{blocks[0], broken, blocks[1], blocks[2]}
+
+		blockchain.Pause()
+		for index := range queued {
+			if err := blockchain.AddBlockSerialized(&queued[index]); err != ErrBlockQueued {
+				t.Fatal(err)
+			}
+		}
+		if height, _ := blockchain.GetState(); height != 0 {
+			t.Fatalf("%d", height)
+		}
+		if pending := blockchain.GetPendingHeader(); pending.Index != header.Index || !bytes.Equal(pending.PrevSafeboxHash, header.PrevSafeboxHash) {
+			t.FailNow()
+		}
+
+		if err := blockchain.Resume(); err == nil || !strings.Contains(err.Error(), "1 of 4") {
+			t.Fatal(err)
+		}
+		if height, _ := blockchain.GetState(); height != uint32(len(blocks)) {
+			t.Fatalf("%d", height)
+		}
+	})
+}
+
+func TestAddBlockSerializedInvalidReward(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		for i := 0; i < 2; i++ {
+			block, err := safebox.NewBlock(getTestBlockMeta(blockchain, defaults.MinTarget))
+			if err != nil {
+				t.Fatal(err)
+			}
+			serialized := block.Serialize()
+
+			tampered := serialized
+			tampered.Header.Reward++
+			if err := blockchain.AddBlockSerialized(&tampered); err == nil {
+				t.FailNow()
+			}
+			if height, _ := blockchain.GetState(); height != uint32(i) {
+				t.Fatalf("%d", height)
+			}
+
+			if err := blockchain.AddBlockSerialized(&serialized); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAddBlockSerializedPow(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		serialized, err := safebox.NewSerializedBlock(getTestBlockMeta(blockchain, defaults.MinTarget))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		forged := serialized
+		forged.Header.Pow = append([]byte{}, serialized.Header.Pow...)
+		forged.Header.Pow[31] ^= 1
+		changed := serialized
+		changed.Header.Nonce++
+		missing := serialized
+		missing.Header.Pow = nil
+		for _, block := range []safebox.SerializedBlock{forged, changed, missing} {
+			if err := blockchain.AddBlockSerialized(&block); err == nil {
+				t.FailNow()
+			}
+		}
+		if height, _ := blockchain.GetState(); height != 0 {
+			t.Fatalf("%d", height)
+		}
+
+		if err := blockchain.AddBlockSerialized(&serialized); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPendingBlockLimits(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestMaturedBlocks(t, blockchain, key)
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Miner = utils.Serialize(key.Public)
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+		// Miner accounts of the first three blocks are matured
+		for block := uint32(0); block < 3; block++ {
+			operation := getTestSignedTransfer(t, key, block*defaults.AccountsPerBlock, 1, 1, 1)
+			if _, err := blockchain.AddOperation(&operation); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		blockchain.maxPendingOps = 2
+		block := blockchain.GetPendingBlock()
+		if len(block.GetOperations()) != 2 || len(blockchain.GetPendingOperations()) != 3 {
+			t.Fatalf("%d", len(block.GetOperations()))
+		}
+		operationsHash := safebox.GetOperationsHash(block.GetOperations())
+		if header := blockchain.GetPendingHeader(); !bytes.Equal(header.OperationsHash, operationsHash[:]) {
+			t.FailNow()
+		}
+
+		blockchain.maxPendingSize = block.GetOperations()[0].SerializedSize()
+		if operations := blockchain.GetPendingBlock().GetOperations(); len(operations) != 1 {
+			t.Fatalf("%d", len(operations))
+		}
+
+		// The capped set is a valid block on its own
+		meta = getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Operations = block.GetOperations()
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+		if len(blockchain.GetPendingOperations()) != 1 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestPendingOperationsReload(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "pasl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withBlockchain := func(fn func(blockchain *Blockchain)) {
+		err := storage.WithStorageFile(filepath.Join(dir, "storage.db"), defaults.AccountsPerBlock, func(storage *storage.Storage) error {
+			blockchain, err := NewBlockchain(storage)
+			if err != nil {
+				return err
+			}
+			fn(blockchain)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mined := getTestSignedTransfer(t, key, 0, 1, 1, 1)
+	pending := getTestSignedTransfer(t, key, 5, 1, 1, 1)
+	withBlockchain(func(blockchain *Blockchain) {
+		addTestMaturedBlocks(t, blockchain, key)
+		for _, operation := range []*tx.Tx{&mined, &pending} {
+			if _, err := blockchain.AddOperation(operation); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := blockchain.SavePendingOperations(); err != nil {
+			t.Fatal(err)
+		}
+
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Operations = []tx.Tx{mined}
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	withBlockchain(func(blockchain *Blockchain) {
+		operations := blockchain.GetPendingOperations()
+		if len(operations) != 1 || operations[0].GetTxIdString() != pending.GetTxIdString() {
+			t.Fatalf("%d", len(operations))
+		}
+	})
+}
+
+func TestLoadCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withStorage := func(fn func(storage *storage.Storage)) {
+		err := storage.WithStorageFile(filepath.Join(dir, "storage.db"), defaults.AccountsPerBlock, func(storage *storage.Storage) error {
+			fn(storage)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var prevSafeboxHash [32]byte
+	withStorage(func(storage *storage.Storage) {
+		blockchain, err := NewBlockchain(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addTestBlocks(t, blockchain, defaults.MinTarget, 2)
+		meta, err := getBlockMeta(storage, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(prevSafeboxHash[:], meta.PrevSafeBoxHash)
+	})
+
+	// Checkpoints of the network the blockchain is loaded with are enforced, not the mainnet ones
+	withStorage(func(storage *storage.Storage) {
+		params := defaults.MainnetParams()
+		params.Checkpoints = map[uint32][32]byte{1: prevSafeboxHash}
+		if _, err := NewBlockchainWithParams(storage, params); err != nil {
+			t.Fatal(err)
+		}
+		params.Checkpoints = map[uint32][32]byte{1: sha256.Sum256(prevSafeboxHash[:])}
+		if _, err := NewBlockchainWithParams(storage, params); err == nil {
+			t.FailNow()
+		}
+	})
+}
@@ -0,0 +1,390 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/utils"
+)
+
+var ErrOrphanBlock = errors.New("Block doesn't continue any known block")
+var ErrReorgTooDeep = errors.New("Block forks deeper than the reorg depth allowed")
+
+// Accounts state prior to the block, stored along with every main chain block
+type blockUndo struct {
+	Accounts []accounter.Account
+}
+
+// Blocks continuing each other, the first one competes with the main chain block at the same index
+type sideBranch struct {
+	metas  []*safebox.BlockMetadata
+	blocks []safebox.BlockBase
+}
+
+func (this *sideBranch) getForkIndex() uint32 {
+	return this.blocks[0].GetIndex()
+}
+
+func (this *sideBranch) getTipIndex() uint32 {
+	return this.blocks[len(this.blocks)-1].GetIndex()
+}
+
+func (this *sideBranch) get(index uint32) safebox.BlockBase {
+	if len(this.blocks) == 0 || index < this.getForkIndex() || index > this.getTipIndex() {
+		return nil
+	}
+	return this.blocks[index-this.getForkIndex()]
+}
+
+func (this *sideBranch) append(meta *safebox.BlockMetadata, block safebox.BlockBase) {
+	this.metas = append(this.metas, meta)
+	this.blocks = append(this.blocks, block)
+}
+
+// Copy of the branch blocks below the index
+func (this *sideBranch) prefix(index uint32) *sideBranch {
+	if len(this.blocks) == 0 {
+		return &sideBranch{}
+	}
+	length := index - this.getForkIndex()
+	return &sideBranch{
+		metas:  append([]*safebox.BlockMetadata{}, this.metas[:length]...),
+		blocks: append([]safebox.BlockBase{}, this.blocks[:length]...),
+	}
+}
+
+// Side blocks either compete with a main chain block or continue a known side branch
+func (this *Blockchain) addSideBlockUnsafe(meta *safebox.BlockMetadata, block safebox.BlockBase) error {
+	height, _ := this.safebox.GetState()
+	index := block.GetIndex()
+
+	var parent *sideBranch
+	if index < height {
+		mainMeta, err := getBlockMeta(this.storage, index)
+		if err != nil {
+			return err
+		}
+		if main, err := safebox.NewBlockWithParams(this.GetParams(), mainMeta); err != nil || bytes.Equal(main.GetHash(), block.GetHash()) {
+			return err
+		}
+		if bytes.Equal(mainMeta.PrevSafeBoxHash, block.GetPrevSafeBoxHash()) {
+			parent = &sideBranch{}
+		}
+	}
+	for _, branch := range this.sideBranches {
+		if known := branch.get(index); known != nil && bytes.Equal(known.GetHash(), block.GetHash()) {
+			return nil
+		}
+		if parent == nil && branch.getForkIndex() < index && branch.getTipIndex()+1 >= index {
+			parent = branch
+		}
+	}
+	if parent == nil {
+		return ErrOrphanBlock
+	}
+
+	branch := parent
+	if len(parent.blocks) == 0 || parent.getTipIndex()+1 != index {
+		branch = parent.prefix(index)
+	}
+
+	// Branches forking deeper than MaxReorgDepth could never replace the main chain
+	if forkIndex := index - uint32(len(branch.blocks)); height-forkIndex > defaults.MaxReorgDepth {
+		utils.Tracef("Block %d forks at %d, %d blocks deep, %d allowed", index, forkIndex, height-forkIndex, defaults.MaxReorgDepth)
+		return ErrReorgTooDeep
+	}
+
+	// Side blocks go through the same checks the main chain ones do, except the safebox is not known yet
+	fork, target, getLastTimestamps, err := this.getBranchStateUnsafe(index-uint32(len(branch.blocks)), branch.blocks)
+	if err != nil {
+		return err
+	}
+	if err := this.checkBlockUnsafe(block, fork, target, getLastTimestamps); err != nil {
+		return err
+	}
+
+	if branch != parent {
+		if len(this.sideBranches) >= defaults.MaxSideBlocks {
+			return nil
+		}
+		this.sideBranches = append(this.sideBranches, branch)
+	}
+	branch.append(meta, block)
+
+	return this.selectBranchUnsafe(branch)
+}
+
+// Fork, target and last timestamps the block continuing the branch blocks is checked against
+func (this *Blockchain) getBranchStateUnsafe(forkIndex uint32, blocks []safebox.BlockBase) (safebox.Fork, common.TargetBase, safebox.GetLastTimestamps, error) {
+	prevTarget := common.NewTarget(defaults.MinTarget)
+	if len(blocks) > 0 {
+		prevTarget = blocks[len(blocks)-1].GetTarget()
+	} else if forkIndex > 0 {
+		meta, err := getBlockMeta(this.storage, forkIndex-1)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		prevTarget = common.NewTarget(meta.Target)
+	}
+
+	getLastTimestamps := func(count uint32) []uint32 {
+		timestamps := make([]uint32, 0, count)
+		for index := len(blocks) - 1; index >= 0 && uint32(len(timestamps)) < count; index-- {
+			timestamps = append(timestamps, blocks[index].GetTimestamp())
+		}
+		for index := forkIndex; index > 0 && uint32(len(timestamps)) < count; index-- {
+			meta, err := getBlockMeta(this.storage, index-1)
+			if err != nil {
+				break
+			}
+			timestamps = append(timestamps, meta.Timestamp)
+		}
+		return timestamps
+	}
+
+	fork := safebox.GetActiveFork(this.GetParams(), forkIndex+uint32(len(blocks)), nil)
+	return fork, common.NewTarget(fork.GetNextTarget(prevTarget, getLastTimestamps)), getLastTimestamps, nil
+}
+
+// The branch replaces the main chain blocks it competes with once it has more work,
+// equal work is resolved in favor of the lowest tip hash so that every node settles on the same branch
+func (this *Blockchain) selectBranchUnsafe(branch *sideBranch) error {
+	height, _ := this.safebox.GetState()
+	mainWork := this.GetCumulativeWork(height - 1)
+	if mainWork == nil {
+		return fmt.Errorf("Failed to get block %d cumulative work", height-1)
+	}
+	if forkIndex := branch.getForkIndex(); forkIndex > 0 {
+		below := this.GetCumulativeWork(forkIndex - 1)
+		if below == nil {
+			return fmt.Errorf("Failed to get block %d cumulative work", forkIndex-1)
+		}
+		mainWork.Sub(mainWork, below)
+	}
+
+	if GetBranchWork(branch.blocks).Cmp(mainWork) < 0 {
+		return nil
+	}
+
+	mainBlocks := make([]safebox.BlockBase, 0, height-branch.getForkIndex())
+	for index := branch.getForkIndex(); index < height; index++ {
+		meta, err := getBlockMeta(this.storage, index)
+		if err != nil {
+			return err
+		}
+		block, err := safebox.NewBlockWithParams(this.GetParams(), meta)
+		if err != nil {
+			return err
+		}
+		mainBlocks = append(mainBlocks, block)
+	}
+	if best := SelectBestBranch(mainBlocks, branch.blocks); len(best) == 0 || best[0] != branch.blocks[0] {
+		return nil
+	}
+	return this.reorganizeUnsafe(branch)
+}
+
+// Reverts the main chain down to the branch fork point and applies the branch instead,
+// the main chain is restored if any of the branch blocks turns out to be invalid
+func (this *Blockchain) reorganizeUnsafe(branch *sideBranch) error {
+	forkIndex := branch.getForkIndex()
+	height, _ := this.safebox.GetState()
+	for index := forkIndex; index < height; index++ {
+		if _, err := this.storage.GetUndo(index); err != nil {
+			return fmt.Errorf("Block %d can't be reverted: %v", index, err)
+		}
+	}
+
+	reverted, err := this.revertBlocksUnsafe(height - forkIndex)
+	if err != nil {
+		return err
+	}
+
+	for index := range branch.blocks {
+		if err := this.applyBlockUnsafe(branch.metas[index], branch.blocks[index]); err != nil {
+			this.truncateSideBranchUnsafe(branch, index)
+			if _, revertErr := this.revertBlocksUnsafe(uint32(index)); revertErr != nil {
+				return revertErr
+			}
+			for index := range reverted.blocks {
+				if restoreErr := this.applyBlockUnsafe(reverted.metas[index], reverted.blocks[index]); restoreErr != nil {
+					return restoreErr
+				}
+			}
+			return fmt.Errorf("Side block %d: %v", branch.blocks[index].GetIndex(), err)
+		}
+	}
+	utils.Tracef("Switched to side branch %d - %d, %d blocks reverted", branch.getForkIndex(), branch.getTipIndex(), len(reverted.blocks))
+
+	// Branches continuing the reverted blocks are dropped, the reverted blocks become a side branch themselves
+	sideBranches := make([]*sideBranch, 0, len(this.sideBranches))
+	for _, side := range this.sideBranches {
+		if side != branch && side.getForkIndex() <= forkIndex {
+			sideBranches = append(sideBranches, side)
+		}
+	}
+	if len(reverted.blocks) > 0 {
+		sideBranches = append(sideBranches, reverted)
+	}
+	this.sideBranches = sideBranches
+
+	filter := this.operationFilter
+	for _, block := range reverted.blocks {
+		operations := block.GetOperations()
+		for index := range operations {
+			this.addOperation(filter, &operations[index])
+		}
+	}
+	return nil
+}
+
+// Reverts the count of top main chain blocks, returns them as a branch
+func (this *Blockchain) revertBlocksUnsafe(count uint32) (*sideBranch, error) {
+	reverted := &sideBranch{
+		metas:  make([]*safebox.BlockMetadata, count),
+		blocks: make([]safebox.BlockBase, count),
+	}
+	for index := int(count) - 1; index >= 0; index-- {
+		meta, err := this.revertBlockUnsafe()
+		if err != nil {
+			return nil, err
+		}
+		block, err := safebox.NewBlockWithParams(this.GetParams(), meta)
+		if err != nil {
+			return nil, err
+		}
+		reverted.metas[index] = meta
+		reverted.blocks[index] = block
+	}
+	return reverted, nil
+}
+
+// Restores the state prior to the top main chain block using its undo data
+func (this *Blockchain) revertBlockUnsafe() (*safebox.BlockMetadata, error) {
+	height, _ := this.safebox.GetState()
+	if height == 0 {
+		return nil, errors.New("Nothing to revert")
+	}
+	index := height - 1
+
+	meta, err := getBlockMeta(this.storage, index)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := this.storage.GetUndo(index)
+	if err != nil {
+		return nil, err
+	}
+	var undo blockUndo
+	if err := utils.Deserialize(&undo, bytes.NewBuffer(serialized)); err != nil {
+		return nil, err
+	}
+
+	reverted, err := this.safebox.Revert(undo.Accounts)
+	if err != nil {
+		return nil, err
+	}
+	err = this.storage.Revert(index, func(fn func(number uint32, data []byte) error) error {
+		for index := range undo.Accounts {
+			if err := fn(undo.Accounts[index].Number, utils.Serialize(&undo.Accounts[index])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		utils.Tracef("Error reverting blockchain state: %v", err)
+		return nil, err
+	}
+
+	var topBlock *safebox.BlockMetadata
+	if index > 0 {
+		if topBlock, err = getBlockMeta(this.storage, index-1); err != nil {
+			return nil, err
+		}
+	}
+	this.safebox = reverted
+	this.target = getNextTarget(reverted, topBlock)
+
+	this.workLock.Lock()
+	if uint32(len(this.cumulativeWork)) > index {
+		this.cumulativeWork = this.cumulativeWork[:index]
+	}
+	this.workLock.Unlock()
+
+	return meta, nil
+}
+
+// Keeps the branch blocks below the first invalid one
+func (this *Blockchain) truncateSideBranchUnsafe(branch *sideBranch, length int) {
+	branch.metas = branch.metas[:length]
+	branch.blocks = branch.blocks[:length]
+	if length != 0 {
+		return
+	}
+	for index, side := range this.sideBranches {
+		if side == branch {
+			this.sideBranches = append(this.sideBranches[:index], this.sideBranches[index+1:]...)
+			return
+		}
+	}
+}
+
+func (this *Blockchain) pruneSideBranchesUnsafe() {
+	height, _ := this.safebox.GetState()
+	sideBranches := this.sideBranches[:0]
+	for _, branch := range this.sideBranches {
+		if branch.getTipIndex()+defaults.SideChainDepth >= height {
+			sideBranches = append(sideBranches, branch)
+		}
+	}
+	this.sideBranches = sideBranches
+}
+
+func (this *Blockchain) GetSideBlocks(index uint32) []safebox.BlockBase {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	blocks := make([]safebox.BlockBase, 0)
+	for _, branch := range this.sideBranches {
+		block := branch.get(index)
+		if block == nil {
+			continue
+		}
+		duplicate := false
+		for _, known := range blocks {
+			duplicate = duplicate || bytes.Equal(known.GetHash(), block.GetHash())
+		}
+		if !duplicate {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,104 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+)
+
+type OperationRef struct {
+	Height    uint32
+	Index     uint32
+	OpHash    []byte
+	Operation tx.Tx
+}
+
+func OperationsForAccount(block safebox.BlockBase, number uint32) []OperationRef {
+	result := make([]OperationRef, 0)
+	operations := block.GetOperations()
+	for index := range operations {
+		for _, affected := range operations[index].GetAffectedAccounts() {
+			if affected == number {
+				result = append(result, OperationRef{
+					Height:    block.GetIndex(),
+					Index:     uint32(index),
+					OpHash:    operations[index].GetTxId(),
+					Operation: operations[index],
+				})
+				break
+			}
+		}
+	}
+	return result
+}
+
+func (this *Blockchain) AccountHistory(number uint32, fromHeight, toHeight uint32) ([]OperationRef, error) {
+	if fromHeight > toHeight {
+		return nil, fmt.Errorf("Invalid range %d-%d", fromHeight, toHeight)
+	}
+	if toHeight-fromHeight >= defaults.MaxAccountHistoryBlocks {
+		toHeight = fromHeight + defaults.MaxAccountHistoryBlocks - 1
+	}
+	if height, _ := this.GetState(); toHeight >= height {
+		if height == 0 {
+			return []OperationRef{}, nil
+		}
+		toHeight = height - 1
+	}
+
+	result := make([]OperationRef, 0)
+	for index := fromHeight; index <= toHeight; index++ {
+		block, err := this.GetBlock(index)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			break
+		}
+		result = append(result, OperationsForAccount(block, number)...)
+	}
+	return result, nil
+}
+
+// Looks for the operation in the most recent blocks only
+func (this *Blockchain) IsOperationConfirmed(opHash []byte) (height uint32, ok bool) {
+	top, _ := this.GetState()
+	for index := top; index > 0 && top-index < defaults.MaxConfirmationBlocks; index-- {
+		block, err := this.GetBlock(index - 1)
+		if err != nil || block == nil {
+			break
+		}
+		operations := block.GetOperations()
+		for i := range operations {
+			if bytes.Equal(operations[i].GetTxId(), opHash) {
+				return block.GetIndex(), true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,122 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestAccountHistory(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestBlocks(t, blockchain, defaults.MinTarget, 4)
+
+		operations := map[uint32][]tx.Tx{
+			0: {*getTestTransfer(t, 1, 2), *getTestTransfer(t, 3, 4)},
+			2: {*getTestTransfer(t, 5, 1)},
+			3: {*getTestTransfer(t, 1, 6), *getTestTransfer(t, 7, 8)},
+		}
+		for index, ops := range operations {
+			block, err := blockchain.GetBlock(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+			meta.Index = index
+			meta.Timestamp = block.GetTimestamp()
+			meta.PrevSafeBoxHash = block.GetPrevSafeBoxHash()
+			meta.Operations = ops
+			blockchain.storage.Store(index, utils.Serialize(meta), func(fn func(number uint32, data []byte) error) error {
+				return nil
+			})
+		}
+
+		check := func(number, from, to uint32, expected ...tx.Tx) {
+			history, err := blockchain.AccountHistory(number, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != len(expected) {
+				t.Fatalf("account %d: %d != %d", number, len(history), len(expected))
+			}
+			for index := range history {
+				if !bytes.Equal(history[index].OpHash, expected[index].GetTxId()) {
+					t.Fatalf("account %d: unexpected operation #%d", number, index)
+				}
+			}
+		}
+
+		check(1, 0, 3, operations[0][0], operations[2][0], operations[3][0])
+		check(1, 1, 2, operations[2][0])
+		check(1, 0, 100, operations[0][0], operations[2][0], operations[3][0])
+		check(4, 0, 3, operations[0][1])
+		check(9, 0, 3)
+
+		history, _ := blockchain.AccountHistory(1, 0, 3)
+		if history[1].Height != 2 || history[1].Index != 0 || history[2].Height != 3 {
+			t.FailNow()
+		}
+
+		if _, err := blockchain.AccountHistory(1, 3, 0); err == nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestIsOperationConfirmed(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestMaturedBlocks(t, blockchain, key)
+
+		operation := getTestSignedTransfer(t, key, 0, 1, 1, 1)
+		if _, err := blockchain.AddOperation(&operation); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := blockchain.IsOperationConfirmed(operation.GetTxId()); ok {
+			t.FailNow()
+		}
+
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Operations = blockchain.GetPendingOperations()
+		if err := blockchain.AddBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+		addTestBlocks(t, blockchain, defaults.MinTarget, 2)
+
+		if height, ok := blockchain.IsOperationConfirmed(operation.GetTxId()); !ok || height != meta.Index {
+			t.Fatalf("%d %v", height, ok)
+		}
+		if _, ok := blockchain.IsOperationConfirmed(getTestTransfer(t, 1, 2).GetTxId()); ok {
+			t.FailNow()
+		}
+	})
+}
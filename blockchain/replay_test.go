@@ -0,0 +1,107 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pasl-project/pasl/safebox"
+)
+
+// Consecutive mainnet blocks, hex encoded, starting from genesis
+const testMainnetBlocks = "mainnet_blocks.hex"
+
+func loadTestBlocks(t *testing.T, name string) []safebox.SerializedBlock {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := make([]safebox.SerializedBlock, 0)
+	reader := bytes.NewBuffer(stream)
+	for reader.Len() > 0 {
+		var block safebox.SerializedBlock
+		if err := block.Deserialize(reader); err != nil {
+			t.Fatalf("block #%d: %v", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestReplayMainnet(t *testing.T) {
+	blocks := loadTestBlocks(t, testMainnetBlocks)
+	if len(blocks) == 0 {
+		t.FailNow()
+	}
+
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		for index := range blocks {
+			// Every captured block commits to the safebox hash produced by its predecessors
+			if height, safeboxHash := blockchain.GetState(); !bytes.Equal(safeboxHash, blocks[index].Header.PrevSafeboxHash) {
+				t.Fatalf("block #%d: safebox hash %x != %x", height, safeboxHash, blocks[index].Header.PrevSafeboxHash)
+			}
+			if err := blockchain.AddBlockSerialized(&blocks[index]); err != nil {
+				t.Fatalf("block #%d: %v", blocks[index].Header.Index, err)
+			}
+			if height, _ := blockchain.GetState(); height != blocks[index].Header.Index+1 {
+				t.Fatalf("block #%d was not applied", blocks[index].Header.Index)
+			}
+
+			block, err := blockchain.GetBlock(blocks[index].Header.Index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serialized := block.Serialize()
+			if diff := serialized.Diff(&blocks[index]); diff != "" {
+				t.Fatalf("block #%d: stored block differs in %s", blocks[index].Header.Index, diff)
+			}
+		}
+
+		if err := blockchain.safebox.CheckTotalBalance(); err != nil {
+			t.Fatal(err)
+		}
+		if err := blockchain.safebox.CheckAccounts(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Checkpoints are the published mainnet safebox hashes, the replay is conclusive only once it reaches one
+		height, safeboxHash := blockchain.GetState()
+		expected, ok := blockchain.GetParams().Checkpoints[height]
+		if !ok {
+			t.Skipf("no published safebox hash at height %d, the fixture has to be extended up to a checkpoint", height)
+		}
+		if !bytes.Equal(safeboxHash, expected[:]) {
+			t.Fatalf("height %d: safebox hash %x != %x published", height, safeboxHash, expected)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/safebox"
+)
+
+func (this *Blockchain) GetCumulativeWork(index uint32) *big.Int {
+	this.workLock.Lock()
+	defer this.workLock.Unlock()
+
+	for uint32(len(this.cumulativeWork)) <= index {
+		meta, err := getBlockMeta(this.storage, uint32(len(this.cumulativeWork)))
+		if err != nil {
+			return nil
+		}
+		work := common.NewTarget(meta.Target).GetWork()
+		if len(this.cumulativeWork) > 0 {
+			work.Add(work, this.cumulativeWork[len(this.cumulativeWork)-1])
+		}
+		this.cumulativeWork = append(this.cumulativeWork, work)
+	}
+
+	return big.NewInt(0).Set(this.cumulativeWork[index])
+}
+
+func GetBranchWork(blocks []safebox.BlockBase) *big.Int {
+	work := big.NewInt(0)
+	for _, block := range blocks {
+		work.Add(work, block.GetTarget().GetWork())
+	}
+	return work
+}
+
+func getTipHash(branch []safebox.BlockBase) []byte {
+	if len(branch) == 0 {
+		return nil
+	}
+	return branch[len(branch)-1].GetHash()
+}
+
+func SelectBestBranch(branches ...[]safebox.BlockBase) (best []safebox.BlockBase) {
+	var bestWork *big.Int
+	for _, branch := range branches {
+		work := GetBranchWork(branch)
+		if bestWork == nil || work.Cmp(bestWork) > 0 || (work.Cmp(bestWork) == 0 && bytes.Compare(getTipHash(branch), getTipHash(best)) < 0) {
+			best = branch
+			bestWork = work
+		}
+	}
+	return best
+}
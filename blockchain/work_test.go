@@ -0,0 +1,300 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+)
+
+func TestGetCumulativeWork(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestBlocks(t, blockchain, defaults.MinTarget, 3)
+
+		work := common.NewTarget(defaults.MinTarget).GetWork()
+		if blockchain.GetCumulativeWork(0).Cmp(work) != 0 {
+			t.FailNow()
+		}
+		work.Mul(work, big.NewInt(3))
+		if blockchain.GetCumulativeWork(2).Cmp(work) != 0 {
+			t.FailNow()
+		}
+		if blockchain.GetCumulativeWork(3) != nil {
+			t.FailNow()
+		}
+	})
+}
+
+func getTestBranch(t *testing.T, blockchain *Blockchain, targets ...uint32) []safebox.BlockBase {
+	branch := make([]safebox.BlockBase, 0, len(targets))
+	for _, target := range targets {
+		block, err := safebox.NewBlock(getTestBlockMeta(blockchain, target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		branch = append(branch, block)
+	}
+	return branch
+}
+
+func TestSelectBestBranch(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		easy := getTestBranch(t, blockchain, defaults.MinTarget, defaults.MinTarget, defaults.MinTarget)
+		hard := getTestBranch(t, blockchain, defaults.MinTarget, 0x25000000, defaults.MinTarget)
+
+		if best := SelectBestBranch(easy, hard); len(best) == 0 || best[1] != hard[1] {
+			t.FailNow()
+		}
+		if best := SelectBestBranch(hard, easy); len(best) == 0 || best[1] != hard[1] {
+			t.FailNow()
+		}
+	})
+}
+
+func TestSelectBestBranchTie(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		first := getTestBranch(t, blockchain, defaults.MinTarget)
+		meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		meta.Timestamp++
+		second, err := safebox.NewBlock(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := first[0]
+		if bytes.Compare(second.GetHash(), first[0].GetHash()) < 0 {
+			expected = second
+		}
+		if best := SelectBestBranch(first, []safebox.BlockBase{second}); len(best) != 1 || best[0] != expected {
+			t.FailNow()
+		}
+		if best := SelectBestBranch([]safebox.BlockBase{second}, first); len(best) != 1 || best[0] != expected {
+			t.FailNow()
+		}
+	})
+}
+
+func TestSideBlocks(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		competing := getTestBlockMeta(blockchain, defaults.MinTarget)
+		competing.Timestamp++
+		addTestBlocks(t, blockchain, defaults.MinTarget, 1)
+		main, err := blockchain.GetBlock(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := blockchain.AddBlock(competing); err != nil {
+			t.Fatal(err)
+		}
+		if err := blockchain.AddBlock(competing); err != nil {
+			t.Fatal(err)
+		}
+		if height, _ := blockchain.GetState(); height != 1 {
+			t.Fatalf("%d != 1", height)
+		}
+
+		// Equal work, the lowest tip hash stays on the main chain
+		competingBlock, err := safebox.NewBlock(competing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		best := SelectBestBranch([]safebox.BlockBase{main}, []safebox.BlockBase{competingBlock})
+		tip, err := blockchain.GetBlock(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tip.GetHash(), best[0].GetHash()) {
+			t.FailNow()
+		}
+		side := blockchain.GetSideBlocks(0)
+		if len(side) != 1 || bytes.Equal(side[0].GetHash(), best[0].GetHash()) {
+			t.FailNow()
+		}
+
+		addTestBlocks(t, blockchain, defaults.MinTarget, int(defaults.SideChainDepth)+1)
+		if len(blockchain.GetSideBlocks(0)) != 0 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestSideBlocksConvergence(t *testing.T) {
+	var first, second *safebox.BlockMetadata
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		first = getTestBlockMeta(blockchain, defaults.MinTarget)
+		second = getTestBlockMeta(blockchain, defaults.MinTarget)
+		second.Timestamp++
+	})
+
+	// Nodes receiving the competing blocks in a different order end up on the same tip
+	var tips [][]byte
+	for _, order := range [][]*safebox.BlockMetadata{{first, second}, {second, first}} {
+		withTestBlockchain(t, func(blockchain *Blockchain) {
+			for _, meta := range order {
+				if err := blockchain.AddBlock(meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tip, err := blockchain.GetBlock(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tips = append(tips, tip.GetHash())
+		})
+	}
+	if !bytes.Equal(tips[0], tips[1]) {
+		t.FailNow()
+	}
+}
+
+func TestSideBlocksValidation(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestBlocks(t, blockchain, defaults.MinTarget, 1)
+		early := getTestBlockMeta(blockchain, defaults.MinTarget)
+		future := getTestBlockMeta(blockchain, defaults.MinTarget)
+		addTestBlocks(t, blockchain, defaults.MinTarget, 2)
+
+		// Side blocks are checked before they are stored, the same way the main chain ones are
+		early.Timestamp = 1500000000 - 1
+		future.Timestamp = uint32(blockchain.GetClock().Now().Unix()) + defaults.MaxFutureBlockTime + 60
+		for _, meta := range []*safebox.BlockMetadata{early, future} {
+			if err := blockchain.AddBlock(meta); err == nil {
+				t.FailNow()
+			}
+		}
+		if len(blockchain.GetSideBlocks(1)) != 0 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestMaxReorgDepth(t *testing.T) {
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		deep := getTestBlockMeta(blockchain, defaults.MinTarget)
+		deep.Timestamp++
+		addTestBlocks(t, blockchain, defaults.MinTarget, int(defaults.MaxReorgDepth)-1)
+		shallow := getTestBlockMeta(blockchain, defaults.MinTarget)
+		shallow.Timestamp++
+		addTestBlocks(t, blockchain, defaults.MinTarget, 2)
+		height, safeboxHash := blockchain.GetState()
+
+		if err := blockchain.AddBlock(deep); err != ErrReorgTooDeep {
+			t.Fatal(err)
+		}
+		if err := blockchain.AddBlock(shallow); err != nil {
+			t.Fatal(err)
+		}
+
+		// Replaying the main chain block at the same depth is fine
+		main, err := getBlockMeta(blockchain.storage, deep.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blockchain.AddBlock(main); err != nil {
+			t.Fatal(err)
+		}
+		if newHeight, newSafeboxHash := blockchain.GetState(); newHeight != height || !bytes.Equal(newSafeboxHash, safeboxHash) {
+			t.FailNow()
+		}
+	})
+}
+
+func TestReorg(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operation := getTestSignedTransfer(t, key, 0, 1, 1, 1)
+
+	// The competing branch is one block longer than the main chain above the fork point
+	var branch []*safebox.BlockMetadata
+	var branchHeight uint32
+	var branchHash []byte
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestMaturedBlocks(t, blockchain, key)
+		for i := 0; i < 3; i++ {
+			meta := getTestBlockMeta(blockchain, defaults.MinTarget)
+			meta.Timestamp++
+			if err := blockchain.AddBlock(meta); err != nil {
+				t.Fatal(err)
+			}
+			branch = append(branch, meta)
+		}
+		branchHeight, branchHash = blockchain.GetState()
+	})
+
+	withTestBlockchain(t, func(blockchain *Blockchain) {
+		addTestMaturedBlocks(t, blockchain, key)
+		mainMeta := getTestBlockMeta(blockchain, defaults.MinTarget)
+		mainMeta.Operations = []tx.Tx{operation}
+		if err := blockchain.AddBlock(mainMeta); err != nil {
+			t.Fatal(err)
+		}
+		addTestBlocks(t, blockchain, defaults.MinTarget, 1)
+		height, safeboxHash := blockchain.GetState()
+		if blockchain.GetCumulativeWork(height-1) == nil {
+			t.FailNow()
+		}
+
+		if err := blockchain.AddBlock(branch[0]); err != nil {
+			t.Fatal(err)
+		}
+		if newHeight, newSafeboxHash := blockchain.GetState(); newHeight != height || !bytes.Equal(newSafeboxHash, safeboxHash) {
+			t.FailNow()
+		}
+		for _, meta := range branch[1:] {
+			if err := blockchain.AddBlock(meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if newHeight, newSafeboxHash := blockchain.GetState(); newHeight != branchHeight || !bytes.Equal(newSafeboxHash, branchHash) {
+			t.Fatalf("%d != %d", newHeight, branchHeight)
+		}
+
+		work := common.NewTarget(defaults.MinTarget).GetWork()
+		work.Mul(work, big.NewInt(int64(branchHeight)))
+		if blockchain.GetCumulativeWork(branchHeight-1).Cmp(work) != 0 {
+			t.FailNow()
+		}
+
+		// The reverted blocks become a side branch, their operations return to the pool
+		main, err := safebox.NewBlock(mainMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if side := blockchain.GetSideBlocks(mainMeta.Index); len(side) != 1 || !bytes.Equal(side[0].GetHash(), main.GetHash()) {
+			t.FailNow()
+		}
+		if pending := blockchain.GetPendingOperations(); len(pending) != 1 || pending[0].GetTxIdString() != operation.GetTxIdString() {
+			t.FailNow()
+		}
+	})
+}
@@ -0,0 +1,42 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"math"
+)
+
+func AddIndex(index uint32, delta uint32) (uint32, error) {
+	if index > math.MaxUint32-delta {
+		return 0, fmt.Errorf("Block index overflow %d + %d", index, delta)
+	}
+	return index + delta, nil
+}
+
+func SubIndex(index uint32, delta uint32) (uint32, error) {
+	if index < delta {
+		return 0, fmt.Errorf("Block index underflow %d - %d", index, delta)
+	}
+	return index - delta, nil
+}
@@ -0,0 +1,49 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddIndex(t *testing.T) {
+	if index, err := AddIndex(math.MaxUint32-1, 1); err != nil || index != math.MaxUint32 {
+		t.Fatalf("%d %v", index, err)
+	}
+	if _, err := AddIndex(math.MaxUint32, 1); err == nil {
+		t.FailNow()
+	}
+	if _, err := AddIndex(math.MaxUint32-10, 50); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestSubIndex(t *testing.T) {
+	if index, err := SubIndex(math.MaxUint32, math.MaxUint32); err != nil || index != 0 {
+		t.Fatalf("%d %v", index, err)
+	}
+	if _, err := SubIndex(0, 1); err == nil {
+		t.FailNow()
+	}
+}
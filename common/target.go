@@ -39,6 +39,8 @@ type target struct {
 type TargetBase interface {
 	GetCompact() uint32
 	Get() *big.Int
+	GetWork() *big.Int
+	Difficulty() float64
 	Check(pow []byte) bool
 	Equal(other TargetBase) bool
 	Set(uint32)
@@ -61,6 +63,23 @@ func (this *target) Get() *big.Int {
 	return this.value
 }
 
+func (this *target) GetWork() *big.Int {
+	divisor := big.NewInt(0).Add(this.value, big.NewInt(1))
+	work := big.NewInt(0).Lsh(big.NewInt(1), 256)
+	return work.Div(work, divisor)
+}
+
+// Relative to the minimum difficulty target, which has difficulty 1
+func (this *target) Difficulty() float64 {
+	max := fromCompact(defaults.MinTarget)
+	if this.value.Cmp(max) >= 0 {
+		return 1.0
+	}
+	quotient := new(big.Float).SetInt(max)
+	difficulty, _ := quotient.Quo(quotient, new(big.Float).SetInt(this.value)).Float64()
+	return difficulty
+}
+
 func (this *target) Check(pow []byte) bool {
 	result := &big.Int{}
 	result.SetBytes(pow)
@@ -24,6 +24,7 @@ package common
 
 import (
 	"encoding/hex"
+	"math"
 	"testing"
 )
 
@@ -59,3 +60,33 @@ func TestCheck(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestGetWork(t *testing.T) {
+	easy := NewTarget(0x24000000).GetWork()
+	hard := NewTarget(0x25000000).GetWork()
+	if easy.Sign() <= 0 || hard.Cmp(easy) <= 0 {
+		t.Fatalf("%s %s", easy.Text(16), hard.Text(16))
+	}
+
+	valid := "1000000800"
+	if got := NewTarget(0x24000000).GetWork().Text(16); got != valid {
+		t.Errorf("\n%s !=\n%s", got, valid)
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	for _, vector := range []struct {
+		compact    uint32
+		difficulty float64
+	}{
+		{0x12345678, 1.1138613675687663},
+		{0x24000000, 1.0},
+		{0x24800000, 1.3333333465788104},
+		{0x25000000, 2.0},
+		{0x2E83D83F, 1379.1416850125488},
+	} {
+		if difficulty := NewTarget(vector.compact).Difficulty(); math.Abs(difficulty-vector.difficulty) > 1e-9 {
+			t.Errorf("%08x: %v != %v", vector.compact, difficulty, vector.difficulty)
+		}
+	}
+}
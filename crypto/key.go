@@ -141,6 +141,26 @@ func (this *Public) Equal(other *Public) bool {
 	return this.X.Cmp(other.X) == 0 && this.Y.Cmp(other.Y) == 0
 }
 
+func (this *Public) Verify(data []byte, signature *Signature) error {
+	curve, err := CurveById(this.TypeId)
+	if err != nil {
+		return err
+	}
+	if !isOnCurve(curve, this.X, this.Y) {
+		return errors.New("Is not on curve")
+	}
+
+	public := ecdsa.PublicKey{
+		Curve: curve,
+		X:     this.X,
+		Y:     this.Y,
+	}
+	if !ecdsa.Verify(&public, data, signature.R, signature.S) {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
 func (this *Public) Serialize(w io.Writer) error {
 	_, err := w.Write(utils.Serialize(this.Serialized()))
 	return err
@@ -151,15 +171,30 @@ func (this *Public) Deserialize(r io.Reader) error {
 	if err := utils.Deserialize(&serialized, r); err != nil {
 		return err
 	}
+	if serialized.isNil() {
+		*this = *NewKeyNil().Public
+		return nil
+	}
 	return PublicFromSerialized(this, &serialized)
 }
 
 func (this *Public) Serialized() PublicSerialized {
-	return PublicSerialized{
+	serialized := PublicSerialized{
 		TypeId: this.TypeId,
-		X:      this.X.Bytes(),
-		Y:      this.Y.Bytes(),
+		X:      []byte{},
+		Y:      []byte{},
+	}
+	if this.X != nil {
+		serialized.X = this.X.Bytes()
 	}
+	if this.Y != nil {
+		serialized.Y = this.Y.Bytes()
+	}
+	return serialized
+}
+
+func (this *PublicSerialized) isNil() bool {
+	return this.TypeId == 0 && len(this.X) == 0 && len(this.Y) == 0
 }
 
 func (this *Public) SerializedPlain() PublicSerializedPlain {
@@ -184,7 +219,7 @@ func PublicFromSerialized(public *Public, serialized *PublicSerialized) error {
 	x.SetBytes(serialized.X)
 	y := &big.Int{}
 	y.SetBytes(serialized.Y)
-	if !curve.IsOnCurve(x, y) {
+	if !isOnCurve(curve, x, y) {
 		return errors.New("Is not on curve")
 	}
 
@@ -195,13 +230,21 @@ func PublicFromSerialized(public *Public, serialized *PublicSerialized) error {
 	return nil
 }
 
+func isOnCurve(curve elliptic.Curve, x, y *big.Int) bool {
+	p := curve.Params().P
+	if x.Sign() < 0 || y.Sign() < 0 || x.Cmp(p) >= 0 || y.Cmp(p) >= 0 {
+		return false
+	}
+	return curve.IsOnCurve(x, y)
+}
+
 func NewPublic(data []byte) (*Public, error) {
 	var serialized PublicSerialized
 	if err := utils.Deserialize(&serialized, bytes.NewBuffer(data)); err != nil {
 		return nil, err
 	}
 
-	if serialized.TypeId == 0 && len(serialized.X) == 0 && len(serialized.Y) == 0 {
+	if serialized.isNil() {
 		return NewKeyNil().Public, nil
 	}
 
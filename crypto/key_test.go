@@ -0,0 +1,164 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/pasl-project/pasl/utils"
+)
+
+func sign(t *testing.T, key *Key, data []byte) *Signature {
+	private := &ecdsa.PrivateKey{
+		PublicKey: key.Public.PublicKey,
+		D:         (&big.Int{}).SetBytes(key.Private),
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, private, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Signature{R: r, S: s}
+}
+
+func TestVerify(t *testing.T) {
+	hash := sha256.Sum256([]byte("PASL"))
+	for _, typeId := range []uint16{NIDsecp256k1, NIDsecp384r1} {
+		key, err := NewKey(typeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public, err := NewPublic(utils.Serialize(key.Public))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature := sign(t, key, hash[:])
+		if err := public.Verify(hash[:], signature); err != nil {
+			t.Fatalf("curve %d: %v", typeId, err)
+		}
+
+		signature.S.Add(signature.S, big.NewInt(1))
+		if err := public.Verify(hash[:], signature); err == nil {
+			t.Fatalf("curve %d: tampered signature accepted", typeId)
+		}
+	}
+}
+
+func TestVerifyCurveMismatch(t *testing.T) {
+	hash := sha256.Sum256([]byte("PASL"))
+	key, err := NewKey(NIDsecp384r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := sign(t, key, hash[:])
+
+	key.Public.TypeId = NIDsecp256k1
+	if err := key.Public.Verify(hash[:], signature); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestUnknownCurve(t *testing.T) {
+	key, err := NewKey(NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := key.Public.Serialized()
+	serialized.TypeId = 1
+	if _, err := NewPublic(utils.Serialize(&serialized)); err == nil {
+		t.FailNow()
+	}
+
+	key.Public.TypeId = 1
+	if err := key.Public.Verify([]byte{}, &Signature{R: big.NewInt(1), S: big.NewInt(1)}); err == nil {
+		t.FailNow()
+	}
+
+	if !bytes.Equal(utils.Serialize(&serialized)[:2], []byte{0x01, 0x00}) {
+		t.FailNow()
+	}
+}
+
+func TestPublicVectors(t *testing.T) {
+	vectors := []struct {
+		typeId uint16
+		data   string
+	}{
+		// Miner key taken from a mainnet block
+		{NIDsecp256k1, "ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901"},
+		{NIDsecp256k1, "ca02200079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817982000483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"},
+		{NIDsecp384r1, "cb023000aa87ca22be8b05378eb1c71ef320ad746e1d3b628ba79b9859f741e082542a385502f25dbf55296c3a545e3872760ab730003617de4a96262c6f5d9e98bf9292dc29f8f41dbd289a147ce9da3113b5f0b8c00a60b1ce1d7e819d7a431d7c90ea0e5f"},
+		{NIDsecp521r1, "cc024100c6858e06b70404e9cd9e3ecb662395b4429c648139053fb521f828af606b4d3dbaa14b5e77efe75928fe1dc127a2ffa8de3348b3c1856a429bf97e7e31c2e5bd664200011839296a789a3bc0045c8a5fb42c7d1bd998f54449579b446817afbd17273e662c97ee72995ef42640c550b9013fad0761353c7086a272c24088be94769fd16650"},
+		{NIDsect283k1, "d90224000503213f78ca44883f1a3b8162f188e553cd265f23c1567a16876913b0c2ac2458492836240001ccda380f1c9e318d90f95d07e5426fe87e45c0e8184698e45962364e34116177dd2259"},
+		{0, "000000000000"},
+	}
+
+	for _, vector := range vectors {
+		data, _ := hex.DecodeString(vector.data)
+
+		var public Public
+		if err := public.Deserialize(bytes.NewBuffer(data)); err != nil {
+			t.Fatalf("curve %d: %v", vector.typeId, err)
+		}
+		if public.TypeId != vector.typeId {
+			t.Fatalf("curve %d: unexpected type id %d", vector.typeId, public.TypeId)
+		}
+		if serialized := utils.Serialize(&public); !bytes.Equal(serialized, data) {
+			t.Fatalf("curve %d: %x != %s", vector.typeId, serialized, vector.data)
+		}
+
+		parsed, err := NewPublic(data)
+		if err != nil {
+			t.Fatalf("curve %d: %v", vector.typeId, err)
+		}
+		if !parsed.Equal(&public) {
+			t.Fatalf("curve %d: NewPublic mismatch", vector.typeId)
+		}
+	}
+}
+
+func TestPublicRoundTrip(t *testing.T) {
+	for _, typeId := range []uint16{NIDsecp256k1, NIDsecp384r1, NIDsecp521r1, NIDsect283k1} {
+		for i := 0; i < 4; i++ {
+			key, err := NewKey(typeId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := utils.Serialize(key.Public)
+
+			var public Public
+			if err := public.Deserialize(bytes.NewBuffer(data)); err != nil {
+				t.Fatalf("curve %d: %v", typeId, err)
+			}
+			if !public.Equal(key.Public) || !bytes.Equal(utils.Serialize(&public), data) {
+				t.Fatalf("curve %d: round trip mismatch", typeId)
+			}
+		}
+	}
+}
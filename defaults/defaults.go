@@ -40,9 +40,32 @@ const (
 	P2PPort                 uint16        = 4004
 	TimeoutConnect          time.Duration = time.Duration(10) * time.Second
 	TimeoutRequest          time.Duration = time.Duration(60) * time.Second
+	HandshakeTimeout        time.Duration = time.Duration(30) * time.Second
 	MaxIncoming             uint32        = 100
 	MaxOutgoing             uint32        = 10
+	MaxPeers                int           = 1000
 	NetworkBlocksPerRequest uint32        = 50
+	NetworkBlocksBacklog    int           = 100
+	NetworkBlocksWatermark  int           = 50
+	NetworkSeenBlocks       int           = 128
+	NetworkSeenOperations   int           = 4096
+	NetworkOpsPerRequest    int           = 1000
+	MaxMessageSize          uint32        = 32 * 1024 * 1024
+	MaxSliceLength          uint32        = 16 * 1024 * 1024
+	MaxSliceBytes           uint64        = 64 * 1024 * 1024
+	MaxAccountHistoryBlocks uint32        = 1000
+	MaxConfirmationBlocks   uint32        = 1000
+	RelayDisabled           bool          = false
+	NetworkRelayFanout      int           = 4
+	MaxSideBlocks           int           = 4
+	MaxPausedBlocks         int           = 1000
+	SideChainDepth          uint32        = 6
+	MaxReorgDepth           uint32        = 100
+	OperationsBatchWindow   time.Duration = time.Duration(100) * time.Millisecond
+	OperationsBatchCount    int           = 100
+	OperationsBatchSize     int           = 256 * 1024
+	NetworkMaxInvalidBlocks uint32        = 3
+	NetworkBanDuration      time.Duration = time.Duration(1) * time.Hour
 )
 
 const (
@@ -52,16 +75,28 @@ const (
 )
 
 const (
-	MinTarget        uint32 = 0x24000000
-	MinTargetBits    uint   = uint(MinTarget >> 24)
-	DifficultyBlocks uint32 = 10
+	MinTarget          uint32 = 0x24000000
+	MinTargetBits      uint   = uint(MinTarget >> 24)
+	DifficultyBlocks   uint32 = 10
+	BlockTime          uint32 = 300
+	MaxFutureBlockTime uint32 = 180
 )
 
 const (
-	AccountsPerBlock uint32 = 5
-	MaturationHeight uint32 = 100
+	AccountsPerBlock   uint32 = 5
+	MaturationHeight   uint32 = 100
+	MaxPayloadSize     int    = 255
+	MaxBlockOperations int    = 10000
+	MaxBlockBytes      int    = 8 * 1024 * 1024
+	MinimumFee         uint64 = 0
+	MinimumFeePerByte  uint64 = 0
+	SignatureCacheSize int    = 10000
 )
 
 var UserAgent = fmt.Sprintf("PASL v%d.%d", VersionMajor, VersionMinor)
 var GenesisSafeBox = sha256.Sum256([]byte("February 1 2017 - CNN - Trump puts on a flawless show in picking Gorsuch for Supreme Court "))
 var GenesisPow = []byte{0x00, 0x00, 0x00, 0x00, 0x0E, 0xAE, 0x7A, 0x91, 0xB7, 0x48, 0xC7, 0x35, 0xA5, 0x33, 0x8A, 0x11, 0x71, 0x5D, 0x81, 0x51, 0x01, 0xE0, 0xC0, 0x75, 0xF7, 0xC6, 0x0F, 0xA5, 0x2B, 0x76, 0x9E, 0xC7}
+
+var Checkpoints = map[uint32][32]byte{
+	29000: [32]byte{0x7A, 0x66, 0xCA, 0x0D, 0x45, 0x03, 0x8E, 0x97, 0xBA, 0xED, 0x24, 0x4B, 0x4B, 0xC5, 0x14, 0x9C, 0x1A, 0x77, 0xE8, 0x83, 0x19, 0x08, 0x20, 0x9F, 0x80, 0xCC, 0x9C, 0x09, 0x89, 0xCE, 0x3A, 0x80},
+}
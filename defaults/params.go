@@ -0,0 +1,70 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package defaults
+
+import (
+	"crypto/sha256"
+)
+
+type NetworkParams struct {
+	Name                 string
+	NetId                uint32
+	GenesisSafeBox       [32]byte
+	Checkpoints          map[uint32][32]byte
+	GenesisReward        uint64
+	MinReward            uint64
+	RewardDecreaseBlocks uint32
+	BlockTime            uint32
+	BootstrapNodes       string
+	P2PPort              uint16
+}
+
+func MainnetParams() *NetworkParams {
+	return &NetworkParams{
+		Name:                 "mainnet",
+		NetId:                NetId,
+		GenesisSafeBox:       GenesisSafeBox,
+		Checkpoints:          Checkpoints,
+		GenesisReward:        GenesisReward,
+		MinReward:            MinReward,
+		RewardDecreaseBlocks: RewardDecreaseBlocks,
+		BlockTime:            BlockTime,
+		BootstrapNodes:       BootstrapNodes,
+		P2PPort:              P2PPort,
+	}
+}
+
+func TestnetParams() *NetworkParams {
+	return &NetworkParams{
+		Name:                 "testnet",
+		NetId:                0x5891E4FE,
+		GenesisSafeBox:       sha256.Sum256([]byte("PASL testnet")),
+		Checkpoints:          map[uint32][32]byte{},
+		GenesisReward:        GenesisReward,
+		MinReward:            MinReward,
+		RewardDecreaseBlocks: RewardDecreaseBlocks,
+		BlockTime:            BlockTime,
+		BootstrapNodes:       "",
+		P2PPort:              4104,
+	}
+}
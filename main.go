@@ -24,10 +24,10 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -43,23 +43,56 @@ import (
 	"github.com/modern-go/concurrent"
 )
 
+var relayDisabled = flag.Bool("relay-disabled", defaults.RelayDisabled, "don't relay blocks and operations to the peers")
+var testnet = flag.Bool("testnet", false, "connect to the testnet instead of the mainnet")
+var seeds = flag.String("seeds", "", "comma separated host:port list of the nodes to connect to before the bootstrap ones")
+
 func main() {
+	flag.Parse()
+
 	defer utils.TimeTrack(time.Now(), "Terminated, %s elapsed")
 
-	utils.Tracef(defaults.UserAgent)
+	utils.Tracef("%s", defaults.UserAgent)
+
+	params := defaults.MainnetParams()
+	storageName := "storage.db"
+	if *testnet {
+		params = defaults.TestnetParams()
+		storageName = "testnet.db"
+	}
 
-	err := storage.WithStorage(defaults.AccountsPerBlock, func(storage *storage.Storage) error {
-		blockchain, err := blockchain.NewBlockchain(storage)
+	err := storage.WithStorageName(storageName, defaults.AccountsPerBlock, func(storage *storage.Storage) error {
+		blockchain, err := blockchain.NewBlockchainWithParams(storage, params)
 		if err != nil {
 			return err
 		}
+		defer func() {
+			if err := blockchain.SavePendingOperations(); err != nil {
+				utils.Tracef("Failed to save pending operations: %v", err)
+			}
+		}()
 
 		config := network.Config{
-			ListenAddrs:    []string{fmt.Sprintf("tcp://%s:%d", defaults.P2PBindAddress, defaults.P2PPort)},
+			ListenAddrs:    []string{fmt.Sprintf("tcp://%s:%d", defaults.P2PBindAddress, params.P2PPort)},
 			MaxIncoming:    defaults.MaxIncoming,
 			MaxOutgoing:    defaults.MaxOutgoing,
+			MaxPeers:       defaults.MaxPeers,
 			TimeoutConnect: defaults.TimeoutConnect,
 		}
+		if *seeds != "" {
+			for _, hostPort := range strings.Split(*seeds, ",") {
+				address, err := network.ParseAddressTcp(hostPort)
+				if err != nil {
+					return fmt.Errorf("Invalid seed %s: %v", hostPort, err)
+				}
+				config.Seeds = append(config.Seeds, address)
+			}
+		}
+		for _, hostPort := range strings.Split(params.BootstrapNodes, ",") {
+			if address, err := network.ParseAddressTcp(hostPort); err == nil {
+				config.Seeds = append(config.Seeds, address)
+			}
+		}
 
 		key, err := crypto.NewKey(crypto.NIDsecp256k1)
 		if err != nil {
@@ -81,16 +114,11 @@ func main() {
 		})
 		defer updatesListener.StopAndWaitForever()
 
-		return pasl.WithManager(nonce, blockchain, peerUpdates, defaults.TimeoutRequest, func(manager network.Manager) error {
+		return pasl.WithManager(nonce, blockchain, peerUpdates, pasl.ManagerOptions{
+			TimeoutRequest: defaults.TimeoutRequest,
+			RelayDisabled:  *relayDisabled,
+		}, func(manager pasl.Manager) error {
 			return network.WithNode(config, manager, func(node network.Node) error {
-				for _, hostPort := range strings.Split(defaults.BootstrapNodes, ",") {
-					hostPort := strings.Split(hostPort, ":")
-					port, err := strconv.Atoi(hostPort[1])
-					if err == nil {
-						node.AddPeer(network.NewAddressTcp(hostPort[0], uint16(port)))
-					}
-				}
-
 				c := make(chan os.Signal, 2)
 				signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 				<-c
@@ -24,6 +24,8 @@ package network
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 )
 
 type AddressType int
@@ -51,6 +53,18 @@ func NewAddressTcp(host string, port uint16) *AddressTcp {
 	}
 }
 
+func ParseAddressTcp(hostPort string) (*AddressTcp, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s: %v", port, err)
+	}
+	return NewAddressTcp(host, uint16(portNumber)), nil
+}
+
 func (this *AddressTcp) GetType() AddressType {
 	return AddressType(TCP)
 }
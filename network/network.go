@@ -31,7 +31,6 @@ import (
 
 	"github.com/pasl-project/pasl/utils"
 
-	"github.com/cevaris/ordered_map"
 	"github.com/tidwall/evio"
 )
 
@@ -44,12 +43,16 @@ type Config struct {
 	ListenAddrs    []string
 	MaxIncoming    uint32
 	MaxOutgoing    uint32
+	MaxPeers       int
 	TimeoutConnect time.Duration
+	// Dialed before any other known peer
+	Seeds []Address
 }
 
 type Node interface {
 	AddPeer(address Address) bool
 	GetPeersByType(addressType AddressType) map[Address]*Peer
+	GetPeersCount() int
 }
 
 type Peer struct {
@@ -79,9 +82,10 @@ type connection struct {
 type nodeInternal struct {
 	Config          Config
 	Server          *evio.Server
+	dial            func(addr string, timeout time.Duration) int
 	ReadyEvent      chan bool
 	StopEvent       chan<- bool
-	PeersQueue      *ordered_map.OrderedMap
+	PeersQueue      *peersQueue
 	PeersInProgress map[int]*Peer
 	PeersLock       sync.RWMutex
 	Incoming        int32
@@ -99,15 +103,10 @@ func WithNode(config Config, manager Manager, fn func(node Node) error) error {
 
 	var events evio.Events
 	events.Serving = func(srv evio.Server) (action evio.Action) {
-		node = &nodeInternal{
-			Config:          config,
-			Server:          &srv,
-			ReadyEvent:      ready,
-			StopEvent:       finish,
-			PeersQueue:      ordered_map.NewOrderedMap(),
-			PeersInProgress: make(map[int]*Peer),
-			Connected:       make(map[int]*connection),
-		}
+		node = newNode(config, srv.Dial)
+		node.Server = &srv
+		node.ReadyEvent = ready
+		node.StopEvent = finish
 		ready <- true
 		utils.Tracef("Node listening %v", config.ListenAddrs)
 		return
@@ -200,11 +199,11 @@ func WithNode(config Config, manager Manager, fn func(node Node) error) error {
 
 			if ok {
 				if isOutgoing {
-					node.PeersQueue.Set(node.Connected[id].destination.Address, node.Connected[id].destination)
+					node.PeersQueue.Add(node.Connected[id].destination)
 				}
 				delete(node.Connected, id)
 			} else {
-				node.PeersQueue.Set(node.PeersInProgress[id].Address, node.PeersInProgress[id])
+				node.PeersQueue.Add(node.PeersInProgress[id])
 				delete(node.PeersInProgress, id)
 			}
 		}()
@@ -254,9 +253,25 @@ func WithNode(config Config, manager Manager, fn func(node Node) error) error {
 	}
 	
 	defer node.stopAndWait()
+	node.Updated()
 	return fn(node)
 }
 
+func newNode(config Config, dial func(addr string, timeout time.Duration) int) *nodeInternal {
+	node := &nodeInternal{
+		Config:          config,
+		dial:            dial,
+		PeersQueue:      newPeersQueue(config.MaxPeers),
+		PeersInProgress: make(map[int]*Peer),
+		Connected:       make(map[int]*connection),
+	}
+	// The queue is dialed in insertion order, seeds go first
+	for _, address := range config.Seeds {
+		node.PeersQueue.Add(&Peer{Address: address})
+	}
+	return node
+}
+
 func (node *nodeInternal) GetPeersByType(addressType AddressType) (result map[Address]*Peer) {
 	result = make(map[Address]*Peer)
 
@@ -286,14 +301,19 @@ func (node *nodeInternal) AddPeer(address Address) bool {
 		return false
 	}
 
-	node.PeersQueue.Set(address, &Peer{
+	return node.PeersQueue.Add(&Peer{
 		Address:              address,
 		LastConnectTimestamp: 0,
 		Attempts:             0,
 		Errors:               0,
 	})
+}
+
+func (node *nodeInternal) GetPeersCount() int {
+	node.PeersLock.RLock()
+	defer node.PeersLock.RUnlock()
 
-	return true
+	return node.PeersQueue.Len()
 }
 
 func (node *nodeInternal) Updated() {
@@ -311,7 +331,7 @@ func (node *nodeInternal) Updated() {
 			var address Address = kv.Key.(Address)
 			var peer *Peer = kv.Value.(*Peer)
 
-			id := node.Server.Dial(address.String(), node.Config.TimeoutConnect)
+			id := node.dial(address.String(), node.Config.TimeoutConnect)
 			if id != 0 {
 				node.PeersQueue.Delete(address)
 				node.PeersInProgress[id] = peer
@@ -0,0 +1,58 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedsDialedFirst(t *testing.T) {
+	dialed := make([]string, 0)
+	dial := func(address string, timeout time.Duration) int {
+		dialed = append(dialed, address)
+		return len(dialed)
+	}
+
+	seeds := []Address{NewAddressTcp("10.0.0.1", 4004), NewAddressTcp("10.0.0.2", 4005)}
+	node := newNode(Config{MaxOutgoing: 2, MaxPeers: 10, Seeds: seeds}, dial)
+	node.AddPeer(NewAddressTcp("10.0.0.3", 4004))
+	node.AddPeer(NewAddressTcp("10.0.0.4", 4004))
+
+	if len(dialed) != 2 || dialed[0] != seeds[0].String() || dialed[1] != seeds[1].String() {
+		t.Fatalf("%v", dialed)
+	}
+	if node.GetPeersCount() != 2 {
+		t.Fatalf("%d", node.GetPeersCount())
+	}
+
+	if _, err := ParseAddressTcp("10.0.0.1"); err == nil {
+		t.FailNow()
+	}
+	if _, err := ParseAddressTcp("10.0.0.1:65536"); err == nil {
+		t.FailNow()
+	}
+	if address, err := ParseAddressTcp("seed.example.com:4004"); err != nil || address.String() != "tcp://seed.example.com:4004" {
+		t.Fatal(err)
+	}
+}
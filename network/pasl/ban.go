@@ -0,0 +1,75 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pasl-project/pasl/utils"
+)
+
+type banList struct {
+	until map[string]time.Time
+	clock utils.Clock
+	lock  sync.Mutex
+}
+
+func newBanList(clock utils.Clock) *banList {
+	return &banList{
+		until: make(map[string]time.Time),
+		clock: clock,
+	}
+}
+
+func (this *banList) Ban(host string, duration time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.until[host] = this.clock.Now().Add(duration)
+}
+
+func (this *banList) IsBanned(host string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	until, ok := this.until[host]
+	if !ok {
+		return false
+	}
+	if this.clock.Now().After(until) {
+		delete(this.until, host)
+		return false
+	}
+	return true
+}
+
+func getHost(address string) string {
+	address = strings.TrimPrefix(address, "tcp://")
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
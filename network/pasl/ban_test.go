@@ -0,0 +1,40 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestBanList(t *testing.T) {
+	banned := newBanList(utils.SystemClock{})
+	banned.Ban(getHost("tcp://10.0.0.1:4004"), time.Hour)
+	banned.Ban(getHost("10.0.0.2:4004"), -time.Second)
+
+	if !banned.IsBanned("10.0.0.1") || banned.IsBanned("10.0.0.2") || banned.IsBanned("10.0.0.3") {
+		t.FailNow()
+	}
+}
@@ -28,8 +28,10 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/safebox"
 	"github.com/pasl-project/pasl/safebox/tx"
@@ -37,8 +39,15 @@ import (
 )
 
 type pascalConnectionState struct {
-	height          uint32
-	prevSafeboxHash []byte
+	height                uint32
+	prevSafeboxHash       []byte
+	pendingOperationsHash []byte
+}
+
+type BlocksDownloadResult struct {
+	Count int
+	Err   error
+	Range [2]uint32
 }
 
 type PascalConnection struct {
@@ -52,6 +61,19 @@ type PascalConnection struct {
 	state          *pascalConnectionState
 	stateLock      sync.RWMutex
 	closed         chan *PascalConnection
+	relayDisabled  bool
+	address        string
+	invalidBlocks  uint32
+	pendingOps     []tx.Tx
+	pendingOpsSize int
+	pendingOpsLock sync.Mutex
+	pendingBatch   uint64
+	capabilities   capabilities
+	headersFailed  bool
+	lastError      error
+	handshaked     bool
+	handshakeDone  chan struct{}
+	self           *selfAddresses
 }
 
 func (this *PascalConnection) OnOpen(isOutgoing bool) error {
@@ -59,53 +81,279 @@ func (this *PascalConnection) OnOpen(isOutgoing bool) error {
 	this.underlying.knownOperations[errorReport] = this.onErrorReport
 	this.underlying.knownOperations[message] = this.onMessageRequest
 	this.underlying.knownOperations[getBlocks] = this.onGetBlocksRequest
+	this.underlying.knownOperations[getBlocksList] = this.onGetBlocksListRequest
 	this.underlying.knownOperations[getHeaders] = this.onGetHeadersRequest
 	this.underlying.knownOperations[newBlock] = this.onNewBlockNotification
 	this.underlying.knownOperations[newOperations] = this.onNewOperationsNotification
+	this.underlying.knownOperations[getPendingOperations] = this.onGetPendingOperationsRequest
 
 	if !isOutgoing {
 		return nil
 	}
 
-	payload := generateHello(0, this.nonce, this.blockchain.GetPendingBlock().SerializeHeader(false), nil, defaults.UserAgent)
+	payload := generateHello(this.blockchain.GetClock().Now(), 0, this.nonce, *this.blockchain.GetPendingHeader(), nil, defaults.UserAgent, supportedCapabilities)
 	return this.underlying.sendRequest(hello, payload, this.onHelloCommon)
 }
 
+func (this *PascalConnection) RegisterHandler(operation operationId, handler requestHandler, override bool) error {
+	return this.underlying.registerHandler(operation, handler, override)
+}
+
 func (this *PascalConnection) OnData(data []byte) error {
-	return this.underlying.OnData(data)
+	err := this.underlying.OnData(data)
+	if err != nil {
+		this.setLastError(err)
+	}
+	return err
 }
 
 func (this *PascalConnection) OnClose() {
+	if this.handshakeDone != nil {
+		close(this.handshakeDone)
+	}
 	this.closed <- this
+	// Don't wait for the timeout, downloads from the dropped peer resume elsewhere right away
+	this.underlying.failPendingRequests()
 }
 
-func (this *PascalConnection) SetState(height uint32, prevSafeboxHash []byte) {
+func (this *PascalConnection) SetState(height uint32, prevSafeboxHash []byte, pendingOperationsHash []byte) {
 	this.stateLock.Lock()
 	defer this.stateLock.Unlock()
 	defer func() { this.onStateUpdate <- this }()
 
 	state := &pascalConnectionState{
-		height:          height,
-		prevSafeboxHash: make([]byte, 32),
+		height:                height,
+		prevSafeboxHash:       make([]byte, 32),
+		pendingOperationsHash: make([]byte, 32),
 	}
 	copy(state.prevSafeboxHash[:32], prevSafeboxHash)
+	copy(state.pendingOperationsHash[:32], pendingOperationsHash)
 	this.state = state
 }
 
+func (this *PascalConnection) setCapabilities(capabilities capabilities) {
+	this.stateLock.Lock()
+	defer this.stateLock.Unlock()
+	this.capabilities = capabilities
+}
+
+func (this *PascalConnection) hasCapability(capability capabilities) bool {
+	this.stateLock.RLock()
+	defer this.stateLock.RUnlock()
+	return this.capabilities&capability != 0
+}
+
+func (this *PascalConnection) setHandshaked() {
+	this.stateLock.Lock()
+	defer this.stateLock.Unlock()
+	this.handshaked = true
+}
+
+func (this *PascalConnection) watchHandshake(clock utils.Clock, timeout time.Duration) {
+	this.handshakeDone = make(chan struct{})
+	expired := clock.After(timeout)
+	go func() {
+		select {
+		case <-expired:
+			this.onHandshakeTimeout()
+		case <-this.handshakeDone:
+		}
+	}()
+}
+
+func (this *PascalConnection) onHandshakeTimeout() {
+	this.stateLock.RLock()
+	handshaked := this.handshaked
+	this.stateLock.RUnlock()
+	if handshaked {
+		return
+	}
+
+	utils.Tracef("[P2P %p] Hello not received in time", this)
+	this.setLastError(errors.New("Handshake timed out"))
+	this.underlying.transport.Close()
+}
+
+func (this *PascalConnection) setLastError(err error) {
+	this.stateLock.Lock()
+	defer this.stateLock.Unlock()
+	this.lastError = err
+}
+
+func (this *PascalConnection) LastError() error {
+	this.stateLock.RLock()
+	defer this.stateLock.RUnlock()
+	return this.lastError
+}
+
 func (this *PascalConnection) GetState() (uint32, []byte) {
 	this.stateLock.RLock()
 	defer this.stateLock.RUnlock()
 	return this.state.height, this.state.prevSafeboxHash
 }
 
-func (this *PascalConnection) StartBlocksDownloading(from, to uint32, downloadingDone chan<- interface{}) error {
+func (this *PascalConnection) GetPendingOperationsHash() []byte {
+	this.stateLock.RLock()
+	defer this.stateLock.RUnlock()
+	return this.state.pendingOperationsHash
+}
+
+func (this *PascalConnection) RequestPendingOperations() error {
+	onSuccess := func(response *requestResponse, payload []byte) error {
+		if response == nil {
+			return errors.New("GetPendingOperations request failed")
+		}
+
+		var packet packetNewOperations
+		if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+			return err
+		}
+
+		utils.Tracef("[P2P %p] Pending operations %d", this, len(packet.Operations))
+		for _, op := range packet.Operations {
+			this.onNewOperation <- &eventNewOperation{event{this}, op}
+		}
+		return nil
+	}
+
+	return this.underlying.sendRequest(getPendingOperations, nil, onSuccess)
+}
+
+func (this *PascalConnection) StartBlocksDownloading(from, to uint32, downloadingDone chan<- BlocksDownloadResult) error {
 	packet := utils.Serialize(packetGetBlocksRequest{
 		FromIndex: from,
 		ToIndex:   to,
 	})
 
-	onSuccess := func(response *requestResponse, payload []byte) error {
-		defer func() { downloadingDone <- nil }()
+	return this.underlying.sendRequest(getBlocks, packet, this.onBlocksResponse([2]uint32{from, to}, downloadingDone))
+}
+
+// Blocks until the peer responds, must not be called from the connection handlers
+func (this *PascalConnection) GetBlock(index uint32) (*safebox.SerializedBlock, error) {
+	type blockResult struct {
+		block *safebox.SerializedBlock
+		err   error
+	}
+	done := make(chan blockResult, 1)
+
+	packet := utils.Serialize(packetGetBlocksRequest{
+		FromIndex: index,
+		ToIndex:   index,
+	})
+	onBlock := func(response *requestResponse, payload []byte) error {
+		if response == nil {
+			done <- blockResult{err: fmt.Errorf("GetBlock #%d request failed", index)}
+			return nil
+		}
+
+		var packet packetGetBlocksResponse
+		if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+			done <- blockResult{err: err}
+			return err
+		}
+		if len(packet.Blocks) != 1 || packet.Blocks[0].Header.Index != index {
+			err := fmt.Errorf("GetBlock #%d returned %d blocks", index, len(packet.Blocks))
+			done <- blockResult{err: err}
+			return err
+		}
+		done <- blockResult{block: &packet.Blocks[0]}
+		return nil
+	}
+	if err := this.underlying.sendRequest(getBlocks, packet, onBlock); err != nil {
+		return nil, err
+	}
+
+	result := <-done
+	return result.block, result.err
+}
+
+func (this *PascalConnection) StartHeadersDownloading(from, to uint32, downloadingDone chan<- BlocksDownloadResult) error {
+	packet := utils.Serialize(packetGetBlocksRequest{
+		FromIndex: from,
+		ToIndex:   to,
+	})
+
+	startBlocksDownloading := func(to uint32) error {
+		if err := this.StartBlocksDownloading(from, to, downloadingDone); err != nil {
+			downloadingDone <- BlocksDownloadResult{Err: err, Range: [2]uint32{from, to}}
+			return err
+		}
+		return nil
+	}
+
+	fallback := func(reason string) error {
+		utils.Tracef("[P2P %p] GetHeaders %s, falling back to blocks downloading", this, reason)
+		this.setHeadersUnsupported()
+		return startBlocksDownloading(to)
+	}
+
+	onHeaders := func(response *requestResponse, payload []byte) (err error) {
+		if response == nil {
+			return fallback("request failed")
+		}
+		if response.result.getError() != success {
+			return fallback(fmt.Sprintf("rejected with error %d", response.result.getError()))
+		}
+
+		var packet packetGetHeadersResponse
+		if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil || len(packet.Headers) == 0 {
+			return fallback("returned no headers")
+		}
+		for index := range packet.Headers {
+			if expected := from + uint32(index); packet.Headers[index].Index != expected {
+				err = fmt.Errorf("GetHeaders returned header #%d, #%d expected", packet.Headers[index].Index, expected)
+				downloadingDone <- BlocksDownloadResult{Err: err, Range: [2]uint32{from, to}}
+				return err
+			}
+		}
+
+		return startBlocksDownloading(packet.Headers[len(packet.Headers)-1].Index)
+	}
+
+	return this.underlying.sendRequest(getHeaders, packet, onHeaders)
+}
+
+func (this *PascalConnection) setHeadersUnsupported() {
+	this.stateLock.Lock()
+	defer this.stateLock.Unlock()
+	this.headersFailed = true
+}
+
+func (this *PascalConnection) supportsHeaders() bool {
+	this.stateLock.RLock()
+	defer this.stateLock.RUnlock()
+	return this.capabilities&capabilityHeadersFirst != 0 && !this.headersFailed
+}
+
+func (this *PascalConnection) StartBlocksDownloadingList(indexes []uint32, downloadingDone chan<- BlocksDownloadResult) error {
+	if len(indexes) > int(defaults.NetworkBlocksPerRequest) {
+		return fmt.Errorf("Too many blocks requested %d > %d", len(indexes), defaults.NetworkBlocksPerRequest)
+	}
+
+	packet := utils.Serialize(packetGetBlocksListRequest{
+		Indexes: indexes,
+	})
+
+	var requested [2]uint32
+	for i, index := range indexes {
+		if i == 0 || index < requested[0] {
+			requested[0] = index
+		}
+		if i == 0 || index > requested[1] {
+			requested[1] = index
+		}
+	}
+
+	return this.underlying.sendRequest(getBlocksList, packet, this.onBlocksResponse(requested, downloadingDone))
+}
+
+func (this *PascalConnection) onBlocksResponse(requested [2]uint32, downloadingDone chan<- BlocksDownloadResult) responseHandler {
+	return func(response *requestResponse, payload []byte) (err error) {
+		result := BlocksDownloadResult{Range: requested}
+		defer func() {
+			result.Err = err
+			downloadingDone <- result
+		}()
 
 		if response == nil {
 			return errors.New("GetBlocks request failed")
@@ -115,6 +363,7 @@ func (this *PascalConnection) StartBlocksDownloading(from, to uint32, downloadin
 		if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
 			return err
 		}
+		result.Count = len(packet.Blocks)
 		for _, it := range packet.Blocks {
 			this.onNewBlock <- &eventNewBlock{
 				event:           event{this},
@@ -125,43 +374,127 @@ func (this *PascalConnection) StartBlocksDownloading(from, to uint32, downloadin
 
 		return nil
 	}
-
-	return this.underlying.sendRequest(getBlocks, packet, onSuccess)
 }
 
 func (this *PascalConnection) BroadcastTx(operation *tx.Tx) {
+	this.pendingOpsLock.Lock()
+	defer this.pendingOpsLock.Unlock()
+
+	if len(this.pendingOps) == 0 {
+		batch := this.pendingBatch
+		expired := this.blockchain.GetClock().After(defaults.OperationsBatchWindow)
+		go func() {
+			<-expired
+			this.flushExpiredOperations(batch)
+		}()
+	}
+	this.pendingOps = append(this.pendingOps, *operation)
+	this.pendingOpsSize += len(tx.SerializeOperation(operation))
+
+	if len(this.pendingOps) >= defaults.OperationsBatchCount || this.pendingOpsSize >= defaults.OperationsBatchSize {
+		this.flushOperationsUnsafe()
+	}
+}
+
+func (this *PascalConnection) flushOperations() {
+	this.pendingOpsLock.Lock()
+	defer this.pendingOpsLock.Unlock()
+
+	this.flushOperationsUnsafe()
+}
+
+// The batch might have been flushed already and a new one started since the timer was set
+func (this *PascalConnection) flushExpiredOperations(batch uint64) {
+	this.pendingOpsLock.Lock()
+	defer this.pendingOpsLock.Unlock()
+
+	if batch == this.pendingBatch {
+		this.flushOperationsUnsafe()
+	}
+}
+
+func (this *PascalConnection) flushOperationsUnsafe() {
+	if len(this.pendingOps) == 0 {
+		return
+	}
+
 	var packet packetNewOperations = packetNewOperations{
 		OperationsNetwork: tx.OperationsNetwork{
-			Operations: []tx.Tx{*operation},
+			Operations: this.pendingOps,
 		},
 	}
-	this.underlying.sendRequest(newOperations, utils.Serialize(packet), nil)
+	this.underlying.sendNotification(newOperations, utils.Serialize(&packet))
+
+	this.pendingOps = nil
+	this.pendingOpsSize = 0
+	this.pendingBatch++
 }
 
 func (this *PascalConnection) BroadcastBlock(block *safebox.SerializedBlock) {
-	this.underlying.sendRequest(newBlock, utils.Serialize(packetNewBlock{*block}), nil)
+	this.underlying.sendNotification(newBlock, utils.Serialize(&packetNewBlock{*block}))
 }
 
 func (this *PascalConnection) onHelloCommon(request *requestResponse, payload []byte) error {
 	utils.Tracef("[P2P %p]", this)
 
 	var packet packetHello
-	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+	if err := utils.DeserializeOptionalTail(&packet, bytes.NewBuffer(payload)); err != nil {
 		request.result.setError(invalidDataBufferInfo)
 		return err
 	}
 
+	for _, stage := range helloPipeline {
+		if err := stage(this, request, &packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type helloStage func(this *PascalConnection, request *requestResponse, packet *packetHello) error
+
+// Handshake steps in the order they run, the first failing one aborts the handshake
+var helloPipeline = []helloStage{
+	(*PascalConnection).helloCheckVersion,
+	(*PascalConnection).helloCheckLoopback,
+	(*PascalConnection).helloNegotiate,
+	(*PascalConnection).helloIngestPeers,
+}
+
+func (this *PascalConnection) helloCheckVersion(request *requestResponse, packet *packetHello) error {
+	if request.version.Major < protocolVersion.Major {
+		request.result.setError(invalidProtocolVersion)
+		return fmt.Errorf("[P2P %p] Unsupported protocol version %d.%d", this, request.version.Major, request.version.Minor)
+	}
+	return nil
+}
+
+func (this *PascalConnection) helloCheckLoopback(request *requestResponse, packet *packetHello) error {
 	if bytes.Equal(packet.Nonce, this.nonce) {
+		if this.self != nil {
+			this.self.Add(this.address)
+		}
 		return fmt.Errorf("[P2P %p] Loopback connection", this)
 	}
+	return nil
+}
 
+func (this *PascalConnection) helloNegotiate(request *requestResponse, packet *packetHello) error {
 	utils.Tracef("[P2P %p] Height %d SafeboxHash %s", this, packet.Block.Index, hex.EncodeToString(packet.Block.PrevSafeboxHash))
-	this.SetState(packet.Block.Index, packet.Block.PrevSafeboxHash)
+	this.setCapabilities(negotiateCapabilities(supportedCapabilities, packet.Capabilities))
+	this.SetState(packet.Block.Index, packet.Block.PrevSafeboxHash, packet.Block.OperationsHash)
+	this.setHandshaked()
+	return nil
+}
 
+func (this *PascalConnection) helloIngestPeers(request *requestResponse, packet *packetHello) error {
 	for _, peer := range packet.Peers {
+		if this.self != nil && this.self.Contains(peer) {
+			continue
+		}
 		this.peerUpdates <- peer
 	}
-
 	return nil
 }
 
@@ -170,7 +503,7 @@ func (this *PascalConnection) onHelloRequest(request *requestResponse, payload [
 		return nil, err
 	}
 
-	out := generateHello(0, this.nonce, this.blockchain.GetPendingBlock().SerializeHeader(false), nil, defaults.UserAgent)
+	out := generateHello(this.blockchain.GetClock().Now(), 0, this.nonce, *this.blockchain.GetPendingHeader(), nil, defaults.UserAgent, supportedCapabilities)
 	request.result.setError(success)
 	return out, nil
 }
@@ -179,29 +512,122 @@ func (this *PascalConnection) onGetBlocksRequest(request *requestResponse, paylo
 	utils.Tracef("[P2P %p]", this)
 
 	var packet packetGetBlocksRequest
-	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+	if err := utils.DeserializeStrict(&packet, bytes.NewBuffer(payload)); err != nil {
 		return nil, err
 	}
 
-	if packet.FromIndex > packet.ToIndex {
-		packet.ToIndex, packet.FromIndex = packet.FromIndex, packet.ToIndex
+	if this.relayDisabled {
+		this.sendErrorReport("Serving blocks is disabled")
+		request.result.setError(success)
+		return utils.Serialize(packetGetBlocksResponse{
+			Blocks: []safebox.SerializedBlock{},
+		}), nil
+	}
+
+	blocks, err := this.getBlocksRange(packet.FromIndex, packet.ToIndex)
+	if err != nil {
+		return nil, err
+	}
+	serialized := make([]safebox.SerializedBlock, len(blocks))
+	for index := range blocks {
+		serialized[index] = blocks[index].Serialize()
+	}
+
+	out := utils.Serialize(packetGetBlocksResponse{
+		Blocks: serialized,
+	})
+	request.result.setError(success)
+
+	return out, nil
+}
+
+func (this *PascalConnection) getBlocksRange(fromIndex, toIndex uint32) ([]safebox.BlockBase, error) {
+	if fromIndex > toIndex {
+		toIndex, fromIndex = fromIndex, toIndex
 	}
 
-	total := packet.ToIndex - packet.FromIndex
-	if total > defaults.NetworkBlocksPerRequest {
-		total = defaults.NetworkBlocksPerRequest
-		packet.ToIndex = packet.FromIndex + total
+	total, err := common.SubIndex(toIndex, fromIndex)
+	if err != nil {
+		return nil, err
+	}
+	if total >= defaults.NetworkBlocksPerRequest {
+		total = defaults.NetworkBlocksPerRequest - 1
+		if toIndex, err = common.AddIndex(fromIndex, total); err != nil {
+			return nil, err
+		}
 	}
 
-	serialized := make([]safebox.SerializedBlock, total)
-	for index := packet.FromIndex; index <= packet.ToIndex; index++ {
-		if block := this.blockchain.GetBlock(index); block != nil {
-			serialized = append(serialized, block.Serialize())
-		} else {
-			utils.Tracef("[P2P %p] Failed to get block %d", this, index)
+	blocks := make([]safebox.BlockBase, 0, total+1)
+	for index := fromIndex; ; index++ {
+		block, err := this.blockchain.GetBlock(index)
+		if err != nil {
+			utils.Tracef("[P2P %p] Failed to get block %d: %v", this, index, err)
+			this.sendErrorReport(fmt.Sprintf("Failed to get block #%d", index))
+			break
+		}
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+		if index == toIndex {
 			break
 		}
 	}
+	if len(blocks) > int(defaults.NetworkBlocksPerRequest) {
+		return nil, fmt.Errorf("Serving %d blocks exceeds the limit of %d", len(blocks), defaults.NetworkBlocksPerRequest)
+	}
+
+	return blocks, nil
+}
+
+func (this *PascalConnection) onGetPendingOperationsRequest(request *requestResponse, payload []byte) ([]byte, error) {
+	utils.Tracef("[P2P %p]", this)
+
+	operations := []tx.Tx{}
+	if !this.relayDisabled {
+		operations = this.blockchain.GetPendingOperations()
+		if len(operations) > defaults.NetworkOpsPerRequest {
+			operations = operations[:defaults.NetworkOpsPerRequest]
+		}
+	}
+
+	out := utils.Serialize(&packetNewOperations{
+		OperationsNetwork: tx.OperationsNetwork{
+			Operations: operations,
+		},
+	})
+	request.result.setError(success)
+
+	return out, nil
+}
+
+func (this *PascalConnection) onGetBlocksListRequest(request *requestResponse, payload []byte) ([]byte, error) {
+	utils.Tracef("[P2P %p]", this)
+
+	var packet packetGetBlocksListRequest
+	if err := utils.DeserializeStrict(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+	if len(packet.Indexes) > int(defaults.NetworkBlocksPerRequest) {
+		return nil, fmt.Errorf("Too many blocks requested %d > %d", len(packet.Indexes), defaults.NetworkBlocksPerRequest)
+	}
+
+	serialized := make([]safebox.SerializedBlock, 0, len(packet.Indexes))
+	if this.relayDisabled {
+		this.sendErrorReport("Serving blocks is disabled")
+	} else {
+		for _, index := range packet.Indexes {
+			block, err := this.blockchain.GetBlock(index)
+			if err != nil {
+				utils.Tracef("[P2P %p] Failed to get block %d: %v", this, index, err)
+				this.sendErrorReport(fmt.Sprintf("Failed to get block #%d", index))
+				continue
+			}
+			if block != nil {
+				serialized = append(serialized, block.Serialize())
+			}
+		}
+	}
 
 	out := utils.Serialize(packetGetBlocksResponse{
 		Blocks: serialized,
@@ -211,6 +637,10 @@ func (this *PascalConnection) onGetBlocksRequest(request *requestResponse, paylo
 	return out, nil
 }
 
+func (this *PascalConnection) sendErrorReport(message string) {
+	this.underlying.sendErrorReport(message)
+}
+
 func (this *PascalConnection) onErrorReport(request *requestResponse, payload []byte) ([]byte, error) {
 	var packet packetError
 	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
@@ -229,7 +659,29 @@ func (this *PascalConnection) onMessageRequest(request *requestResponse, payload
 
 func (this *PascalConnection) onGetHeadersRequest(request *requestResponse, payload []byte) ([]byte, error) {
 	utils.Tracef("[P2P %p]", this)
-	return nil, nil
+
+	var packet packetGetBlocksRequest
+	if err := utils.DeserializeStrict(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+
+	headers := []safebox.SerializedBlockHeader{}
+	if this.relayDisabled {
+		this.sendErrorReport("Serving headers is disabled")
+	} else {
+		blocks, err := this.getBlocksRange(packet.FromIndex, packet.ToIndex)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			headers = append(headers, block.SerializeHeader(false))
+		}
+	}
+
+	request.result.setError(success)
+	return utils.Serialize(packetGetHeadersResponse{
+		Headers: headers,
+	}), nil
 }
 
 func (this *PascalConnection) onNewBlockNotification(request *requestResponse, payload []byte) ([]byte, error) {
@@ -0,0 +1,524 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/storage"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func addTestBlocks(t *testing.T, manager *manager, count int) {
+	for i := 0; i < count; i++ {
+		block := getTestBlock(t, manager.blockchain)
+		if err := manager.blockchain.AddBlockSerialized(&block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func requestBlocks(t *testing.T, conn *PascalConnection, from, to uint32) packetGetBlocksResponse {
+	request := &requestResponse{
+		id:        1,
+		typeId:    request,
+		operation: getBlocks,
+		result:    &result{},
+	}
+	out, err := conn.onGetBlocksRequest(request, utils.Serialize(packetGetBlocksRequest{
+		FromIndex: from,
+		ToIndex:   to,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response packetGetBlocksResponse
+	if err := utils.Deserialize(&response, bytes.NewBuffer(out)); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestGetBlocksAtTip(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 2)
+		conn, transport := newTestConnection(t, manager)
+
+		if response := requestBlocks(t, conn, 0, 5); len(response.Blocks) != 2 {
+			t.Fatalf("%d != 2", len(response.Blocks))
+		}
+		if len(transport.writes) != 0 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestGetBlocksStorageError(t *testing.T) {
+	withTestStorage(t, func(storage *storage.Storage) {
+		manager := newTestManager(t, storage)
+		addTestBlocks(t, manager, 3)
+		conn, transport := newTestConnection(t, manager)
+
+		corrupted := safebox.BlockMetadata{
+			Index: 1,
+			Miner: utils.Serialize(&crypto.PublicSerialized{TypeId: 1}),
+		}
+		storage.Store(1, utils.Serialize(&corrupted), func(fn func(number uint32, data []byte) error) error {
+			return nil
+		})
+
+		if response := requestBlocks(t, conn, 0, 2); len(response.Blocks) != 1 {
+			t.Fatalf("%d != 1", len(response.Blocks))
+		}
+		packets := transport.getPackets(t)
+		if len(packets) != 1 || packets[0].Operation != errorReport || packets[0].TypeId != notification {
+			t.FailNow()
+		}
+		if packets[0].NetworkId != defaults.NetId {
+			t.FailNow()
+		}
+	})
+}
+
+func TestGetBlocksTrailingBytes(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 2)
+		conn, _ := newTestConnection(t, manager)
+
+		request := &requestResponse{
+			id:        1,
+			typeId:    request,
+			operation: getBlocks,
+			result:    &result{},
+		}
+		payload := utils.Serialize(packetGetBlocksRequest{
+			FromIndex: 0,
+			ToIndex:   1,
+		})
+		if _, err := conn.onGetBlocksRequest(request, append(payload, 0xFF)); err == nil {
+			t.FailNow()
+		}
+		if _, err := conn.onGetBlocksRequest(request, payload); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGetBlocksNearMaxIndex(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 2)
+		conn, _ := newTestConnection(t, manager)
+
+		if response := requestBlocks(t, conn, math.MaxUint32-1, math.MaxUint32); len(response.Blocks) != 0 {
+			t.Fatalf("%d", len(response.Blocks))
+		}
+		if response := requestBlocks(t, conn, math.MaxUint32, 1); len(response.Blocks) != 1 {
+			t.Fatalf("%d", len(response.Blocks))
+		}
+	})
+}
+
+func TestGetBlocksLimit(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		limit := defaults.NetworkBlocksPerRequest
+		addTestBlocks(t, manager, int(limit)+10)
+		conn, _ := newTestConnection(t, manager)
+
+		if response := requestBlocks(t, conn, 0, limit-1); len(response.Blocks) != int(limit) {
+			t.Fatalf("%d != %d", len(response.Blocks), limit)
+		}
+
+		response := requestBlocks(t, conn, 5, limit+5)
+		if len(response.Blocks) != int(limit) {
+			t.Fatalf("%d != %d", len(response.Blocks), limit)
+		}
+		if first, last := response.Blocks[0].Header.Index, response.Blocks[limit-1].Header.Index; first != 5 || last != limit+4 {
+			t.Fatalf("%d .. %d", first, last)
+		}
+	})
+}
+
+func TestGetBlocksList(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 10)
+		conn, transport := newTestConnection(t, manager)
+
+		indexes := []uint32{7, 2, 5, 20}
+		request := &requestResponse{
+			id:        1,
+			typeId:    request,
+			operation: getBlocksList,
+			result:    &result{},
+		}
+		out, err := conn.onGetBlocksListRequest(request, utils.Serialize(packetGetBlocksListRequest{Indexes: indexes}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response packetGetBlocksResponse
+		if err := utils.Deserialize(&response, bytes.NewBuffer(out)); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Blocks) != 3 {
+			t.Fatalf("%d", len(response.Blocks))
+		}
+		for i, block := range response.Blocks {
+			if block.Header.Index != indexes[i] {
+				t.Fatalf("%d != %d", block.Header.Index, indexes[i])
+			}
+		}
+
+		tooMany := make([]uint32, defaults.NetworkBlocksPerRequest+1)
+		if _, err := conn.onGetBlocksListRequest(request, utils.Serialize(packetGetBlocksListRequest{Indexes: tooMany})); err == nil {
+			t.FailNow()
+		}
+		if err := conn.StartBlocksDownloadingList(tooMany, nil); err == nil {
+			t.FailNow()
+		}
+
+		if err := conn.StartBlocksDownloadingList(indexes, nil); err != nil {
+			t.Fatal(err)
+		}
+		packets := transport.getPackets(t)
+		if len(packets) != 1 || packets[0].Operation != getBlocksList || packets[0].TypeId != request.typeId {
+			t.FailNow()
+		}
+	})
+}
+
+func TestBlocksDownloadResult(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		payload, err := hex.DecodeString(testBlocksResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for range manager.onNewBlock {
+			}
+		}()
+		defer close(manager.onNewBlock)
+
+		done := make(chan BlocksDownloadResult, 1)
+		if err := conn.onBlocksResponse([2]uint32{100450, 100451}, done)(&requestResponse{}, payload); err != nil {
+			t.Fatal(err)
+		}
+		if result := <-done; result.Err != nil || result.Count != 2 || result.Range != [2]uint32{100450, 100451} {
+			t.Fatalf("%v", result)
+		}
+
+		if err := conn.onBlocksResponse([2]uint32{1, 2}, done)(nil, nil); err == nil {
+			t.FailNow()
+		}
+		if result := <-done; result.Err == nil || result.Count != 0 || result.Range != [2]uint32{1, 2} {
+			t.Fatalf("%v", result)
+		}
+	})
+}
+
+func TestGetHeadersFallback(t *testing.T) {
+	var blocks []safebox.SerializedBlock
+	withTestManager(t, func(source *manager) {
+		addTestBlocks(t, source, 2)
+		conn, _ := newTestConnection(t, source)
+
+		out, err := conn.onGetHeadersRequest(&requestResponse{result: &result{}}, utils.Serialize(packetGetBlocksRequest{FromIndex: 0, ToIndex: 1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var headers packetGetHeadersResponse
+		if err := utils.Deserialize(&headers, bytes.NewBuffer(out)); err != nil || len(headers.Headers) != 2 {
+			t.FailNow()
+		}
+
+		for index := uint32(0); index < 2; index++ {
+			block, err := source.blockchain.GetBlock(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, block.Serialize())
+		}
+	})
+
+	withTestManager(t, func(manager *manager) {
+		conn, transport := newTestConnection(t, manager)
+		conn.setCapabilities(capabilityHeadersFirst)
+		if !conn.supportsHeaders() {
+			t.FailNow()
+		}
+
+		stop := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			for {
+				select {
+				case event := <-manager.onNewBlock:
+					manager.onNewBlockEvent(event)
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		respond := func(operation operationId, errorId errorId, payload []byte) {
+			packets := transport.getPackets(t)
+			last := packets[len(packets)-1]
+			if last.Operation != operation || last.TypeId != request {
+				t.Fatalf("%d %d", last.Operation, last.TypeId)
+			}
+			frame, err := conn.underlying.preparePacket(response, operation, last.RequestId, errorId, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.OnData(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan BlocksDownloadResult, 1)
+		if err := conn.StartHeadersDownloading(0, 1, done); err != nil {
+			t.Fatal(err)
+		}
+		respond(getHeaders, invalidDataBufferInfo, nil)
+		if conn.supportsHeaders() {
+			t.FailNow()
+		}
+		respond(getBlocks, success, utils.Serialize(packetGetBlocksResponse{Blocks: blocks}))
+
+		result := <-done
+		close(stop)
+		<-finished
+		for len(manager.onNewBlock) > 0 {
+			manager.onNewBlockEvent(<-manager.onNewBlock)
+		}
+		if result.Err != nil || result.Count != 2 {
+			t.Fatalf("%+v", result)
+		}
+		if height, _ := manager.blockchain.GetState(); height != 2 {
+			t.Fatalf("%d", height)
+		}
+	})
+}
+
+func TestSelfPeerFiltered(t *testing.T) {
+	withTestStorage(t, func(storage *storage.Storage) {
+		blockchain, err := blockchain.NewBlockchain(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerUpdates := make(chan PeerInfo, 10)
+		manager := newManager([]byte("nonce"), blockchain, peerUpdates, ManagerOptions{TimeoutRequest: time.Minute})
+		conn, _ := newTestConnection(t, manager)
+
+		// The loopback connection reveals the address we are reachable at
+		loopback := generateHello(time.Now(), 0, manager.nonce, *blockchain.GetPendingHeader(), nil, defaults.UserAgent, supportedCapabilities)
+		if err := conn.onHelloCommon(newTestHelloRequest(), loopback); err == nil {
+			t.FailNow()
+		}
+
+		go func() { <-manager.onStateUpdate }()
+		peers := []PeerInfo{
+			{Host: "127.0.0.1", Port: 4004, LastConnect: 1},
+			{Host: "127.0.0.2", Port: 4004, LastConnect: 2},
+			{Host: "127.0.0.1", Port: 4005, LastConnect: 3},
+		}
+		hello := generateHello(time.Now(), 0, []byte("remote"), *blockchain.GetPendingHeader(), peers, defaults.UserAgent, supportedCapabilities)
+		if err := conn.onHelloCommon(newTestHelloRequest(), hello); err != nil {
+			t.Fatal(err)
+		}
+
+		close(peerUpdates)
+		received := make([]PeerInfo, 0)
+		for peer := range peerUpdates {
+			received = append(received, peer)
+		}
+		if len(received) != 2 || received[0] != peers[1] || received[1] != peers[2] {
+			t.Fatalf("%v", received)
+		}
+	})
+}
+
+func TestGetBlock(t *testing.T) {
+	var blocks []safebox.SerializedBlock
+	withTestManager(t, func(source *manager) {
+		addTestBlocks(t, source, 3)
+		for index := uint32(0); index < 3; index++ {
+			block, err := source.blockchain.GetBlock(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, block.Serialize())
+		}
+	})
+
+	withTestManager(t, func(manager *manager) {
+		conn, transport := newTestConnection(t, manager)
+
+		type blockResult struct {
+			block *safebox.SerializedBlock
+			err   error
+		}
+		get := func(index uint32, respond []safebox.SerializedBlock) blockResult {
+			done := make(chan blockResult, 1)
+			go func() {
+				block, err := conn.GetBlock(index)
+				done <- blockResult{block, err}
+			}()
+
+			var header packetHeader
+			for {
+				if packets := transport.getPackets(t); len(packets) != 0 {
+					header = packets[len(packets)-1]
+					transport.reset()
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if header.Operation != getBlocks || header.TypeId != request {
+				t.Fatalf("%d %d", header.Operation, header.TypeId)
+			}
+			frame, err := conn.underlying.preparePacket(response, getBlocks, header.RequestId, success, utils.Serialize(packetGetBlocksResponse{Blocks: respond}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.OnData(frame)
+			return <-done
+		}
+
+		if result := get(1, blocks[1:2]); result.err != nil || result.block.Header.Index != 1 || result.block.Diff(&blocks[1]) != "" {
+			t.Fatalf("%v", result.err)
+		}
+		if result := get(1, blocks[1:3]); result.err == nil {
+			t.FailNow()
+		}
+		if result := get(2, blocks[1:2]); result.err == nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestHelloCheckVersion(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+
+		request := newTestHelloRequest()
+		if err := conn.helloCheckVersion(request, &packetHello{}); err != nil {
+			t.Fatal(err)
+		}
+
+		request.version.Major = protocolVersion.Major - 1
+		if err := conn.helloCheckVersion(request, &packetHello{}); err == nil || request.result.getError() != invalidProtocolVersion {
+			t.FailNow()
+		}
+	})
+}
+
+func TestHelloCheckLoopback(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+
+		if err := conn.helloCheckLoopback(newTestHelloRequest(), &packetHello{Nonce: []byte("remote")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.helloCheckLoopback(newTestHelloRequest(), &packetHello{Nonce: manager.nonce}); err == nil {
+			t.FailNow()
+		}
+		if !conn.self.Contains(PeerInfo{Host: "127.0.0.1", Port: 4004}) {
+			t.FailNow()
+		}
+	})
+}
+
+func TestHelloNegotiate(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		go func() { <-manager.onStateUpdate }()
+
+		packet := &packetHello{
+			Block:        safebox.SerializedBlockHeader{Index: 7, PrevSafeboxHash: make([]byte, 32)},
+			Capabilities: capabilityHeadersFirst | capabilityCompression,
+		}
+		if err := conn.helloNegotiate(newTestHelloRequest(), packet); err != nil {
+			t.Fatal(err)
+		}
+		if height, _ := conn.GetState(); height != 7 {
+			t.Fatalf("%d", height)
+		}
+		if !conn.hasCapability(capabilityHeadersFirst) || conn.hasCapability(capabilityCompression) || !conn.handshaked {
+			t.FailNow()
+		}
+	})
+}
+
+func TestHelloIngestPeers(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		peerUpdates := make(chan PeerInfo, 10)
+		conn.peerUpdates = peerUpdates
+		conn.self.Add("tcp://127.0.0.1:4004")
+
+		peers := []PeerInfo{
+			{Host: "127.0.0.1", Port: 4004},
+			{Host: "127.0.0.2", Port: 4004},
+		}
+		if err := conn.helloIngestPeers(newTestHelloRequest(), &packetHello{Peers: peers}); err != nil {
+			t.Fatal(err)
+		}
+		if len(peerUpdates) != 1 || <-peerUpdates != peers[1] {
+			t.FailNow()
+		}
+	})
+}
+
+func TestHelloPipeline(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		peers := []PeerInfo{{Host: "127.0.0.2", Port: 4004}}
+		hello := generateHello(time.Now(), 0, []byte("remote"), *manager.blockchain.GetPendingHeader(), peers, defaults.UserAgent, supportedCapabilities)
+
+		// Rejected by the first stage, nothing else runs
+		outdated := newTestHelloRequest()
+		outdated.version.Major = 0
+		if err := conn.onHelloCommon(outdated, hello); err == nil || conn.handshaked || len(manager.peerUpdates) != 0 {
+			t.FailNow()
+		}
+
+		go func() { <-manager.onStateUpdate }()
+		if err := conn.onHelloCommon(newTestHelloRequest(), hello); err != nil {
+			t.Fatal(err)
+		}
+		if !conn.handshaked || !conn.hasCapability(capabilityHeadersFirst) || len(manager.peerUpdates) != 1 {
+			t.FailNow()
+		}
+	})
+}
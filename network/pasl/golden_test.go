@@ -0,0 +1,127 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func getGoldenHeader() safebox.SerializedBlockHeader {
+	return safebox.SerializedBlockHeader{
+		HeaderOnly:      3,
+		Version:         common.Version{Major: 1, Minor: 1},
+		Index:           100,
+		Miner:           []byte{0xca, 0x02, 0x02, 0x00, 0x01, 0x02, 0x02, 0x00, 0x03, 0x04},
+		Reward:          1000000,
+		Fee:             10,
+		Time:            1533000000,
+		Target:          0x30000000,
+		Nonce:           12345,
+		Payload:         []byte("payload"),
+		PrevSafeboxHash: bytes.Repeat([]byte{0x11}, 32),
+		OperationsHash:  bytes.Repeat([]byte{0x22}, 32),
+		Pow:             bytes.Repeat([]byte{0x33}, 32),
+	}
+}
+
+func getGoldenChangeKey(t *testing.T) *tx.ChangeKey {
+	curve, err := crypto.CurveById(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := crypto.Public{
+		TypeId: crypto.NIDsecp256k1,
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     curve.Params().Gx,
+			Y:     curve.Params().Gy,
+		},
+	}
+	return &tx.ChangeKey{
+		Source:       1234,
+		OperationId:  5,
+		Fee:          10,
+		Payload:      []byte("payload"),
+		PublicKey:    public,
+		NewPublickey: utils.Serialize(&public),
+		Signature: crypto.SignatureSerialized{
+			R: bytes.Repeat([]byte{0x44}, 32),
+			S: bytes.Repeat([]byte{0x55}, 32),
+		},
+	}
+}
+
+func checkGolden(t *testing.T, name string, serialized []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(serialized)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serialized, golden) {
+		t.Fatalf("%s: wire format changed\n%x\n%x", name, serialized, golden)
+	}
+}
+
+func TestGoldenSerialization(t *testing.T) {
+	peers := []PeerInfo{
+		{Host: "127.0.0.1", Port: 4004, LastConnect: 1},
+		{Host: "127.0.0.2", Port: 4004, LastConnect: 2},
+	}
+	hello := generateHello(time.Unix(1533000000, 0), 4004, []byte("nonce"), getGoldenHeader(), peers, "PASL v1.0", supportedCapabilities)
+	checkGolden(t, "hello.hex", hello)
+
+	header := getGoldenHeader()
+	checkGolden(t, "block_header.hex", utils.Serialize(&header))
+
+	changeKey := &bytes.Buffer{}
+	if err := getGoldenChangeKey(t).Serialize(changeKey); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "change_key.hex", changeKey.Bytes())
+}
@@ -23,12 +23,18 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pasl
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"math/rand"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/network"
 	"github.com/pasl-project/pasl/safebox"
@@ -51,6 +57,32 @@ type eventNewOperation struct {
 	tx.Tx
 }
 
+// Manager tunables, zero values fall back to the defaults
+type ManagerOptions struct {
+	TimeoutRequest  time.Duration
+	RelayDisabled   bool
+	BlocksBacklog   int
+	BlocksWatermark int
+}
+
+func (this ManagerOptions) withDefaults() ManagerOptions {
+	if this.TimeoutRequest == 0 {
+		this.TimeoutRequest = defaults.TimeoutRequest
+	}
+	if this.BlocksBacklog == 0 {
+		this.BlocksBacklog = defaults.NetworkBlocksBacklog
+	}
+	if this.BlocksWatermark == 0 {
+		this.BlocksWatermark = defaults.NetworkBlocksWatermark
+	}
+	return this
+}
+
+type Manager interface {
+	network.Manager
+	BlocksBacklog() int
+}
+
 type manager struct {
 	network.Manager
 
@@ -60,6 +92,7 @@ type manager struct {
 	nonce				   []byte
 
 	timeoutRequest         time.Duration
+	handshakeTimeout       time.Duration
 	peerUpdates            chan<- PeerInfo
 	onStateUpdate          chan *PascalConnection
 	onNewBlock             chan *eventNewBlock
@@ -67,23 +100,48 @@ type manager struct {
 	closed                 chan *PascalConnection
 	initializedConnections map[*PascalConnection]uint32
 	downloading            bool
-	downloadingDone        chan interface{}
+	downloadingDone        chan BlocksDownloadResult
+	seenBlocks             *seenCache
+	seenOperations         *seenCache
+	relayDisabled          bool
+	banned                 *banList
+	self                   *selfAddresses
+	relayFanout            int
+	random                 *rand.Rand
+	blocksWatermark        int
+	downloadsPaused        bool
+	rewinding              bool
+	rewindFrom             uint32
 }
 
-func WithManager(nonce []byte, blockchain *blockchain.Blockchain, peerUpdates chan<- PeerInfo, timeoutRequest time.Duration, callback func(network.Manager) error) error {
-	manager := &manager{
-		timeoutRequest:         timeoutRequest,
+func newManager(nonce []byte, blockchain *blockchain.Blockchain, peerUpdates chan<- PeerInfo, options ManagerOptions) *manager {
+	options = options.withDefaults()
+	return &manager{
+		timeoutRequest:         options.TimeoutRequest,
+		handshakeTimeout:       defaults.HandshakeTimeout,
 		blockchain:             blockchain,
 		nonce:                  nonce,
 		peerUpdates:            peerUpdates,
 		onStateUpdate:          make(chan *PascalConnection),
 		onNewOperation:         make(chan *eventNewOperation),
 		closed:                 make(chan *PascalConnection),
-		onNewBlock:             make(chan *eventNewBlock),
+		onNewBlock:             make(chan *eventNewBlock, options.BlocksBacklog),
 		initializedConnections: make(map[*PascalConnection]uint32),
 		downloading:            false,
-		downloadingDone:        make(chan interface{}),
+		downloadingDone:        make(chan BlocksDownloadResult),
+		seenBlocks:             newSeenCache(defaults.NetworkSeenBlocks),
+		seenOperations:         newSeenCache(defaults.NetworkSeenOperations),
+		relayDisabled:          options.RelayDisabled,
+		banned:                 newBanList(blockchain.GetClock()),
+		self:                   newSelfAddresses(),
+		relayFanout:            defaults.NetworkRelayFanout,
+		random:                 rand.New(rand.NewSource(time.Now().UnixNano())),
+		blocksWatermark:        options.BlocksWatermark,
 	}
+}
+
+func WithManager(nonce []byte, blockchain *blockchain.Blockchain, peerUpdates chan<- PeerInfo, options ManagerOptions, callback func(Manager) error) error {
+	manager := newManager(nonce, blockchain, peerUpdates, options)
 	defer manager.waitGroup.Wait()
 
 	stop := make(chan bool)
@@ -93,32 +151,22 @@ func WithManager(nonce []byte, blockchain *blockchain.Blockchain, peerUpdates ch
 		for {
 			select {
 			case event := <-manager.onNewBlock:
-				if err := manager.blockchain.AddBlockSerialized(&event.SerializedBlock); err != nil {
-					utils.Tracef("[P2P] AddBlockSerialized %d failed %v", event.SerializedBlock.Header.Index, err)
-					if event.shouldBroadcast {
-						manager.forEachConnection(func(conn *PascalConnection) {
-							conn.BroadcastBlock(&event.SerializedBlock)
-						}, event.source)
-					}
+				manager.onNewBlockEvent(event)
+				if manager.downloadsPaused {
+					manager.startDownloading()
 				}
 			case event := <-manager.onNewOperation:
-				new, err := manager.blockchain.AddOperation(&event.Tx)
-				if err != nil {
-					utils.Tracef("[P2P %p] Tx validation failed: %v", event.source, err)
-				} else if new {
-					manager.forEachConnection(func(conn *PascalConnection) {
-						conn.BroadcastTx(&event.Tx)
-					}, event.source)
-				}
-			case <-manager.downloadingDone:
-				manager.downloading = false
-				manager.startDownloading()
+				manager.onNewOperationEvent(event)
+			case result := <-manager.downloadingDone:
+				manager.onDownloadingDone(result)
 			case conn := <-manager.closed:
-				delete(manager.initializedConnections, conn)
+				manager.onConnectionClosed(conn)
 			case conn := <-manager.onStateUpdate:
 				connHeight, _ := conn.GetState()
 				manager.initializedConnections[conn] = connHeight
+				manager.updateBestPeerHeight()
 				manager.startDownloading()
+				manager.syncPendingOperations(conn)
 			case <-stop:
 			}
 		}
@@ -130,12 +178,147 @@ func WithManager(nonce []byte, blockchain *blockchain.Blockchain, peerUpdates ch
 	return err
 }
 
+func (this *manager) onDownloadingDone(result BlocksDownloadResult) {
+	if result.Err != nil {
+		utils.Tracef("[P2P] Downloading blocks #%d .. #%d failed: %v", result.Range[0], result.Range[1], result.Err)
+	} else {
+		utils.Tracef("[P2P] Downloaded %d blocks #%d .. #%d", result.Count, result.Range[0], result.Range[1])
+	}
+	this.downloading = false
+	// Blocks delivered before a failure are already applied, the next download starts past them
+	this.startDownloading()
+}
+
+func (this *manager) onConnectionClosed(conn *PascalConnection) {
+	if err := conn.LastError(); err != nil {
+		utils.Tracef("[P2P %p] Connection closed: %v", conn, err)
+	}
+	delete(this.initializedConnections, conn)
+	this.updateBestPeerHeight()
+}
+
+// Blocks are marked seen once accepted, the rejected ones may turn valid later
+func (this *manager) onNewBlockEvent(event *eventNewBlock) {
+	key := getBlockKey(&event.SerializedBlock)
+	if this.seenBlocks.Contains(key) {
+		return
+	}
+
+	err := this.blockchain.AddBlockSerialized(&event.SerializedBlock)
+	// Queued blocks are not validated yet, neither relayed nor credited to the peer
+	if err == blockchain.ErrBlockQueued {
+		return
+	}
+	if err != nil {
+		utils.Tracef("[P2P] AddBlockSerialized %d failed %v", event.SerializedBlock.Header.Index, err)
+		if err == blockchain.ErrOrphanBlock {
+			this.rewindDownloading(event.SerializedBlock.Header.Index)
+		}
+		// Stale, orphan or future blocks may be fine from the peer's point of view
+		if errors.Is(err, blockchain.ErrInvalidBlock) {
+			this.onInvalidBlock(event.source)
+		}
+		return
+	}
+	this.seenBlocks.Add(key)
+	if event.source != nil {
+		event.source.invalidBlocks = 0
+	}
+
+	if event.shouldBroadcast && !this.relayDisabled {
+		this.forEachConnection(func(conn *PascalConnection) {
+			conn.BroadcastBlock(&event.SerializedBlock)
+		}, event.source)
+	}
+}
+
+func (this *manager) onInvalidBlock(conn *PascalConnection) {
+	if conn == nil {
+		return
+	}
+
+	conn.invalidBlocks++
+	if conn.invalidBlocks < defaults.NetworkMaxInvalidBlocks {
+		return
+	}
+
+	utils.Tracef("[P2P %p] Banning %s after %d invalid blocks", conn, conn.address, conn.invalidBlocks)
+	conn.setLastError(fmt.Errorf("Banned after %d invalid blocks", conn.invalidBlocks))
+	this.banned.Ban(getHost(conn.address), defaults.NetworkBanDuration)
+	// Pending request handlers may report to the manager loop, let OnClose deal with them
+	conn.underlying.transport.Close()
+}
+
+// Operations are marked seen once accepted, the rejected ones may turn valid later
+func (this *manager) onNewOperationEvent(event *eventNewOperation) {
+	key := getOperationKey(&event.Tx)
+	if this.seenOperations.Contains(key) {
+		return
+	}
+
+	new, err := this.blockchain.AddOperation(&event.Tx)
+	if err != nil {
+		utils.Tracef("[P2P %p] Tx validation failed: %v", event.source, err)
+		return
+	}
+	this.seenOperations.Add(key)
+	if new && !this.relayDisabled {
+		this.forEachRelayConnection(func(conn *PascalConnection) {
+			conn.BroadcastTx(&event.Tx)
+		}, event.source)
+	}
+}
+
+func (this *manager) updateBestPeerHeight() {
+	var best uint32
+	for _, height := range this.initializedConnections {
+		if height > best {
+			best = height
+		}
+	}
+	this.blockchain.SetBestKnownPeerHeight(best)
+}
+
+// Blocks received but not processed yet
+func (this *manager) BlocksBacklog() int {
+	return len(this.onNewBlock)
+}
+
+// The blocks below the orphan are downloaded again to find the fork point, down to the deepest reorg allowed
+func (this *manager) rewindDownloading(index uint32) {
+	nodeHeight, _ := this.blockchain.GetState()
+	from := utils.MinUint32(index, nodeHeight)
+	from -= utils.MinUint32(from, defaults.NetworkBlocksPerRequest)
+	if nodeHeight > defaults.MaxReorgDepth && from < nodeHeight-defaults.MaxReorgDepth {
+		from = nodeHeight - defaults.MaxReorgDepth
+	}
+	if !this.rewinding || from < this.rewindFrom {
+		utils.Tracef("[P2P] Orphan block %d, downloading from #%d", index, from)
+		this.rewinding = true
+		this.rewindFrom = from
+	}
+}
+
 func (this *manager) startDownloading() {
 	if this.downloading {
 		return
 	}
 
+	// Downloads resume once the block processor catches up
+	if backlog := this.BlocksBacklog(); backlog >= this.blocksWatermark {
+		if !this.downloadsPaused {
+			utils.Tracef("[P2P] Blocks backlog %d, downloading paused", backlog)
+		}
+		this.downloadsPaused = true
+		return
+	}
+	this.downloadsPaused = false
+
 	nodeHeight, _ := this.blockchain.GetState()
+	from := nodeHeight
+	if this.rewinding && this.rewindFrom < nodeHeight {
+		from = this.rewindFrom
+	}
 
 	candidates := make(map[uint32]*PascalConnection)
 	for conn, height := range this.initializedConnections {
@@ -149,9 +332,19 @@ func (this *manager) startDownloading() {
 		utils.Tracef("[P2P %p] Remote node height %d (%d blocks ahead)", conn, height, height-nodeHeight)
 
 		this.downloading = true
-		to := utils.MinUint32(nodeHeight+defaults.NetworkBlocksPerRequest-1, height-1)
-		if err := conn.StartBlocksDownloading(nodeHeight, to, this.downloadingDone); err == nil {
-			utils.Tracef("[P2P %p] Downloading blocks #%d .. #%d", conn, nodeHeight, to)
+		to, err := common.AddIndex(from, defaults.NetworkBlocksPerRequest-1)
+		if err != nil || to > height-1 {
+			to = height - 1
+		}
+		start := conn.StartBlocksDownloading
+		if conn.supportsHeaders() {
+			start = conn.StartHeadersDownloading
+		}
+		if err := start(from, to, this.downloadingDone); err == nil {
+			utils.Tracef("[P2P %p] Downloading blocks #%d .. #%d", conn, from, to)
+			// Rewinding continues right above the range until it reaches the tip
+			this.rewinding = to+1 < nodeHeight
+			this.rewindFrom = to + 1
 			break
 		} else {
 			this.downloading = false
@@ -163,6 +356,21 @@ func (this *manager) startDownloading() {
 	}
 }
 
+func (this *manager) syncPendingOperations(conn *PascalConnection) {
+	if this.relayDisabled {
+		return
+	}
+
+	pendingOperationsHash := this.blockchain.GetPendingOperationsHash()
+	if bytes.Equal(conn.GetPendingOperationsHash(), pendingOperationsHash[:]) {
+		return
+	}
+
+	if err := conn.RequestPendingOperations(); err != nil {
+		utils.Tracef("[P2P %p] Failed to request pending operations: %v", conn, err)
+	}
+}
+
 func (this *manager) forEachConnection(fn func(*PascalConnection), except *PascalConnection) {
 	for conn := range this.initializedConnections {
 		if conn != except {
@@ -171,9 +379,37 @@ func (this *manager) forEachConnection(fn func(*PascalConnection), except *Pasca
 	}
 }
 
-func (this *manager) OnOpen(address string, transport io.WriteCloser, isOutgoing bool) (interface{}, error) {
+// Operations are relayed to a random subset of peers, they propagate further as each peer relays them in turn
+func (this *manager) forEachRelayConnection(fn func(*PascalConnection), except *PascalConnection) {
+	connections := make([]*PascalConnection, 0, len(this.initializedConnections))
+	for conn := range this.initializedConnections {
+		if conn != except {
+			connections = append(connections, conn)
+		}
+	}
+	for _, index := range selectRelayPeers(this.random, len(connections), this.relayFanout) {
+		fn(connections[index])
+	}
+}
+
+func selectRelayPeers(random *rand.Rand, peers int, minFanout int) []int {
+	fanout := int(math.Ceil(math.Sqrt(float64(peers))))
+	if fanout < minFanout {
+		fanout = minFanout
+	}
+	if fanout > peers {
+		fanout = peers
+	}
+	return random.Perm(peers)[:fanout]
+}
+
+func (this *manager) newConnection(address string, transport io.WriteCloser, isOutgoing bool) (*PascalConnection, error) {
+	if this.banned.IsBanned(getHost(address)) {
+		return nil, fmt.Errorf("[P2P] Peer %s is banned", address)
+	}
+
 	conn := &PascalConnection{
-		underlying:     NewProtocol(transport, this.timeoutRequest),
+		underlying:     NewProtocol(this.blockchain.GetParams().NetId, transport, this.blockchain.GetClock(), this.timeoutRequest),
 		blockchain:     this.blockchain,
 		nonce:          this.nonce,
 		peerUpdates:    this.peerUpdates,
@@ -181,16 +417,32 @@ func (this *manager) OnOpen(address string, transport io.WriteCloser, isOutgoing
 		onNewOperation: this.onNewOperation,
 		closed:         this.closed,
 		onNewBlock:     this.onNewBlock,
+		relayDisabled:  this.relayDisabled,
+		address:        address,
+		self:           this.self,
 	}
 
 	if err := conn.OnOpen(isOutgoing); err != nil {
 		return nil, err
 	}
+	conn.watchHandshake(this.blockchain.GetClock(), this.handshakeTimeout)
+	return conn, nil
+}
+
+func (this *manager) OnOpen(address string, transport io.WriteCloser, isOutgoing bool) (interface{}, error) {
+	conn, err := this.newConnection(address, transport, isOutgoing)
+	if err != nil {
+		return nil, err
+	}
 
 	this.waitGroup.Add(1)
 	return conn, nil
 }
 
+func (this *manager) OpenConn(conn net.Conn, isOutgoing bool) (*PascalConnection, error) {
+	return this.newConnection("tcp://"+conn.RemoteAddr().String(), newConnTransport(conn), isOutgoing)
+}
+
 func (this *manager) OnData(connection interface{}, data []byte) error {
 	return connection.(*PascalConnection).OnData(data)
 }
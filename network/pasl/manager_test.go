@@ -24,12 +24,148 @@ package pasl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/storage"
 	"github.com/pasl-project/pasl/utils"
 )
 
+type testTransport struct {
+	writes  [][]byte
+	closed  bool
+	lock    sync.Mutex
+	written chan struct{}
+	closing chan struct{}
+}
+
+func (this *testTransport) Write(data []byte) (int, error) {
+	this.lock.Lock()
+	this.writes = append(this.writes, append([]byte{}, data...))
+	this.lock.Unlock()
+
+	if this.written != nil {
+		this.written <- struct{}{}
+	}
+	return len(data), nil
+}
+
+func (this *testTransport) Close() error {
+	this.lock.Lock()
+	this.closed = true
+	this.lock.Unlock()
+
+	if this.closing != nil {
+		this.closing <- struct{}{}
+	}
+	return nil
+}
+
+func (this *testTransport) reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.writes = nil
+}
+
+func (this *testTransport) isClosed() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.closed
+}
+
+func (this *testTransport) getPackets(t *testing.T) []packetHeader {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	packets := make([]packetHeader, 0, len(this.writes))
+	for _, data := range this.writes {
+		var header packetHeader
+		if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, header)
+	}
+	return packets
+}
+
+func withTestStorage(t *testing.T, fn func(storage *storage.Storage)) {
+	dir, err := ioutil.TempDir("", "pasl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = storage.WithStorageFile(filepath.Join(dir, "storage.db"), defaults.AccountsPerBlock, func(storage *storage.Storage) error {
+		fn(storage)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestManager(t *testing.T, storage *storage.Storage) *manager {
+	blockchain, err := blockchain.NewBlockchain(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newManager([]byte("nonce"), blockchain, make(chan PeerInfo, 100), ManagerOptions{TimeoutRequest: time.Minute})
+}
+
+func withTestManager(t *testing.T, fn func(manager *manager)) {
+	withTestStorage(t, func(storage *storage.Storage) {
+		fn(newTestManager(t, storage))
+	})
+}
+
+func newTestConnection(t *testing.T, manager *manager) (*PascalConnection, *testTransport) {
+	transport := &testTransport{}
+	conn, err := manager.OnOpen("tcp://127.0.0.1:4004", transport, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.initializedConnections[conn.(*PascalConnection)] = 0
+	return conn.(*PascalConnection), transport
+}
+
+func newTestHelloRequest() *requestResponse {
+	return &requestResponse{version: protocolVersion, result: &result{}}
+}
+
+func getTestBlock(t *testing.T, blockchain *blockchain.Blockchain) safebox.SerializedBlock {
+	height, _ := blockchain.GetState()
+	return getTestBlockWithTimestamp(t, blockchain, 1500000000+height*300)
+}
+
+func getTestBlockWithTimestamp(t *testing.T, blockchain *blockchain.Blockchain, timestamp uint32) safebox.SerializedBlock {
+	height, safeboxHash := blockchain.GetState()
+	block, err := safebox.NewBlock(&safebox.BlockMetadata{
+		Index:           height,
+		Miner:           utils.Serialize(crypto.NewKeyNil().Public),
+		Timestamp:       timestamp,
+		Target:          defaults.MinTarget,
+		PrevSafeBoxHash: safeboxHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block.Serialize()
+}
+
 func TestDeserializeBlocks(t *testing.T) {
 
 	buffer, err := hex.DecodeString("020000000201000100628801004600ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120a107000000000000000000000000005147735a1ef2d130005b5f1522007061736c2e66616972706f6f6c2e78797a5f4330334445393841376330303030303020002063b4544af77cf1a3cbf6eaae844772a808a12c2ca9e8965c861d3751bf161b2000c611fbcc6e11f1e859d4c81387b445a2e3414962f4f84c08229dbe0d90d6505f20000000000000007e4b5e7947620478fcb1d498a0084eaaf7d44019200266b1476b0a00000001000000a19d070003000000a8cb030024e301000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200057e773c096748cbefb32c7c1c7ad04130fa31e68706f3cc023f73dc80b9c19772000056eb2578bb8fd414b1abfaf3e67459ebbcc69aa8145890f5701819036b9d70601000000a19d0700040000003a2707005ddf01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200022eeb6bf1a2ac3f96fabe8b4845717e6d4a117c044054b6334b51304ec64cbad20003eb64ba88a0988410286a50278f9825ef529c027a005cda4f069c77b77eb701102000000f0a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000e45e5d7757ba87c468df08b41e8e21dda16538ac345f16ff64062efb66c66a722000c0e4b0a478123efc18bd712ffe91626a8f355a891e41603b6aacf25fa77855e82000cf0ea05f90796eee9c3dc5fab97039e91b7c3398c9c16a3cd79dc9cec06a149f2000a64ec12db4f635b1e2d329f09840d75038d20ab9dc8fa6ec82d33c1fcea096cf01000000a19d070005000000f0a70700b46701000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669012000300a46854b5754c6682ec06d8b3f9be366c746e2720f41086ab8d23bfa045de320002ce4cb9a34a552c72530fe66149e4477265148399650c366dff2fead8cdc189902000000efa707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000e45e5d7757ba87c468df08b41e8e21dda16538ac345f16ff64062efb66c66a722000c0e4b0a478123efc18bd712ffe91626a8f355a891e41603b6aacf25fa77855e820002505500ec6e753ef6ad99b28973d31f853224863d5028316e06ce81f19ea4eef20009ff2cb84e69354665f85d163edadf6b705291a7c32b8cd67491be3f8e347402001000000a69d070001000000efa70700d07600000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669012000a948bf4ff5bd719e5045af99cae6c77da93134a7bd28168d7ed92a04ac05e24e20007af964a8aba773bbd45c18f5017e99c591a947f469900f38b20be733967ab55602000000f5a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000b81815199ea76766759735f829f99f20a45f5281def971cf507f3b0f8693a08020001789c4fa04ff63e8a10752baef743d8c414d475e9536e71f7a17156d7e7c50d520009820d47016256c07ac30b1d8ec83dcfa6df84916ac65768e1b801388890c606a2000b9a31669bbec3647a6795c6f72e4fe0d44ab0e769f31b1417c1e467f473e892d01000000a69d070002000000f5a7070084de01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120009317277092851c7f00c2527e5669a57038417dd4984660f37ed1512f09d92c292000ba3e8d9ed27361a46334762986dbf611eb5e42abbffcfb4b7f18852784833fd602000000f4a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca0220004827190c2e4d9970a4edca77e7485307a6171f5981760f4dd0f191b7d20f3d1920005ccbafb54acd3ff5d8482d41911e7db64847ac685d3ae1af62dd04ab3f9b105920003d66c9f7024b98492350541f5130f35a97167cd4e8c319459c969410e56cfaf02000ff75b968b330fb5eeb3bbcd349daa49910cde628d5813f6948472ae1069ee09a01000000a69d070003000000f4a7070084de01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200045c9150792fcff16dc6430df2aee267d0919022a271f4601e6ba88a56387728c20006c7f8a8e60fc441d530cbea1b5210594fc6b34dbfd25f487509594421d53360c0201000100638801004600ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120a107000000000000000000000000005847735a02e2d130042d92c622007061736c2e66616972706f6f6c2e78797a5f463937303039373733353430303030302000262d4766f39d8bb6ef0fe3cd1381a01b4dfda22b3e6f4bb0406b16368c0603382000e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855200000000000000074097dbf6a8a6e6ba9aeff7e8239ba8dbe15c6b0d7aa11f8979900000000")
@@ -52,3 +188,576 @@ func TestDeserializeBlocks(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+const testBlocksResponse = "020000000201000100628801004600ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120a107000000000000000000000000005147735a1ef2d130005b5f1522007061736c2e66616972706f6f6c2e78797a5f4330334445393841376330303030303020002063b4544af77cf1a3cbf6eaae844772a808a12c2ca9e8965c861d3751bf161b2000c611fbcc6e11f1e859d4c81387b445a2e3414962f4f84c08229dbe0d90d6505f20000000000000007e4b5e7947620478fcb1d498a0084eaaf7d44019200266b1476b0a00000001000000a19d070003000000a8cb030024e301000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200057e773c096748cbefb32c7c1c7ad04130fa31e68706f3cc023f73dc80b9c19772000056eb2578bb8fd414b1abfaf3e67459ebbcc69aa8145890f5701819036b9d70601000000a19d0700040000003a2707005ddf01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200022eeb6bf1a2ac3f96fabe8b4845717e6d4a117c044054b6334b51304ec64cbad20003eb64ba88a0988410286a50278f9825ef529c027a005cda4f069c77b77eb701102000000f0a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000e45e5d7757ba87c468df08b41e8e21dda16538ac345f16ff64062efb66c66a722000c0e4b0a478123efc18bd712ffe91626a8f355a891e41603b6aacf25fa77855e82000cf0ea05f90796eee9c3dc5fab97039e91b7c3398c9c16a3cd79dc9cec06a149f2000a64ec12db4f635b1e2d329f09840d75038d20ab9dc8fa6ec82d33c1fcea096cf01000000a19d070005000000f0a70700b46701000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669012000300a46854b5754c6682ec06d8b3f9be366c746e2720f41086ab8d23bfa045de320002ce4cb9a34a552c72530fe66149e4477265148399650c366dff2fead8cdc189902000000efa707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000e45e5d7757ba87c468df08b41e8e21dda16538ac345f16ff64062efb66c66a722000c0e4b0a478123efc18bd712ffe91626a8f355a891e41603b6aacf25fa77855e820002505500ec6e753ef6ad99b28973d31f853224863d5028316e06ce81f19ea4eef20009ff2cb84e69354665f85d163edadf6b705291a7c32b8cd67491be3f8e347402001000000a69d070001000000efa70700d07600000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669012000a948bf4ff5bd719e5045af99cae6c77da93134a7bd28168d7ed92a04ac05e24e20007af964a8aba773bbd45c18f5017e99c591a947f469900f38b20be733967ab55602000000f5a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000b81815199ea76766759735f829f99f20a45f5281def971cf507f3b0f8693a08020001789c4fa04ff63e8a10752baef743d8c414d475e9536e71f7a17156d7e7c50d520009820d47016256c07ac30b1d8ec83dcfa6df84916ac65768e1b801388890c606a2000b9a31669bbec3647a6795c6f72e4fe0d44ab0e769f31b1417c1e467f473e892d01000000a69d070002000000f5a7070084de01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120009317277092851c7f00c2527e5669a57038417dd4984660f37ed1512f09d92c292000ba3e8d9ed27361a46334762986dbf611eb5e42abbffcfb4b7f18852784833fd602000000f4a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca0220004827190c2e4d9970a4edca77e7485307a6171f5981760f4dd0f191b7d20f3d1920005ccbafb54acd3ff5d8482d41911e7db64847ac685d3ae1af62dd04ab3f9b105920003d66c9f7024b98492350541f5130f35a97167cd4e8c319459c969410e56cfaf02000ff75b968b330fb5eeb3bbcd349daa49910cde628d5813f6948472ae1069ee09a01000000a69d070003000000f4a7070084de01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200045c9150792fcff16dc6430df2aee267d0919022a271f4601e6ba88a56387728c20006c7f8a8e60fc441d530cbea1b5210594fc6b34dbfd25f487509594421d53360c0201000100638801004600ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120a107000000000000000000000000005847735a02e2d130042d92c622007061736c2e66616972706f6f6c2e78797a5f463937303039373733353430303030302000262d4766f39d8bb6ef0fe3cd1381a01b4dfda22b3e6f4bb0406b16368c0603382000e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855200000000000000074097dbf6a8a6e6ba9aeff7e8239ba8dbe15c6b0d7aa11f8979900000000"
+
+// Operations go as uint32 LE count, then uint32 type and body for each, same as the reference implementation
+func TestBlockOperationsLayout(t *testing.T) {
+	buffer, err := hex.DecodeString(testBlocksResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet packetGetBlocksResponse
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	operations := struct {
+		Operations []tx.Tx
+	}{packet.Blocks[0].Operations}
+	serialized := utils.Serialize(&operations)
+	if count := binary.LittleEndian.Uint32(serialized); count != 10 {
+		t.Fatalf("%d", count)
+	}
+	if operationType := binary.LittleEndian.Uint32(serialized[4:]); operationType != 1 {
+		t.Fatalf("%d", operationType)
+	}
+	if !bytes.Contains(buffer, serialized) {
+		t.FailNow()
+	}
+	if !bytes.Equal(utils.Serialize(&packet), buffer) {
+		t.FailNow()
+	}
+}
+
+func TestNewBlockDuplicate(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		a, transportA := newTestConnection(t, manager)
+		b, transportB := newTestConnection(t, manager)
+		_, transportC := newTestConnection(t, manager)
+
+		block := getTestBlock(t, manager.blockchain)
+		manager.onNewBlockEvent(&eventNewBlock{event{a}, block, true})
+		manager.onNewBlockEvent(&eventNewBlock{event{b}, block, true})
+
+		if height, _ := manager.blockchain.GetState(); height != 1 {
+			t.Fatalf("%d != 1", height)
+		}
+		if len(transportA.writes) != 0 {
+			t.FailNow()
+		}
+		for _, transport := range []*testTransport{transportB, transportC} {
+			packets := transport.getPackets(t)
+			if len(packets) != 1 || packets[0].Operation != newBlock {
+				t.FailNow()
+			}
+		}
+	})
+}
+
+type testTimer struct {
+	deadline time.Time
+	fired    chan time.Time
+}
+
+// Timers fire only when the test advances the clock past their deadline
+type testClock struct {
+	now    time.Time
+	timers []testTimer
+	lock   sync.Mutex
+}
+
+func (this *testClock) Now() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.now
+}
+
+func (this *testClock) After(d time.Duration) <-chan time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	fired := make(chan time.Time, 1)
+	this.timers = append(this.timers, testTimer{this.now.Add(d), fired})
+	return fired
+}
+
+func (this *testClock) advance(d time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.now = this.now.Add(d)
+	pending := this.timers[:0]
+	for _, timer := range this.timers {
+		if this.now.Before(timer.deadline) {
+			pending = append(pending, timer)
+		} else {
+			timer.fired <- this.now
+		}
+	}
+	this.timers = pending
+}
+
+func TestNewBlockSeenAfterValidation(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		block := getTestBlock(t, manager.blockchain)
+		clock := &testClock{now: time.Unix(int64(block.Header.Time-defaults.MaxFutureBlockTime-1), 0)}
+		manager.blockchain.SetClock(clock)
+
+		// Too far in the future at first, the same block is fine a second later
+		manager.onNewBlockEvent(&eventNewBlock{event{conn}, block, false})
+		if height, _ := manager.blockchain.GetState(); height != 0 || manager.seenBlocks.Len() != 0 {
+			t.FailNow()
+		}
+		clock.advance(time.Second)
+		manager.onNewBlockEvent(&eventNewBlock{event{conn}, block, false})
+		if height, _ := manager.blockchain.GetState(); height != 1 || manager.seenBlocks.Len() != 1 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestNewBlockQueued(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		source, _ := newTestConnection(t, manager)
+		_, transport := newTestConnection(t, manager)
+		source.invalidBlocks = 1
+
+		manager.blockchain.Pause()
+		manager.onNewBlockEvent(&eventNewBlock{event{source}, getTestBlock(t, manager.blockchain), true})
+		if len(transport.getPackets(t)) != 0 || source.invalidBlocks != 1 || manager.seenBlocks.Len() != 0 {
+			t.FailNow()
+		}
+
+		if err := manager.blockchain.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		if height, _ := manager.blockchain.GetState(); height != 1 {
+			t.Fatalf("%d", height)
+		}
+	})
+}
+
+func TestOperationFilterRelay(t *testing.T) {
+	blocks, err := hex.DecodeString(testBlocksResponse)
+	if err != nil {
+		t.FailNow()
+	}
+	var packet packetGetBlocksResponse
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(blocks)); err != nil {
+		t.FailNow()
+	}
+	operation := packet.Blocks[0].Operations[0]
+	source, _, _ := operation.GetSourceInfo()
+
+	withTestManager(t, func(manager *manager) {
+		manager.blockchain.SetOperationFilter(blockchain.NewBlacklistFilter(source))
+
+		a, _ := newTestConnection(t, manager)
+		_, transport := newTestConnection(t, manager)
+
+		manager.onNewOperationEvent(&eventNewOperation{event{a}, operation})
+		if new, err := manager.blockchain.AddOperation(&operation); new || err == nil {
+			t.FailNow()
+		}
+		if len(transport.writes) != 0 || manager.seenOperations.Len() != 0 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestRelayDisabled(t *testing.T) {
+	withTestStorage(t, func(storage *storage.Storage) {
+		chain, err := blockchain.NewBlockchain(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager := newManager([]byte("nonce"), chain, make(chan PeerInfo, 100), ManagerOptions{TimeoutRequest: time.Minute, RelayDisabled: true})
+
+		a, _ := newTestConnection(t, manager)
+		b, transportB := newTestConnection(t, manager)
+
+		block := getTestBlock(t, manager.blockchain)
+		manager.onNewBlockEvent(&eventNewBlock{event{a}, block, true})
+		if height, _ := manager.blockchain.GetState(); height != 1 {
+			t.Fatalf("%d != 1", height)
+		}
+		if len(transportB.writes) != 0 {
+			t.FailNow()
+		}
+
+		if response := requestBlocks(t, b, 0, 0); len(response.Blocks) != 0 {
+			t.Fatalf("%d != 0", len(response.Blocks))
+		}
+		if _, err := b.onGetHeadersRequest(&requestResponse{result: &result{}}, utils.Serialize(packetGetBlocksRequest{FromIndex: 0, ToIndex: 0})); err != nil {
+			t.Fatal(err)
+		}
+		packets := transportB.getPackets(t)
+		if len(packets) != 2 || packets[0].Operation != errorReport || packets[1].Operation != errorReport {
+			t.FailNow()
+		}
+	})
+}
+
+func TestTestnetParams(t *testing.T) {
+	withTestStorage(t, func(storage *storage.Storage) {
+		params := defaults.TestnetParams()
+		chain, err := blockchain.NewBlockchainWithParams(storage, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, safeboxHash := chain.GetState(); !bytes.Equal(safeboxHash, params.GenesisSafeBox[:]) {
+			t.FailNow()
+		}
+		mainnet := defaults.MainnetParams()
+		if bytes.Equal(params.GenesisSafeBox[:], mainnet.GenesisSafeBox[:]) || params.NetId == mainnet.NetId {
+			t.FailNow()
+		}
+
+		manager := newManager([]byte("nonce"), chain, make(chan PeerInfo, 100), ManagerOptions{TimeoutRequest: time.Minute})
+		conn, transport := newTestConnection(t, manager)
+
+		block := getTestBlock(t, chain)
+		if err := chain.AddBlockSerialized(&block); err != nil {
+			t.Fatal(err)
+		}
+		conn.BroadcastBlock(&block)
+		if packets := transport.getPackets(t); len(packets) != 1 || packets[0].NetworkId != params.NetId {
+			t.FailNow()
+		}
+
+		if err := conn.OnData(utils.Serialize(mainnet.NetId)); err == nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestInvalidBlocksBan(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, transport := newTestConnection(t, manager)
+
+		// Blocks from the future may be fine for the peer, they don't count
+		block := getTestBlock(t, manager.blockchain)
+		manager.blockchain.SetClock(&testClock{now: time.Unix(int64(block.Header.Time-defaults.MaxFutureBlockTime-1), 0)})
+		for i := uint32(0); i < defaults.NetworkMaxInvalidBlocks; i++ {
+			manager.onNewBlockEvent(&eventNewBlock{event{conn}, block, false})
+		}
+		if transport.isClosed() || conn.invalidBlocks != 0 {
+			t.FailNow()
+		}
+		manager.blockchain.SetClock(utils.SystemClock{})
+
+		var i uint32
+		for i = 0; i < defaults.NetworkMaxInvalidBlocks; i++ {
+			if transport.isClosed() {
+				t.Fatalf("closed after %d blocks", i)
+			}
+			block := getTestBlock(t, manager.blockchain)
+			block.Header.PrevSafeboxHash = make([]byte, 32)
+			block.Header.Nonce = i
+			manager.onNewBlockEvent(&eventNewBlock{event{conn}, block, false})
+		}
+
+		if !transport.isClosed() || !manager.banned.IsBanned("127.0.0.1") {
+			t.FailNow()
+		}
+		if _, err := manager.OnOpen("tcp://127.0.0.1:4005", &testTransport{}, false); err == nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		clock := &testClock{}
+		manager.blockchain.SetClock(clock)
+		silent, silentTransport := newTestConnection(t, manager)
+		silentTransport.closing = make(chan struct{}, 1)
+		greeted, greetedTransport := newTestConnection(t, manager)
+
+		go func() { <-manager.onStateUpdate }()
+		hello := generateHello(time.Now(), 0, []byte("remote"), *manager.blockchain.GetPendingHeader(), nil, defaults.UserAgent, supportedCapabilities)
+		if err := greeted.onHelloCommon(newTestHelloRequest(), hello); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.advance(manager.handshakeTimeout - time.Second)
+		if silentTransport.isClosed() {
+			t.FailNow()
+		}
+		clock.advance(time.Second)
+		<-silentTransport.closing
+		if !silentTransport.isClosed() || silent.LastError() == nil {
+			t.FailNow()
+		}
+		if greetedTransport.isClosed() || greeted.LastError() != nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestSyncPendingOperations(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, transport := newTestConnection(t, manager)
+		pendingOperationsHash := manager.blockchain.GetPendingOperationsHash()
+
+		conn.state = &pascalConnectionState{pendingOperationsHash: pendingOperationsHash[:]}
+		manager.syncPendingOperations(conn)
+		if packets := transport.getPackets(t); len(packets) != 0 {
+			t.Fatalf("%d", len(packets))
+		}
+
+		conn.state = &pascalConnectionState{pendingOperationsHash: make([]byte, 32)}
+		manager.syncPendingOperations(conn)
+		packets := transport.getPackets(t)
+		if len(packets) != 1 || packets[0].Operation != getPendingOperations || packets[0].TypeId != request {
+			t.FailNow()
+		}
+	})
+}
+
+func TestSyncStatus(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 2)
+
+		if status := manager.blockchain.Status(); status.Height != 2 || status.BestKnownPeerHeight != 0 || !status.Synced {
+			t.Fatalf("%+v", status)
+		}
+
+		a, _ := newTestConnection(t, manager)
+		b, _ := newTestConnection(t, manager)
+		for _, heights := range [][2]uint32{{1, 2}, {5, 3}, {0, 0}} {
+			manager.initializedConnections[a] = heights[0]
+			manager.initializedConnections[b] = heights[1]
+			manager.updateBestPeerHeight()
+
+			best := heights[0]
+			if heights[1] > best {
+				best = heights[1]
+			}
+			if status := manager.blockchain.Status(); status.Height != 2 || status.BestKnownPeerHeight != best || status.Synced != (best <= 2) {
+				t.Fatalf("%+v", status)
+			}
+		}
+
+		delete(manager.initializedConnections, a)
+		delete(manager.initializedConnections, b)
+		manager.updateBestPeerHeight()
+		if status := manager.blockchain.Status(); status.BestKnownPeerHeight != 0 || !status.Synced {
+			t.Fatalf("%+v", status)
+		}
+	})
+}
+
+func TestRelayFanout(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		manager.relayFanout = 0
+
+		source, _ := newTestConnection(t, manager)
+		transports := make(map[*PascalConnection]*testTransport)
+		for i := 0; i < 16; i++ {
+			conn, transport := newTestConnection(t, manager)
+			transports[conn] = transport
+		}
+
+		relayed := make(map[*PascalConnection]struct{})
+		manager.forEachRelayConnection(func(conn *PascalConnection) {
+			if conn == source {
+				t.FailNow()
+			}
+			relayed[conn] = struct{}{}
+		}, source)
+		if len(relayed) != 4 {
+			t.Fatalf("%d", len(relayed))
+		}
+
+		block := getTestBlock(t, manager.blockchain)
+		manager.onNewBlockEvent(&eventNewBlock{event{source}, block, true})
+		for _, transport := range transports {
+			if packets := transport.getPackets(t); len(packets) != 1 || packets[0].Operation != newBlock {
+				t.FailNow()
+			}
+		}
+	})
+}
+
+func TestRelayFanoutPropagation(t *testing.T) {
+	const nodes = 64
+	random := rand.New(rand.NewSource(1))
+
+	informed := map[int]bool{0: true}
+	relaying := []int{0}
+	rounds := 0
+	for ; len(relaying) > 0 && len(informed) < nodes; rounds++ {
+		next := []int{}
+		for _, node := range relaying {
+			peers := make([]int, 0, nodes-1)
+			for peer := 0; peer < nodes; peer++ {
+				if peer != node {
+					peers = append(peers, peer)
+				}
+			}
+			selected := selectRelayPeers(random, len(peers), 0)
+			if len(selected) != 8 {
+				t.Fatalf("%d", len(selected))
+			}
+			for _, index := range selected {
+				if peer := peers[index]; !informed[peer] {
+					informed[peer] = true
+					next = append(next, peer)
+				}
+			}
+		}
+		relaying = next
+	}
+
+	if len(informed) != nodes || rounds > 4 {
+		t.Fatalf("%d nodes informed after %d rounds", len(informed), rounds)
+	}
+}
+
+func TestResumeDownloading(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		connections := make(map[*PascalConnection]*testTransport)
+		for i := 0; i < 2; i++ {
+			conn, transport := newTestConnection(t, manager)
+			conn.state = &pascalConnectionState{height: 4}
+			manager.initializedConnections[conn] = 4
+			connections[conn] = transport
+		}
+
+		lastGetBlocks := func(transport *testTransport) *packetGetBlocksRequest {
+			transport.lock.Lock()
+			defer transport.lock.Unlock()
+			for index := len(transport.writes) - 1; index >= 0; index-- {
+				var header packetHeader
+				if err := binary.Read(bytes.NewReader(transport.writes[index]), binary.LittleEndian, &header); err != nil {
+					t.Fatal(err)
+				}
+				if header.Operation == getBlocks {
+					var packet packetGetBlocksRequest
+					if err := utils.Deserialize(&packet, bytes.NewBuffer(transport.writes[index][headerSize:])); err != nil {
+						t.Fatal(err)
+					}
+					return &packet
+				}
+			}
+			return nil
+		}
+
+		manager.startDownloading()
+		var dropped, replacement *PascalConnection
+		for conn, transport := range connections {
+			if packet := lastGetBlocks(transport); packet != nil {
+				if packet.FromIndex != 0 || packet.ToIndex != 3 {
+					t.Fatalf("%+v", packet)
+				}
+				dropped = conn
+			} else {
+				replacement = conn
+			}
+		}
+		if dropped == nil || replacement == nil {
+			t.FailNow()
+		}
+
+		// The first two blocks of the range made it before the peer dropped
+		for i := 0; i < 2; i++ {
+			manager.onNewBlockEvent(&eventNewBlock{event{dropped}, getTestBlock(t, manager.blockchain), false})
+		}
+		go dropped.OnClose()
+		manager.onConnectionClosed(<-manager.closed)
+		result := <-manager.downloadingDone
+		if result.Err == nil {
+			t.FailNow()
+		}
+		manager.onDownloadingDone(result)
+
+		packet := lastGetBlocks(connections[replacement])
+		if packet == nil || packet.FromIndex != 2 || packet.ToIndex != 3 {
+			t.Fatalf("%+v", packet)
+		}
+		if !manager.downloading {
+			t.FailNow()
+		}
+	})
+}
+
+func TestDownloadsPausedAtWatermark(t *testing.T) {
+	withTestStorage(t, func(storage *storage.Storage) {
+		chain, err := blockchain.NewBlockchain(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager := newManager([]byte("nonce"), chain, make(chan PeerInfo, 100), ManagerOptions{TimeoutRequest: time.Minute, BlocksWatermark: 2})
+		conn, transport := newTestConnection(t, manager)
+		conn.state = &pascalConnectionState{height: 4}
+		manager.initializedConnections[conn] = 4
+
+		payload, err := hex.DecodeString(testBlocksResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Nobody processes the received blocks
+		done := make(chan BlocksDownloadResult, 1)
+		if err := conn.onBlocksResponse([2]uint32{0, 1}, done)(&requestResponse{}, payload); err != nil {
+			t.Fatal(err)
+		}
+		if backlog := manager.BlocksBacklog(); backlog != 2 {
+			t.Fatalf("%d", backlog)
+		}
+		transport.reset()
+		manager.onDownloadingDone(<-done)
+		if manager.downloading || !manager.downloadsPaused || len(transport.getPackets(t)) != 0 {
+			t.FailNow()
+		}
+
+		manager.onNewBlockEvent(<-manager.onNewBlock)
+		manager.startDownloading()
+		if !manager.downloading || manager.downloadsPaused || len(transport.getPackets(t)) != 1 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestDownloadRewind(t *testing.T) {
+	// The peer's branch forks at block 1 and is one block longer
+	var branch []safebox.SerializedBlock
+	var branchHash []byte
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 1)
+		for i := 0; i < 2; i++ {
+			height, _ := manager.blockchain.GetState()
+			block := getTestBlockWithTimestamp(t, manager.blockchain, 1500000000+height*300+1)
+			if err := manager.blockchain.AddBlockSerialized(&block); err != nil {
+				t.Fatal(err)
+			}
+			branch = append(branch, block)
+		}
+		_, branchHash = manager.blockchain.GetState()
+	})
+
+	withTestManager(t, func(manager *manager) {
+		addTestBlocks(t, manager, 2)
+		conn, transport := newTestConnection(t, manager)
+		conn.state = &pascalConnectionState{height: 3}
+		manager.initializedConnections[conn] = 3
+
+		manager.onNewBlockEvent(&eventNewBlock{event{conn}, branch[1], false})
+		if height, _ := manager.blockchain.GetState(); height != 2 || transport.isClosed() || conn.invalidBlocks != 0 {
+			t.FailNow()
+		}
+
+		manager.startDownloading()
+		transport.lock.Lock()
+		written := transport.writes[len(transport.writes)-1]
+		transport.lock.Unlock()
+		var packet packetGetBlocksRequest
+		if err := utils.Deserialize(&packet, bytes.NewBuffer(written[headerSize:])); err != nil {
+			t.Fatal(err)
+		}
+		if packet.FromIndex != 0 || packet.ToIndex != 2 {
+			t.Fatalf("%+v", packet)
+		}
+
+		for index := range branch {
+			manager.onNewBlockEvent(&eventNewBlock{event{conn}, branch[index], false})
+		}
+		if height, safeboxHash := manager.blockchain.GetState(); height != 3 || !bytes.Equal(safeboxHash, branchHash) {
+			t.FailNow()
+		}
+	})
+}
@@ -33,6 +33,21 @@ import (
 	"github.com/pasl-project/pasl/utils"
 )
 
+type capabilities uint32
+
+const (
+	capabilityCompression capabilities = 1 << iota
+	capabilityLargeBatch
+	capabilityHeadersFirst
+	capabilityMessages
+)
+
+const supportedCapabilities = capabilityHeadersFirst | capabilityMessages
+
+func negotiateCapabilities(local capabilities, remote capabilities) capabilities {
+	return local & remote
+}
+
 type helloHandler struct {
 	Nonce              []byte
 	GetTopBlock        func() safebox.BlockBase
@@ -49,12 +64,13 @@ type PeerInfo struct {
 }
 
 type packetHello struct {
-	NodePort  uint16
-	Nonce     []byte
-	Time      uint32
-	Block     safebox.SerializedBlockHeader
-	Peers     []PeerInfo
-	UserAgent string
+	NodePort     uint16
+	Nonce        []byte
+	Time         uint32
+	Block        safebox.SerializedBlockHeader
+	Peers        []PeerInfo
+	UserAgent    utils.Text
+	Capabilities capabilities
 }
 
 func (this *helloHandler) getTcpPeersList() []PeerInfo {
@@ -78,13 +94,14 @@ func (this *helloHandler) getTcpPeersList() []PeerInfo {
 	return peers
 }
 
-func generateHello(nodePort uint16, nonce []byte, pendingBlock safebox.SerializedBlockHeader, peers []PeerInfo, userAgent string) []byte {
+func generateHello(now time.Time, nodePort uint16, nonce []byte, pendingBlock safebox.SerializedBlockHeader, peers []PeerInfo, userAgent string, capabilities capabilities) []byte {
 	return utils.Serialize(packetHello{
-		NodePort:  nodePort,
-		Nonce:     nonce,
-		Time:      uint32(time.Now().Unix()),
-		Block:     pendingBlock,
-		Peers:     peers,
-		UserAgent: userAgent,
+		NodePort:     nodePort,
+		Nonce:        nonce,
+		Time:         uint32(now.Unix()),
+		Block:        pendingBlock,
+		Peers:        peers,
+		UserAgent:    utils.Text(userAgent),
+		Capabilities: capabilities,
 	})
 }
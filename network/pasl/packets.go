@@ -25,6 +25,7 @@ package pasl
 import (
 	"github.com/pasl-project/pasl/safebox"
 	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
 )
 
 type packetGetBlocksRequest struct {
@@ -32,12 +33,20 @@ type packetGetBlocksRequest struct {
 	ToIndex   uint32
 }
 
+type packetGetBlocksListRequest struct {
+	Indexes []uint32
+}
+
 type packetGetBlocksResponse struct {
 	Blocks []safebox.SerializedBlock
 }
 
+type packetGetHeadersResponse struct {
+	Headers []safebox.SerializedBlockHeader
+}
+
 type packetError struct {
-	Message string
+	Message utils.Text
 }
 
 type packetNewBlock struct {
@@ -0,0 +1,264 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+
+	"github.com/pasl-project/pasl/utils"
+)
+
+// Two mainnet transfers: uint32 count, then uint8 type and body for each operation
+const testNewOperationsPayload = "0200000001a19d070003000000a8cb030024e301000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200057e773c096748cbefb32c7c1c7ad04130fa31e68706f3cc023f73dc80b9c19772000056eb2578bb8fd414b1abfaf3e67459ebbcc69aa8145890f5701819036b9d70601a19d0700040000003a2707005ddf01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200022eeb6bf1a2ac3f96fabe8b4845717e6d4a117c044054b6334b51304ec64cbad20003eb64ba88a0988410286a50278f9825ef529c027a005cda4f069c77b77eb7011"
+
+func getTestNewOperations(t *testing.T) ([]byte, packetNewOperations) {
+	payload, err := hex.DecodeString(testNewOperationsPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packet packetNewOperations
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return payload, packet
+}
+
+func TestNewOperationsRoundTrip(t *testing.T) {
+	payload, packet := getTestNewOperations(t)
+	if len(packet.Operations) != 2 {
+		t.Fatalf("%d", len(packet.Operations))
+	}
+	if source, operationId, _ := packet.Operations[1].GetSourceInfo(); source != 499105 || operationId != 4 {
+		t.Fatalf("%d %d", source, operationId)
+	}
+
+	if serialized := utils.Serialize(&packet); !bytes.Equal(serialized, payload) {
+		t.Fatalf("%x", serialized)
+	}
+}
+
+func TestBroadcastTxLayout(t *testing.T) {
+	payload, packet := getTestNewOperations(t)
+	// Both captured operations have the same size
+	expected := append(utils.Serialize(uint32(1)), payload[4:4+(len(payload)-4)/2]...)
+
+	withTestManager(t, func(manager *manager) {
+		conn, transport := newTestConnection(t, manager)
+		transport.reset()
+
+		conn.BroadcastTx(&packet.Operations[0])
+		conn.flushOperations()
+		if len(transport.writes) != 1 {
+			t.Fatalf("%d", len(transport.writes))
+		}
+		sent := transport.writes[0][binary.Size(packetHeader{}):]
+		if !bytes.Equal(sent, expected) {
+			t.Fatalf("%x", sent)
+		}
+	})
+}
+
+func TestBroadcastTxBatching(t *testing.T) {
+	_, packet := getTestNewOperations(t)
+
+	withTestManager(t, func(manager *manager) {
+		clock := &testClock{}
+		manager.blockchain.SetClock(clock)
+		conn, transport := newTestConnection(t, manager)
+		transport.reset()
+		transport.written = make(chan struct{}, 1)
+
+		conn.BroadcastTx(&packet.Operations[0])
+		conn.BroadcastTx(&packet.Operations[1])
+		conn.BroadcastTx(&packet.Operations[0])
+		clock.advance(defaults.OperationsBatchWindow - time.Millisecond)
+		if packets := transport.getPackets(t); len(packets) != 0 {
+			t.Fatalf("%d", len(packets))
+		}
+
+		clock.advance(time.Millisecond)
+		<-transport.written
+
+		transport.lock.Lock()
+		defer transport.lock.Unlock()
+		if len(transport.writes) != 1 {
+			t.Fatalf("%d", len(transport.writes))
+		}
+		var sent packetNewOperations
+		if err := utils.Deserialize(&sent, bytes.NewBuffer(transport.writes[0][binary.Size(packetHeader{}):])); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent.Operations) != 3 {
+			t.Fatalf("%d", len(sent.Operations))
+		}
+	})
+}
+
+func TestBroadcastTxStaleBatchTimer(t *testing.T) {
+	_, packet := getTestNewOperations(t)
+
+	withTestManager(t, func(manager *manager) {
+		clock := &testClock{}
+		manager.blockchain.SetClock(clock)
+		conn, transport := newTestConnection(t, manager)
+		transport.reset()
+
+		// The full batch is sent right away, its timer stays armed
+		stale := conn.pendingBatch
+		for index := 0; index < defaults.OperationsBatchCount; index++ {
+			conn.BroadcastTx(&packet.Operations[index%len(packet.Operations)])
+		}
+		if packets := transport.getPackets(t); len(packets) != 1 {
+			t.Fatalf("%d", len(packets))
+		}
+		transport.reset()
+		transport.written = make(chan struct{}, 1)
+
+		clock.advance(defaults.OperationsBatchWindow / 2)
+		conn.BroadcastTx(&packet.Operations[0])
+		clock.advance(defaults.OperationsBatchWindow / 2)
+		conn.flushExpiredOperations(stale)
+		if packets := transport.getPackets(t); len(packets) != 0 {
+			t.Fatalf("%d", len(packets))
+		}
+
+		clock.advance(defaults.OperationsBatchWindow / 2)
+		<-transport.written
+
+		transport.lock.Lock()
+		defer transport.lock.Unlock()
+		if len(transport.writes) != 1 {
+			t.Fatalf("%d", len(transport.writes))
+		}
+		var sent packetNewOperations
+		if err := utils.Deserialize(&sent, bytes.NewBuffer(transport.writes[0][binary.Size(packetHeader{}):])); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent.Operations) != 1 {
+			t.Fatalf("%d", len(sent.Operations))
+		}
+	})
+}
+
+func getTestHello() []byte {
+	peers := []PeerInfo{
+		{Host: "127.0.0.1", Port: 4004, LastConnect: 1},
+		{Host: "127.0.0.2", Port: 4004, LastConnect: 2},
+	}
+	header := safebox.SerializedBlockHeader{
+		HeaderOnly:      3,
+		Miner:           make([]byte, 70),
+		Payload:         []byte("payload"),
+		PrevSafeboxHash: make([]byte, 32),
+		OperationsHash:  make([]byte, 32),
+		Pow:             make([]byte, 32),
+	}
+	return generateHello(time.Now(), 4004, []byte("nonce"), header, peers, defaults.UserAgent, supportedCapabilities)
+}
+
+func BenchmarkSerializeHello(b *testing.B) {
+	data := getTestHello()
+	var packet packetHello
+	utils.Deserialize(&packet, bytes.NewBuffer(data))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.Serialize(&packet)
+	}
+}
+
+func BenchmarkDeserializeHello(b *testing.B) {
+	data := getTestHello()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var packet packetHello
+		utils.Deserialize(&packet, bytes.NewReader(data))
+	}
+}
+
+func BenchmarkSerializeNewOperations(b *testing.B) {
+	payload, _ := hex.DecodeString(testNewOperationsPayload)
+	var packet packetNewOperations
+	utils.Deserialize(&packet, bytes.NewBuffer(payload))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.Serialize(&packet)
+	}
+}
+
+func BenchmarkDeserializeNewOperations(b *testing.B) {
+	payload, _ := hex.DecodeString(testNewOperationsPayload)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var packet packetNewOperations
+		utils.Deserialize(&packet, bytes.NewReader(payload))
+	}
+}
+
+func TestCapabilitiesNegotiation(t *testing.T) {
+	if negotiated := negotiateCapabilities(capabilityCompression|capabilityHeadersFirst, capabilityHeadersFirst|capabilityMessages); negotiated != capabilityHeadersFirst {
+		t.Fatalf("%x", negotiated)
+	}
+
+	for _, remote := range []capabilities{0, capabilityCompression | capabilityMessages} {
+		withTestManager(t, func(manager *manager) {
+			conn, _ := newTestConnection(t, manager)
+			go func() { <-manager.onStateUpdate }()
+
+			hello := generateHello(time.Now(), 0, []byte("remote"), *manager.blockchain.GetPendingHeader(), nil, defaults.UserAgent, remote)
+			if err := conn.onHelloCommon(newTestHelloRequest(), hello); err != nil {
+				t.Fatal(err)
+			}
+			if conn.hasCapability(capabilityCompression) || conn.hasCapability(capabilityHeadersFirst) {
+				t.FailNow()
+			}
+			if conn.hasCapability(capabilityMessages) != (remote&capabilityMessages != 0) {
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestNewOperationsBogusCount(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		if _, err := conn.onNewOperationsNotification(&requestResponse{result: &result{}}, []byte{0xff, 0xff, 0xff, 0xff, 1}); err == nil {
+			t.FailNow()
+		}
+	})
+}
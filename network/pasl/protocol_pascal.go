@@ -27,7 +27,9 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -54,12 +56,26 @@ const (
 	hello
 	errorReport
 	message
-	getBlocks     = 0x10
-	getHeaders    = 0x5
-	newBlock      = 0x11
-	newOperations = 0x20
+	getBlocks            = 0x10
+	getHeaders           = 0x5
+	newBlock             = 0x11
+	newOperations        = 0x20
+	getPendingOperations = 0x30
+	getBlocksList        = 0x110
 )
 
+var knownOperationIds = map[operationId]struct{}{
+	hello:                {},
+	errorReport:          {},
+	message:              {},
+	getBlocks:            {},
+	getHeaders:           {},
+	newBlock:             {},
+	newOperations:        {},
+	getPendingOperations: {},
+	getBlocksList:        {},
+}
+
 type errorId int16
 
 const (
@@ -71,6 +87,9 @@ const (
 	invalidNewAccount     = 0x0012
 )
 
+// Written to every packet header, peers with an older major version are rejected on hello
+var protocolVersion = common.Version{Major: 3, Minor: 4}
+
 type packetHeader struct {
 	NetworkId   uint32
 	TypeId      typeId
@@ -97,6 +116,7 @@ type requestResponse struct {
 	id        uint32
 	typeId    typeId
 	operation operationId
+	version   common.Version
 	expecting int
 	result    *result
 }
@@ -107,25 +127,23 @@ type responseHandler func(request *requestResponse, payload []byte) error
 type requestWithTimeout struct {
 	responseHandler
 	*concurrent.UnboundedExecutor
+	operation operationId
 }
 
-func NewRequest(handler responseHandler, onTimeout func(), timeoutRequest time.Duration) *requestWithTimeout {
+func NewRequest(operation operationId, handler responseHandler, onTimeout func(), clock utils.Clock, timeoutRequest time.Duration) *requestWithTimeout {
+	timeout := clock.After(timeoutRequest)
 	unboundedExecutor := concurrent.NewUnboundedExecutor()
 	unboundedExecutor.Go(func(ctx context.Context) {
-		timer := time.NewTimer(timeoutRequest)
 		select {
 		case <-ctx.Done():
-			if !timer.Stop() {
-				<-timer.C
-			}
 			return
-		case <-timer.C:
+		case <-timeout:
 			onTimeout()
 			return
 		}
 	})
 
-	return &requestWithTimeout{handler, unboundedExecutor}
+	return &requestWithTimeout{handler, unboundedExecutor, operation}
 }
 
 func (this *requestWithTimeout) Process(packet *requestResponse, payload []byte) error {
@@ -134,7 +152,9 @@ func (this *requestWithTimeout) Process(packet *requestResponse, payload []byte)
 }
 
 type protocol struct {
+	netId           uint32
 	transport       io.WriteCloser
+	clock           utils.Clock
 	timeoutRequest  time.Duration
 	requests        map[uint32]*requestWithTimeout
 	requestId       uint32
@@ -142,27 +162,37 @@ type protocol struct {
 	header          packetHeader
 	pendingPacket   *requestResponse
 	knownOperations map[operationId]requestHandler
+	handlersLock    sync.RWMutex
+	maxMessageSize  uint32
 }
 
-func NewProtocol(transport io.WriteCloser, timeoutRequest time.Duration) *protocol {
+func NewProtocol(netId uint32, transport io.WriteCloser, clock utils.Clock, timeoutRequest time.Duration) *protocol {
 	conn := &protocol{
+		netId:           netId,
 		transport:       transport,
+		clock:           clock,
 		timeoutRequest:  timeoutRequest,
 		buffer:          &bytes.Buffer{},
 		knownOperations: make(map[operationId]requestHandler),
 		requests:        make(map[uint32]*requestWithTimeout),
+		maxMessageSize:  defaults.MaxMessageSize,
 	}
 	return conn
 }
 
 func (this *protocol) Close() error {
-	for _, request := range this.requests {
-		request.Process(nil, nil)
-	}
+	this.failPendingRequests()
 
 	return this.transport.Close()
 }
 
+func (this *protocol) failPendingRequests() {
+	for id, request := range this.requests {
+		delete(this.requests, id)
+		request.Process(nil, nil)
+	}
+}
+
 func (this *protocol) OnData(data []byte) error {
 	err := binary.Write(this.buffer, binary.LittleEndian, data)
 	if err != nil {
@@ -171,10 +201,15 @@ func (this *protocol) OnData(data []byte) error {
 
 	for {
 		if this.pendingPacket == nil {
+			if err = checkNetworkId(this.netId, this.buffer.Bytes()); err != nil {
+				return err
+			}
 			if this.buffer.Len() < headerSize {
 				break
 			}
-			this.pendingPacket, err = this.parseHeader(this.buffer.Next(headerSize))
+			if this.pendingPacket, err = this.parseHeader(this.buffer.Next(headerSize)); err != nil {
+				return err
+			}
 		} else {
 			if this.buffer.Len() < this.pendingPacket.expecting {
 				break
@@ -190,6 +225,11 @@ func (this *protocol) OnData(data []byte) error {
 		}
 	}
 
+	// Complete frames are consumed above, what is left of a partial one may not exceed the largest possible frame
+	if limit := headerSize + int(this.maxMessageSize); this.buffer.Len() > limit {
+		return fmt.Errorf("Read buffer exceeds %d bytes limit", limit)
+	}
+
 	return nil
 }
 
@@ -210,50 +250,88 @@ func (this *protocol) onPacket(packet *requestResponse, payload []byte) (err err
 
 func (this *protocol) processPacket(packet *requestResponse, payload []byte) (out []byte, err error) {
 	if packet.typeId == response {
-		if request, ok := this.requests[packet.id]; ok {
-			delete(this.requests, packet.id)
-			return nil, request.Process(packet, payload)
+		request, ok := this.requests[packet.id]
+		if !ok {
+			return nil, fmt.Errorf("Unexpected response #%d", packet.id)
 		}
-		return nil, errors.New("Unexpected response")
+		if request.operation != packet.operation {
+			return nil, fmt.Errorf("Response #%d operation %d doesn't match request operation %d", packet.id, packet.operation, request.operation)
+		}
+		delete(this.requests, packet.id)
+		return nil, request.Process(packet, payload)
 	}
 
-	if handler, ok := this.knownOperations[packet.operation]; ok {
+	this.handlersLock.RLock()
+	handler, ok := this.knownOperations[packet.operation]
+	this.handlersLock.RUnlock()
+	if ok {
 		return handler(packet, payload)
 	}
 
+	if _, ok := knownOperationIds[packet.operation]; !ok {
+		this.sendErrorReport(fmt.Sprintf("Unknown operation %d", packet.operation))
+		packet.result.setError(invalidDataBufferInfo)
+		return nil, nil
+	}
+
 	packet.result.setError(success)
 	return nil, nil
 }
 
-func (this *protocol) sendRequest(operationId operationId, payload []byte, handler responseHandler) error {
-	newRequestId := atomic.AddUint32(&this.requestId, 1)
+func (this *protocol) registerHandler(operation operationId, handler requestHandler, override bool) error {
+	this.handlersLock.Lock()
+	defer this.handlersLock.Unlock()
 
-	var packetType typeId
-	if handler != nil {
-		packetType = typeId(request)
+	if _, ok := knownOperationIds[operation]; ok && !override {
+		return fmt.Errorf("Operation %d is reserved by the protocol", operation)
+	}
+	if handler == nil {
+		delete(this.knownOperations, operation)
 	} else {
-		packetType = typeId(notification)
+		this.knownOperations[operation] = handler
 	}
+	return nil
+}
 
-	packet, err := this.preparePacket(packetType, operationId, newRequestId, success, payload)
+func (this *protocol) sendRequest(operationId operationId, payload []byte, handler responseHandler) error {
+	if handler == nil {
+		return fmt.Errorf("Request %d has no response handler", operationId)
+	}
+
+	newRequestId := atomic.AddUint32(&this.requestId, 1)
+
+	packet, err := this.preparePacket(typeId(request), operationId, newRequestId, success, payload)
 	if err != nil {
 		return err
 	}
 
-	if handler != nil {
-		this.requests[newRequestId] = NewRequest(handler, func() {
-			delete(this.requests, newRequestId)
-			if err := handler(nil, nil); err != nil {
-				utils.Tracef("Disconnecting peer (%v)", err)
-				this.Close()
-			}
-		}, this.timeoutRequest)
+	this.requests[newRequestId] = NewRequest(operationId, handler, func() {
+		delete(this.requests, newRequestId)
+		if err := handler(nil, nil); err != nil {
+			utils.Tracef("Disconnecting peer (%v)", err)
+			this.Close()
+		}
+	}, this.clock, this.timeoutRequest)
+
+	_, err = this.transport.Write(packet)
+	return err
+}
+
+// Fire-and-forget, the peer doesn't respond and the request id isn't tracked
+func (this *protocol) sendNotification(operationId operationId, payload []byte) error {
+	packet, err := this.preparePacket(typeId(notification), operationId, atomic.AddUint32(&this.requestId, 1), success, payload)
+	if err != nil {
+		return err
 	}
 
 	_, err = this.transport.Write(packet)
 	return err
 }
 
+func (this *protocol) sendErrorReport(message string) {
+	this.sendNotification(errorReport, utils.Serialize(packetError{Message: utils.Text(message)}))
+}
+
 func (this *protocol) sendResponse(request *requestResponse, payload []byte) error {
 	packet, err := this.preparePacket(typeId(response), request.operation, request.id, request.result.getError(), payload)
 	if err != nil {
@@ -266,15 +344,12 @@ func (this *protocol) sendResponse(request *requestResponse, payload []byte) err
 func (this *protocol) preparePacket(typeId typeId, operationId operationId, requestId uint32, errorId errorId, payload []byte) (data []byte, err error) {
 	packet := &bytes.Buffer{}
 	err = binary.Write(packet, binary.LittleEndian, &packetHeader{
-		NetworkId: defaults.NetId,
-		TypeId:    typeId,
-		Operation: operationId,
-		Error:     errorId,
-		RequestId: requestId,
-		Version: common.Version{
-			Major: 3,
-			Minor: 4,
-		},
+		NetworkId:   this.netId,
+		TypeId:      typeId,
+		Operation:   operationId,
+		Error:       errorId,
+		RequestId:   requestId,
+		Version:     protocolVersion,
 		PayloadSize: uint32(len(payload)),
 	})
 	if err != nil {
@@ -293,22 +368,45 @@ func (this *protocol) preparePacket(typeId typeId, operationId operationId, requ
 	return packet.Bytes(), nil
 }
 
+func checkNetworkId(netId uint32, data []byte) error {
+	if len(data) < 4 {
+		return nil
+	}
+	if networkId := binary.LittleEndian.Uint32(data); networkId != netId {
+		return fmt.Errorf("Invalid network id %08X", networkId)
+	}
+	return nil
+}
+
 func (this *protocol) parseHeader(data []byte) (handleWith *requestResponse, err error) {
 	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &this.header)
 	if err != nil {
 		return
 	}
 
-	if this.header.NetworkId != defaults.NetId {
-		err = errors.New("Invalid network id")
+	switch this.header.TypeId {
+	case request, response, notification:
+	default:
+		this.sendErrorReport(fmt.Sprintf("Malformed command header, unknown type %d", this.header.TypeId))
+		err = fmt.Errorf("Unknown packet type %d", this.header.TypeId)
+		return
+	}
+
+	if this.header.PayloadSize > this.maxMessageSize {
+		err = fmt.Errorf("Message size %d exceeds %d bytes limit", this.header.PayloadSize, this.maxMessageSize)
 		return
 	}
 
-	return &requestResponse{
+	handleWith = &requestResponse{
 		id:        this.header.RequestId,
 		typeId:    this.header.TypeId,
 		operation: this.header.Operation,
+		version:   this.header.Version,
 		expecting: int(this.header.PayloadSize),
 		result:    &result{},
-	}, nil
+	}
+	if this.header.TypeId == response {
+		handleWith.result.setError(this.header.Error)
+	}
+	return handleWith, nil
 }
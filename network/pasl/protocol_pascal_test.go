@@ -0,0 +1,392 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func getTestHeader(t *testing.T, header packetHeader) []byte {
+	buffer := &bytes.Buffer{}
+	if err := binary.Write(buffer, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestOversizedMessage(t *testing.T) {
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+
+	data := getTestHeader(t, packetHeader{
+		NetworkId:   defaults.NetId,
+		TypeId:      notification,
+		Operation:   newBlock,
+		PayloadSize: defaults.MaxMessageSize + 1,
+	})
+	if err := protocol.OnData(data); err == nil {
+		t.FailNow()
+	}
+	if protocol.pendingPacket != nil {
+		t.FailNow()
+	}
+}
+
+func TestOversizedMessageDropsConnection(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		serverSide, clientSide := net.Pipe()
+		conn, err := manager.OpenConn(serverSide, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.initializedConnections[conn] = 0
+		served := make(chan error, 1)
+		go func() { served <- ServeConn(serverSide, conn) }()
+
+		data := getTestHeader(t, packetHeader{
+			NetworkId:   defaults.NetId,
+			TypeId:      notification,
+			Operation:   newBlock,
+			PayloadSize: defaults.MaxMessageSize + 1,
+		})
+		if _, err := clientSide.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		closed := <-manager.closed
+		manager.onConnectionClosed(closed)
+		if err := <-served; err == nil || closed != conn {
+			t.FailNow()
+		}
+		if _, ok := manager.initializedConnections[conn]; ok {
+			t.FailNow()
+		}
+		if _, err := clientSide.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+
+	data := getTestHeader(t, packetHeader{
+		NetworkId:   defaults.NetId,
+		TypeId:      notification,
+		Operation:   newBlock,
+		PayloadSize: defaults.MaxMessageSize,
+	})
+	if err := protocol.OnData(data); err != nil {
+		t.Fatal(err)
+	}
+	if protocol.pendingPacket == nil {
+		t.FailNow()
+	}
+}
+
+func TestNetworkId(t *testing.T) {
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+
+	data := getTestHeader(t, packetHeader{
+		NetworkId: defaults.NetId,
+		TypeId:    notification,
+		Operation: message,
+	})
+	if err := protocol.OnData(data[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.OnData(data[4:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidNetworkId(t *testing.T) {
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+
+	data := getTestHeader(t, packetHeader{
+		NetworkId: defaults.NetId + 1,
+		TypeId:    notification,
+		Operation: message,
+	})
+	if err := protocol.OnData(data[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.OnData(data[2:4]); err == nil {
+		t.FailNow()
+	}
+
+	protocol = NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+	if err := protocol.OnData([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestMalformedCommandHeader(t *testing.T) {
+	transport := &testTransport{}
+	protocol := NewProtocol(defaults.NetId, transport, utils.SystemClock{}, time.Minute)
+	dispatched := false
+	protocol.knownOperations[hello] = func(request *requestResponse, payload []byte) ([]byte, error) {
+		dispatched = true
+		return nil, nil
+	}
+
+	data := getTestHeader(t, packetHeader{
+		NetworkId: defaults.NetId,
+		TypeId:    4,
+		Operation: hello,
+	})
+	if err := protocol.OnData(data); err == nil {
+		t.FailNow()
+	}
+	if dispatched || protocol.pendingPacket != nil {
+		t.FailNow()
+	}
+	packets := transport.getPackets(t)
+	if len(packets) != 1 || packets[0].Operation != errorReport || packets[0].TypeId != notification {
+		t.FailNow()
+	}
+}
+
+func TestUnknownOperation(t *testing.T) {
+	transport := &testTransport{}
+	protocol := NewProtocol(defaults.NetId, transport, utils.SystemClock{}, time.Minute)
+
+	data := getTestHeader(t, packetHeader{
+		NetworkId:   defaults.NetId,
+		TypeId:      request,
+		Operation:   0x7F,
+		RequestId:   1,
+		PayloadSize: 1,
+	})
+	if err := protocol.OnData(append(data, 0)); err != nil {
+		t.Fatal(err)
+	}
+	packets := transport.getPackets(t)
+	if len(packets) != 2 || packets[0].Operation != errorReport {
+		t.FailNow()
+	}
+	if packets[1].TypeId != response || packets[1].RequestId != 1 || packets[1].Error != invalidDataBufferInfo {
+		t.FailNow()
+	}
+}
+
+func TestReadBufferLimit(t *testing.T) {
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+	protocol.maxMessageSize = 16
+
+	header := getTestHeader(t, packetHeader{
+		NetworkId:   defaults.NetId,
+		TypeId:      notification,
+		Operation:   message,
+		PayloadSize: 16,
+	})
+	if err := protocol.OnData(header); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 15; i++ {
+		if err := protocol.OnData([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if protocol.pendingPacket == nil {
+		t.FailNow()
+	}
+
+	// The pending frame completes with 1 byte, a whole frame following it in the same read is parsed too
+	if err := protocol.OnData(append(append([]byte{0}, header...), make([]byte, 16)...)); err != nil {
+		t.Fatal(err)
+	}
+	if protocol.pendingPacket != nil || protocol.buffer.Len() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, transport := newTestConnection(t, manager)
+		transport.reset()
+
+		handler := func(request *requestResponse, payload []byte) ([]byte, error) {
+			return nil, nil
+		}
+		if err := conn.RegisterHandler(hello, handler, false); err == nil {
+			t.FailNow()
+		}
+
+		var received []byte
+		err := conn.RegisterHandler(0x7F, func(request *requestResponse, payload []byte) ([]byte, error) {
+			received = payload
+			return []byte("pong"), nil
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := getTestHeader(t, packetHeader{
+			NetworkId:   defaults.NetId,
+			TypeId:      request,
+			Operation:   0x7F,
+			RequestId:   1,
+			PayloadSize: 4,
+		})
+		if err := conn.OnData(append(data, []byte("ping")...)); err != nil {
+			t.Fatal(err)
+		}
+		if string(received) != "ping" {
+			t.Fatalf("%s", received)
+		}
+		packets := transport.getPackets(t)
+		if len(packets) != 1 || packets[0].TypeId != response || packets[0].Operation != 0x7F || packets[0].Error != success {
+			t.FailNow()
+		}
+		if payload := transport.writes[0][headerSize:]; string(payload) != "pong" {
+			t.Fatalf("%s", payload)
+		}
+
+		if err := conn.RegisterHandler(hello, handler, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestConnectionLastError(t *testing.T) {
+	withTestManager(t, func(manager *manager) {
+		conn, _ := newTestConnection(t, manager)
+		if conn.LastError() != nil {
+			t.FailNow()
+		}
+
+		data := getTestHeader(t, packetHeader{
+			NetworkId:   defaults.NetId,
+			TypeId:      notification,
+			Operation:   newBlock,
+			PayloadSize: defaults.MaxMessageSize + 1,
+		})
+		if err := conn.OnData(data); err == nil {
+			t.FailNow()
+		}
+
+		closed := make(chan *PascalConnection)
+		go func() { closed <- <-manager.closed }()
+		manager.OnClose(conn)
+
+		err := (<-closed).LastError()
+		if err == nil || !strings.Contains(err.Error(), "Message size") {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSendNotification(t *testing.T) {
+	transport := &testTransport{}
+	protocol := NewProtocol(defaults.NetId, transport, utils.SystemClock{}, time.Minute)
+
+	if err := protocol.sendNotification(newBlock, []byte("block")); err != nil {
+		t.Fatal(err)
+	}
+	if len(protocol.requests) != 0 {
+		t.FailNow()
+	}
+	packets := transport.getPackets(t)
+	if len(packets) != 1 || packets[0].TypeId != notification || packets[0].Operation != newBlock {
+		t.FailNow()
+	}
+
+	if err := protocol.sendRequest(newBlock, nil, nil); err == nil {
+		t.FailNow()
+	}
+	if len(protocol.requests) != 0 || len(transport.getPackets(t)) != 1 {
+		t.FailNow()
+	}
+}
+
+func TestUnexpectedResponse(t *testing.T) {
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, utils.SystemClock{}, time.Minute)
+	defer protocol.Close()
+
+	responded := false
+	if err := protocol.sendRequest(getBlocks, nil, func(*requestResponse, []byte) error {
+		responded = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(protocol.requests) != 1 {
+		t.FailNow()
+	}
+
+	for _, header := range []packetHeader{
+		{NetworkId: defaults.NetId, TypeId: response, Operation: getBlocks, RequestId: protocol.requestId + 1},
+		{NetworkId: defaults.NetId, TypeId: response, Operation: getHeaders, RequestId: protocol.requestId},
+	} {
+		protocol.pendingPacket = nil
+		protocol.buffer.Reset()
+		if err := protocol.OnData(getTestHeader(t, header)); err == nil {
+			t.FailNow()
+		}
+	}
+	if responded || len(protocol.requests) != 1 {
+		t.FailNow()
+	}
+
+	if err := protocol.OnData(getTestHeader(t, packetHeader{NetworkId: defaults.NetId, TypeId: response, Operation: getBlocks, RequestId: protocol.requestId})); err != nil {
+		t.Fatal(err)
+	}
+	if !responded || len(protocol.requests) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	clock := &testClock{}
+	protocol := NewProtocol(defaults.NetId, &testTransport{}, clock, time.Minute)
+
+	timedOut := make(chan struct{})
+	err := protocol.sendRequest(hello, nil, func(request *requestResponse, payload []byte) error {
+		if request != nil {
+			t.Error("unexpected response")
+		}
+		close(timedOut)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(time.Minute - time.Second)
+	select {
+	case <-timedOut:
+		t.FailNow()
+	default:
+	}
+	clock.advance(time.Second)
+	<-timedOut
+}
@@ -0,0 +1,89 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
+)
+
+type seenCache struct {
+	limit int
+	order *list.List
+	items map[[32]byte]*list.Element
+	lock  sync.Mutex
+}
+
+func newSeenCache(limit int) *seenCache {
+	return &seenCache{
+		limit: limit,
+		order: list.New(),
+		items: make(map[[32]byte]*list.Element),
+	}
+}
+
+func (this *seenCache) Add(key [32]byte) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, exists := this.items[key]; exists {
+		return false
+	}
+
+	this.items[key] = this.order.PushBack(key)
+	for this.order.Len() > this.limit {
+		oldest := this.order.Front()
+		delete(this.items, oldest.Value.([32]byte))
+		this.order.Remove(oldest)
+	}
+
+	return true
+}
+
+func (this *seenCache) Contains(key [32]byte) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	_, exists := this.items[key]
+	return exists
+}
+
+func (this *seenCache) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.order.Len()
+}
+
+func getBlockKey(block *safebox.SerializedBlock) [32]byte {
+	return sha256.Sum256(utils.Serialize(&block.Header))
+}
+
+func getOperationKey(operation *tx.Tx) [32]byte {
+	return sha256.Sum256(tx.SerializeOperation(operation))
+}
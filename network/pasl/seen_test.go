@@ -0,0 +1,97 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+func TestSeenCache(t *testing.T) {
+	cache := newSeenCache(2)
+	if !cache.Add([32]byte{1}) || !cache.Add([32]byte{2}) {
+		t.FailNow()
+	}
+	if cache.Add([32]byte{1}) {
+		t.FailNow()
+	}
+
+	if !cache.Add([32]byte{3}) || cache.Len() != 2 {
+		t.FailNow()
+	}
+	if !cache.Add([32]byte{1}) {
+		t.FailNow()
+	}
+	if cache.Add([32]byte{3}) {
+		t.FailNow()
+	}
+	if !cache.Contains([32]byte{3}) || cache.Contains([32]byte{2}) {
+		t.FailNow()
+	}
+}
+
+func TestSeenCacheCollisions(t *testing.T) {
+	cache := newSeenCache(16)
+
+	// Keys sharing everything but the last byte must not collide
+	var a, b [32]byte
+	for i := range a {
+		a[i] = 0xAB
+		b[i] = 0xAB
+	}
+	b[31] = 0xAC
+	if !cache.Add(a) || !cache.Add(b) || cache.Len() != 2 {
+		t.FailNow()
+	}
+
+	_, packet := getTestNewOperations(t)
+	first := getOperationKey(&packet.Operations[0])
+	second := getOperationKey(&packet.Operations[1])
+	if first == second {
+		t.FailNow()
+	}
+	if !cache.Add(first) || !cache.Add(second) {
+		t.FailNow()
+	}
+	duplicate := packet.Operations[0]
+	if cache.Add(getOperationKey(&duplicate)) {
+		t.FailNow()
+	}
+}
+
+func BenchmarkSeenOperations(b *testing.B) {
+	cache := newSeenCache(defaults.NetworkSeenOperations)
+	keys := make([][32]byte, defaults.NetworkSeenOperations)
+	for i := range keys {
+		keys[i] = sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		cache.Add(keys[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Add(keys[i%len(keys)])
+	}
+}
@@ -0,0 +1,57 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Addresses other nodes reach us at, learned from loopback connections
+type selfAddresses struct {
+	addresses map[string]struct{}
+	lock      sync.RWMutex
+}
+
+func newSelfAddresses() *selfAddresses {
+	return &selfAddresses{
+		addresses: make(map[string]struct{}),
+	}
+}
+
+func (this *selfAddresses) Add(address string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.addresses[strings.TrimPrefix(address, "tcp://")] = struct{}{}
+}
+
+func (this *selfAddresses) Contains(peer PeerInfo) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	_, ok := this.addresses[net.JoinHostPort(peer.Host, strconv.Itoa(int(peer.Port)))]
+	return ok
+}
@@ -0,0 +1,75 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const serveBufferSize = 64 * 1024
+
+type connTransport struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+func newConnTransport(conn net.Conn) *connTransport {
+	return &connTransport{
+		conn: conn,
+	}
+}
+
+func (this *connTransport) Write(data []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.conn.Write(data)
+}
+
+func (this *connTransport) Close() error {
+	return this.conn.Close()
+}
+
+func ServeConn(conn net.Conn, pc *PascalConnection) error {
+	defer pc.OnClose()
+	defer conn.Close()
+
+	buffer := make([]byte, serveBufferSize)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			if dataErr := pc.OnData(buffer[:n]); dataErr != nil {
+				return dataErr
+			}
+		}
+		if err == io.EOF || err == io.ErrClosedPipe || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
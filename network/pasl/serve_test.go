@@ -0,0 +1,84 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/storage"
+)
+
+func TestServeConn(t *testing.T) {
+	withTestStorage(t, func(serverStorage *storage.Storage) {
+		server := newTestManager(t, serverStorage)
+		addTestBlocks(t, server, 2)
+
+		withTestStorage(t, func(clientStorage *storage.Storage) {
+			chain, err := blockchain.NewBlockchain(clientStorage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := newManager([]byte("client"), chain, make(chan PeerInfo, 100), ManagerOptions{TimeoutRequest: time.Minute})
+
+			serverSide, clientSide := net.Pipe()
+
+			serverConn, err := server.OpenConn(serverSide, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			served := make(chan error, 2)
+			go func() { served <- ServeConn(serverSide, serverConn) }()
+
+			clientConn, err := client.OpenConn(clientSide, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() { served <- ServeConn(clientSide, clientConn) }()
+
+			if conn := <-server.onStateUpdate; conn != serverConn {
+				t.FailNow()
+			}
+			if conn := <-client.onStateUpdate; conn != clientConn {
+				t.FailNow()
+			}
+
+			serverHeight, serverHash := server.blockchain.GetState()
+			if height, hash := clientConn.GetState(); height != serverHeight || !bytes.Equal(hash, serverHash) {
+				t.Fatalf("%d != %d", height, serverHeight)
+			}
+
+			clientSide.Close()
+			<-client.closed
+			<-server.closed
+			for i := 0; i < 2; i++ {
+				if err := <-served; err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	})
+}
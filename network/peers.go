@@ -0,0 +1,75 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"github.com/cevaris/ordered_map"
+)
+
+type peersQueue struct {
+	*ordered_map.OrderedMap
+	max int
+}
+
+func newPeersQueue(max int) *peersQueue {
+	return &peersQueue{
+		OrderedMap: ordered_map.NewOrderedMap(),
+		max:        max,
+	}
+}
+
+func (this *peersQueue) Add(peer *Peer) bool {
+	if _, exists := this.Get(peer.Address); exists {
+		this.Set(peer.Address, peer)
+		return true
+	}
+
+	if this.Len() >= this.max {
+		worst := this.getWorst()
+		if worst == nil || !worst.isWorseThan(peer) {
+			return false
+		}
+		this.Delete(worst.Address)
+	}
+
+	this.Set(peer.Address, peer)
+	return true
+}
+
+func (this *peersQueue) getWorst() (worst *Peer) {
+	iter := this.IterFunc()
+	for kv, ok := iter(); ok; kv, ok = iter() {
+		peer := kv.Value.(*Peer)
+		if worst == nil || peer.isWorseThan(worst) {
+			worst = peer
+		}
+	}
+	return
+}
+
+func (this *Peer) isWorseThan(other *Peer) bool {
+	if this.Errors != other.Errors {
+		return this.Errors > other.Errors
+	}
+	return this.LastConnectTimestamp < other.LastConnectTimestamp
+}
@@ -0,0 +1,67 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPeersQueueEviction(t *testing.T) {
+	queue := newPeersQueue(3)
+
+	good := &Peer{Address: NewAddressTcp("127.0.0.1", 4004), LastConnectTimestamp: 300}
+	stale := &Peer{Address: NewAddressTcp("127.0.0.2", 4004), LastConnectTimestamp: 100}
+	failing := &Peer{Address: NewAddressTcp("127.0.0.3", 4004), LastConnectTimestamp: 400, Errors: 2}
+	for _, peer := range []*Peer{good, stale, failing} {
+		if !queue.Add(peer) {
+			t.FailNow()
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		peer := &Peer{Address: NewAddressTcp(fmt.Sprintf("127.0.1.%d", i), 4004), LastConnectTimestamp: 200}
+		if !queue.Add(peer) {
+			t.Fatalf("%d", i)
+		}
+		if queue.Len() != 3 {
+			t.Fatalf("%d", queue.Len())
+		}
+	}
+	if _, ok := queue.Get(failing.Address); ok {
+		t.FailNow()
+	}
+	if _, ok := queue.Get(stale.Address); ok {
+		t.FailNow()
+	}
+	if _, ok := queue.Get(good.Address); !ok {
+		t.FailNow()
+	}
+
+	if queue.Add(&Peer{Address: NewAddressTcp("127.0.2.1", 4004), LastConnectTimestamp: 100}) {
+		t.FailNow()
+	}
+	if queue.Len() != 3 {
+		t.Fatalf("%d", queue.Len())
+	}
+}
@@ -23,19 +23,18 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package safebox
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"math/big"
 
 	"github.com/pasl-project/pasl/common"
-	"github.com/pasl-project/pasl/crypto"
 	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/utils"
 )
 
 type antiHopDiff struct {
 	Fork
+	blockTime uint32
 }
 
 func (this *antiHopDiff) CheckBlock(currentTarget common.TargetBase, block BlockBase) error {
@@ -43,11 +42,9 @@ func (this *antiHopDiff) CheckBlock(currentTarget common.TargetBase, block Block
 		return fmt.Errorf("Invalid block #%d target 0x%08x != 0x%08x expected", block.GetIndex(), block.GetTarget().GetCompact(), currentTarget.GetCompact())
 	}
 
-	hashingBlob, _, _ := this.GetBlockHashingBlob(block)
-	hash := sha256.Sum256(hashingBlob)
-	pow := sha256.Sum256(hash[:])
-	if !currentTarget.Check(pow[:]) {
-		return fmt.Errorf("POW check failed %s > %064s", hex.EncodeToString(pow[:]), currentTarget.Get().Text(16))
+	pow := block.GetPow()
+	if !currentTarget.Check(pow) {
+		return fmt.Errorf("POW check failed %s > %064s", hex.EncodeToString(pow), currentTarget.Get().Text(16))
 	}
 
 	return nil
@@ -64,7 +61,7 @@ func (this *antiHopDiff) GetNextTarget(currentTarget common.TargetBase, getLastT
 	multiplier1 := utils.MaxInt64(0, 4-(median/50))
 	multiplier1 = multiplier1 * multiplier1 * multiplier1
 
-	multiplier2 := utils.MaxInt64(-86400, utils.MinInt64(0, 300-int64(median)))
+	multiplier2 := utils.MaxInt64(-86400, utils.MinInt64(0, int64(this.blockTime)-int64(median)))
 
 	previous := big.NewInt(0)
 	targetHash := big.NewInt(0).Set(currentTarget.Get())
@@ -79,44 +76,5 @@ func (this *antiHopDiff) GetNextTarget(currentTarget common.TargetBase, getLastT
 }
 
 func (this *antiHopDiff) GetBlockHashingBlob(block BlockBase) (template []byte, reservedOffset int, reservedSize int) {
-	type part1 struct {
-		Index   uint32
-		Miner   crypto.PublicSerialized
-		Reward  uint64
-		Version common.Version
-		Target  uint32
-	}
-	type part2 struct {
-		PrevSafeboxHash utils.Serializable
-		OperationsHash  utils.Serializable
-		Fee             uint32
-		Timestamp       uint32
-		Nonce           uint32
-	}
-	toHash := utils.Serialize(part1{
-		Index:   block.GetIndex(),
-		Miner:   block.GetMiner().Serialized(),
-		Reward:  block.GetReward(),
-		Version: block.GetVersion(),
-		Target:  block.GetTarget().GetCompact(),
-	})
-
-	payload := block.GetPayload()
-	toHash = append(toHash, payload...)
-	reservedOffset = len(toHash)
-	reservedSize = len(payload)
-
-	toHash = append(toHash, utils.Serialize(part2{
-		PrevSafeboxHash: &utils.BytesWithoutLengthPrefix{
-			Bytes: block.GetPrevSafeBoxHash(),
-		},
-		OperationsHash: &utils.BytesWithoutLengthPrefix{
-			Bytes: block.GetOperationsHash(),
-		},
-		Fee:       uint32(block.GetFee()),
-		Timestamp: block.GetTimestamp(),
-		Nonce:     block.GetNonce(),
-	})...)
-
-	return toHash, reservedOffset, reservedSize
+	return getBlockHashingBlob(block)
 }
@@ -23,15 +23,27 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package safebox
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 
 	"github.com/pasl-project/pasl/accounter"
 	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/safebox/tx"
 	"github.com/pasl-project/pasl/utils"
 )
 
+const (
+	headerWithOperations uint8 = 2
+	headerOnly           uint8 = 3
+)
+
 type SerializedBlockHeader struct {
 	HeaderOnly      uint8
 	Version         common.Version
@@ -96,33 +108,84 @@ type Block struct {
 	Accounts       []accounter.Account
 }
 
-type blockHashBuffer struct {
-	Index     uint32
-	Accounts  []accounter.AccountHashBuffer
-	Timestamp uint32
+func getOperationDigest(operation *tx.Tx) (digest [32]byte) {
+	h := sha256.New()
+	operation.SerializeUnderlying(h)
+	copy(digest[:], h.Sum(nil))
+	return
+}
+
+func chainOperationsHash(hash [32]byte, digest [32]byte) [32]byte {
+	return sha256.Sum256(append(hash[:], digest[:]...))
 }
 
 func GetOperationsHash(operations []tx.Tx) [32]byte {
-	hash := sha256.Sum256([]byte(""))
-	for _, it := range operations {
-		h := sha256.New()
-		it.SerializeUnderlying(h)
-		hash = sha256.Sum256(h.Sum(hash[:]))
+	if len(operations) == 0 {
+		return EmptyOperationsHash
+	}
+
+	hash := EmptyOperationsHash
+	for index := range operations {
+		hash = chainOperationsHash(hash, getOperationDigest(&operations[index]))
 	}
 	return hash
 }
 
+func checkDuplicateOperations(operations []tx.Tx) error {
+	digests := make(map[[32]byte]struct{}, len(operations))
+	sources := make(map[[2]uint32]struct{}, len(operations))
+	for index := range operations {
+		digest := getOperationDigest(&operations[index])
+		if _, exists := digests[digest]; exists {
+			return fmt.Errorf("Duplicate operation #%d", index)
+		}
+		digests[digest] = struct{}{}
+
+		source, operationId, _ := operations[index].GetSourceInfo()
+		if _, exists := sources[[2]uint32{source, operationId}]; exists {
+			return fmt.Errorf("Operation #%d conflicts with another operation of account %d n_operation %d", index, source, operationId)
+		}
+		sources[[2]uint32{source, operationId}] = struct{}{}
+	}
+	return nil
+}
+
 func NewBlock(meta *BlockMetadata) (BlockBase, error) {
+	return NewBlockWithParams(defaults.MainnetParams(), meta)
+}
+
+func NewBlockWithParams(params *defaults.NetworkParams, meta *BlockMetadata) (BlockBase, error) {
+	return NewBlockWithOperationsHash(params, meta, GetOperationsHash(meta.Operations))
+}
+
+func NewSerializedBlock(meta *BlockMetadata) (SerializedBlock, error) {
+	block, err := NewBlock(meta)
+	if err != nil {
+		return SerializedBlock{}, err
+	}
+	return block.Serialize(), nil
+}
+
+func NewBlockWithOperationsHash(params *defaults.NetworkParams, meta *BlockMetadata, operationsHash [32]byte) (BlockBase, error) {
 	var fee uint64 = 0
+	var err error
 	operations := make([]tx.Tx, len(meta.Operations))
 
 	for index, it := range meta.Operations {
 		operations[index] = it
-		fee += operations[index].GetFee()
+		if err = operations[index].CheckActivation(meta.Index); err != nil {
+			return nil, err
+		}
+		if fee, err = utils.AddUint64(fee, operations[index].GetFee()); err != nil {
+			return nil, fmt.Errorf("Operations fee: %v", err)
+		}
+	}
+
+	if err = checkDuplicateOperations(operations); err != nil {
+		return nil, err
 	}
 
 	var miner *crypto.Public
-	var err error
 	if miner, err = crypto.NewPublic(meta.Miner); err != nil {
 		return nil, err
 	}
@@ -132,44 +195,65 @@ func NewBlock(meta *BlockMetadata) (BlockBase, error) {
 		Miner:          miner,
 		Target:         common.NewTarget(meta.Target),
 		Operations:     operations,
-		OperationsHash: GetOperationsHash(operations),
+		OperationsHash: operationsHash,
 		Fee:            fee,
-		Reward:         getReward(meta.Index),
-		Accounts:       make([]accounter.Account, 5),
+		Reward:         getNetworkReward(params, meta.Index),
+		Accounts:       make([]accounter.Account, defaults.AccountsPerBlock),
 	}
 	var i uint32
 	for i = 0; i < uint32(len(block.Accounts)); i++ {
 		block.Accounts[i] = accounter.Account{
-			Number:       i + block.GetIndex(),
+			Number:       block.GetIndex()*defaults.AccountsPerBlock + i,
 			PublicKey:    *block.GetMiner(),
 			Balance:      0,
 			UpdatedIndex: block.GetIndex(),
 			Operations:   0,
+			Timestamp:    block.GetTimestamp(),
 		}
 	}
+	if block.Accounts[0].Balance, err = utils.AddUint64(block.Reward, block.Fee); err != nil {
+		return nil, fmt.Errorf("Miner balance: %v", err)
+	}
 
+	if err = checkAccountsOrder(block.GetIndex(), block.GetAccountsSerialized()); err != nil {
+		return nil, err
+	}
 	block.Hash = block.GetHash()
 
 	return block, nil
 }
 
+func (block *Block) getSortedAccounts() []*accounter.Account {
+	accounts := make([]*accounter.Account, len(block.Accounts))
+	for i := range block.Accounts {
+		accounts[i] = &block.Accounts[i]
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return accounts[i].Number < accounts[j].Number
+	})
+	return accounts
+}
+
 func (block *Block) GetAccountsSerialized() []accounter.AccountHashBuffer {
-	var result []accounter.AccountHashBuffer = make([]accounter.AccountHashBuffer, len(block.Accounts))
+	accounts := block.getSortedAccounts()
+	var result []accounter.AccountHashBuffer = make([]accounter.AccountHashBuffer, len(accounts))
 	for i := 0; i < len(result); i++ {
-		result[i] = block.Accounts[i].GetHashBuffer()
+		result[i] = accounts[i].GetHashBuffer()
 	}
 	return result
 }
 
+func checkAccountsOrder(index uint32, accounts []accounter.AccountHashBuffer) error {
+	for i := range accounts {
+		if expected := index*defaults.AccountsPerBlock + uint32(i); accounts[i].Number != expected {
+			return fmt.Errorf("Block %d account #%d has number %d, %d expected", index, i, accounts[i].Number, expected)
+		}
+	}
+	return nil
+}
+
 func (block *Block) GetHash() []byte {
-	buf := utils.Serialize(blockHashBuffer{
-		Index:     block.GetIndex(),
-		Accounts:  block.GetAccountsSerialized(),
-		Timestamp: block.GetTimestamp(),
-	})
-	hash := sha256.New()
-	hash.Write(buf)
-	return hash.Sum(nil)
+	return accounter.NewPackWithAccounts(block.GetIndex(), block.getSortedAccounts()).GetHash()
 }
 
 func (block *Block) GetIndex() uint32 {
@@ -217,23 +301,22 @@ func (block *Block) GetOperationsHash() []byte {
 }
 
 func (block *Block) GetPow() []byte {
-	// TODO: fix
-	return []byte("")
+	hashingBlob, _, _ := getBlockHashingBlob(block)
+	hash := sha256.Sum256(hashingBlob)
+	pow := sha256.Sum256(hash[:])
+	return pow[:]
 }
 
 func (block *Block) SerializeHeader(willAppendOperations bool) SerializedBlockHeader {
-	var headerOnly uint8
+	var kind uint8
 	if willAppendOperations {
-		headerOnly = 2
+		kind = headerWithOperations
 	} else {
-		headerOnly = 3
+		kind = headerOnly
 	}
 	return SerializedBlockHeader{
-		HeaderOnly: headerOnly,
-		Version: common.Version{
-			Major: 1,
-			Minor: 1,
-		},
+		HeaderOnly:      kind,
+		Version:         block.GetVersion(),
 		Index:           block.GetIndex(),
 		Miner:           utils.Serialize(block.GetMiner()),
 		Reward:          block.GetReward(),
@@ -255,6 +338,259 @@ func (this *Block) Serialize() SerializedBlock {
 	}
 }
 
+func (this *SerializedBlock) VisitOperations(visitor tx.OperationVisitor) error {
+	for index := range this.Operations {
+		if err := this.Operations[index].Accept(visitor); err != nil {
+			return fmt.Errorf("Operation %d: %v", index, err)
+		}
+	}
+	return nil
+}
+
 func (this *Block) GetOperations() []tx.Tx {
 	return this.Operations
 }
+
+func (this *SerializedBlockHeader) Diff(other *SerializedBlockHeader) string {
+	switch {
+	case this.HeaderOnly != other.HeaderOnly:
+		return "HeaderOnly"
+	case this.Version != other.Version:
+		return "Version"
+	case this.Index != other.Index:
+		return "Index"
+	case !bytes.Equal(this.Miner, other.Miner):
+		return "Miner"
+	case this.Reward != other.Reward:
+		return "Reward"
+	case this.Fee != other.Fee:
+		return "Fee"
+	case this.Time != other.Time:
+		return "Time"
+	case this.Target != other.Target:
+		return "Target"
+	case this.Nonce != other.Nonce:
+		return "Nonce"
+	case !bytes.Equal(this.Payload, other.Payload):
+		return "Payload"
+	case !bytes.Equal(this.PrevSafeboxHash, other.PrevSafeboxHash):
+		return "PrevSafeboxHash"
+	case !bytes.Equal(this.OperationsHash, other.OperationsHash):
+		return "OperationsHash"
+	case !bytes.Equal(this.Pow, other.Pow):
+		return "Pow"
+	}
+	return ""
+}
+
+func (this *SerializedBlock) Diff(other *SerializedBlock) string {
+	if field := this.Header.Diff(&other.Header); field != "" {
+		return "Header." + field
+	}
+	if len(this.Operations) != len(other.Operations) {
+		return "Operations"
+	}
+	for index := range this.Operations {
+		if !bytes.Equal(utils.Serialize(&this.Operations[index]), utils.Serialize(&other.Operations[index])) {
+			return fmt.Sprintf("Operations[%d]", index)
+		}
+	}
+	return ""
+}
+
+func BlocksEqual(a, b *SerializedBlock) bool {
+	return a.Diff(b) == ""
+}
+
+type ValidationIssue struct {
+	Field  string
+	Reason string
+}
+
+type validationIssues struct {
+	issues   []ValidationIssue
+	failFast bool
+}
+
+// Returns true once validation should stop
+func (this *validationIssues) add(field string, format string, args ...interface{}) bool {
+	this.issues = append(this.issues, ValidationIssue{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	})
+	return this.failFast
+}
+
+func (this *SerializedBlockHeader) validate(issues *validationIssues) bool {
+	if len(this.PrevSafeboxHash) != sha256.Size && issues.add("PrevSafeboxHash", "length %d", len(this.PrevSafeboxHash)) {
+		return true
+	}
+	if len(this.OperationsHash) != sha256.Size && issues.add("OperationsHash", "length %d", len(this.OperationsHash)) {
+		return true
+	}
+	if len(this.Pow) != sha256.Size && issues.add("Pow", "length %d", len(this.Pow)) {
+		return true
+	}
+	return false
+}
+
+func (this *SerializedBlockHeader) Validate() error {
+	issues := &validationIssues{failFast: true}
+	if this.validate(issues); len(issues.issues) != 0 {
+		return fmt.Errorf("Invalid block #%d %s %s", this.Index, issues.issues[0].Field, issues.issues[0].Reason)
+	}
+	return nil
+}
+
+// Reports every stateless problem of the block instead of stopping at the first one
+func (this *SerializedBlock) ValidateAll(params *defaults.NetworkParams) []ValidationIssue {
+	issues := &validationIssues{}
+	this.Header.validate(issues)
+
+	withOperations, err := this.Header.hasOperations()
+	if err != nil {
+		issues.add("HeaderOnly", "value %d", this.Header.HeaderOnly)
+	}
+	if _, err := crypto.NewPublic(this.Header.Miner); err != nil {
+		issues.add("Miner", "%v", err)
+	}
+	if expected := getNetworkReward(params, this.Header.Index); this.Header.Reward != expected {
+		issues.add("Reward", "%d != %d expected", this.Header.Reward, expected)
+	}
+
+	for index := range this.Operations {
+		if err := this.Operations[index].CheckActivation(this.Header.Index); err != nil {
+			issues.add(fmt.Sprintf("Operations[%d]", index), "%v", err)
+		}
+	}
+	if err := checkDuplicateOperations(this.Operations); err != nil {
+		issues.add("Operations", "%v", err)
+	}
+	if withOperations && len(this.Header.OperationsHash) == sha256.Size {
+		if operationsHash := GetOperationsHash(this.Operations); !bytes.Equal(operationsHash[:], this.Header.OperationsHash) {
+			issues.add("OperationsHash", "%x != %x expected", this.Header.OperationsHash, operationsHash)
+		}
+	}
+
+	return issues.issues
+}
+
+func (this *SerializedBlockHeader) hasOperations() (bool, error) {
+	switch this.HeaderOnly {
+	case headerWithOperations:
+		return true, nil
+	case headerOnly:
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid block #%d HeaderOnly value %d", this.Index, this.HeaderOnly)
+}
+
+func (this *SerializedBlock) Serialize(w io.Writer) error {
+	withOperations, err := this.Header.hasOperations()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(utils.Serialize(&this.Header)); err != nil {
+		return err
+	}
+	if !withOperations {
+		return nil
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(this.Operations))); err != nil {
+		return err
+	}
+	for index := range this.Operations {
+		if err := this.Operations[index].Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *SerializedBlock) Deserialize(r io.Reader) error {
+	operations := make([]tx.Tx, 0)
+	header, err := DeserializeBlockStream(r, func(index uint32, operation *tx.Tx) error {
+		operations = append(operations, *operation)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	this.Header = header
+	this.Operations = operations
+	return nil
+}
+
+func DeserializeBlockStream(r io.Reader, onOperation func(index uint32, operation *tx.Tx) error) (header SerializedBlockHeader, err error) {
+	if err = utils.Deserialize(&header, r); err != nil {
+		return
+	}
+
+	withOperations, err := header.hasOperations()
+	if err != nil || !withOperations {
+		return
+	}
+
+	var count uint32
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil {
+		err = errors.New("Block operations expected: " + err.Error())
+		return
+	}
+
+	var index uint32
+	for index = 0; index < count; index++ {
+		var operation tx.Tx
+		if err = operation.Deserialize(r); err != nil {
+			return
+		}
+		if err = onOperation(index, &operation); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Same for every fork, the payload is the part reserved for miners
+func getBlockHashingBlob(block BlockBase) (template []byte, reservedOffset int, reservedSize int) {
+	type part1 struct {
+		Index   uint32
+		Miner   crypto.PublicSerialized
+		Reward  uint64
+		Version common.Version
+		Target  uint32
+	}
+	type part2 struct {
+		PrevSafeboxHash utils.Serializable
+		OperationsHash  utils.Serializable
+		Fee             uint32
+		Timestamp       uint32
+		Nonce           uint32
+	}
+	toHash := utils.Serialize(part1{
+		Index:   block.GetIndex(),
+		Miner:   block.GetMiner().Serialized(),
+		Reward:  block.GetReward(),
+		Version: block.GetVersion(),
+		Target:  block.GetTarget().GetCompact(),
+	})
+
+	payload := block.GetPayload()
+	toHash = append(toHash, payload...)
+	reservedOffset = len(toHash)
+	reservedSize = len(payload)
+
+	toHash = append(toHash, utils.Serialize(part2{
+		PrevSafeboxHash: &utils.BytesWithoutLengthPrefix{
+			Bytes: block.GetPrevSafeBoxHash(),
+		},
+		OperationsHash: &utils.BytesWithoutLengthPrefix{
+			Bytes: block.GetOperationsHash(),
+		},
+		Fee:       uint32(block.GetFee()),
+		Timestamp: block.GetTimestamp(),
+		Nonce:     block.GetNonce(),
+	})...)
+
+	return toHash, reservedOffset, reservedSize
+}
@@ -24,9 +24,16 @@ package safebox
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox/tx"
 	"github.com/pasl-project/pasl/utils"
 )
 
@@ -58,3 +65,491 @@ func TestMetaSerialize(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+const testBlocksStream = "0201000100628801004600ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120a107000000000000000000000000005147735a1ef2d130005b5f1522007061736c2e66616972706f6f6c2e78797a5f4330334445393841376330303030303020002063b4544af77cf1a3cbf6eaae844772a808a12c2ca9e8965c861d3751bf161b2000c611fbcc6e11f1e859d4c81387b445a2e3414962f4f84c08229dbe0d90d6505f20000000000000007e4b5e7947620478fcb1d498a0084eaaf7d44019200266b1476b0a00000001000000a19d070003000000a8cb030024e301000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200057e773c096748cbefb32c7c1c7ad04130fa31e68706f3cc023f73dc80b9c19772000056eb2578bb8fd414b1abfaf3e67459ebbcc69aa8145890f5701819036b9d70601000000a19d0700040000003a2707005ddf01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200022eeb6bf1a2ac3f96fabe8b4845717e6d4a117c044054b6334b51304ec64cbad20003eb64ba88a0988410286a50278f9825ef529c027a005cda4f069c77b77eb701102000000f0a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000e45e5d7757ba87c468df08b41e8e21dda16538ac345f16ff64062efb66c66a722000c0e4b0a478123efc18bd712ffe91626a8f355a891e41603b6aacf25fa77855e82000cf0ea05f90796eee9c3dc5fab97039e91b7c3398c9c16a3cd79dc9cec06a149f2000a64ec12db4f635b1e2d329f09840d75038d20ab9dc8fa6ec82d33c1fcea096cf01000000a19d070005000000f0a70700b46701000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669012000300a46854b5754c6682ec06d8b3f9be366c746e2720f41086ab8d23bfa045de320002ce4cb9a34a552c72530fe66149e4477265148399650c366dff2fead8cdc189902000000efa707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000e45e5d7757ba87c468df08b41e8e21dda16538ac345f16ff64062efb66c66a722000c0e4b0a478123efc18bd712ffe91626a8f355a891e41603b6aacf25fa77855e820002505500ec6e753ef6ad99b28973d31f853224863d5028316e06ce81f19ea4eef20009ff2cb84e69354665f85d163edadf6b705291a7c32b8cd67491be3f8e347402001000000a69d070001000000efa70700d07600000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669012000a948bf4ff5bd719e5045af99cae6c77da93134a7bd28168d7ed92a04ac05e24e20007af964a8aba773bbd45c18f5017e99c591a947f469900f38b20be733967ab55602000000f5a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca022000b81815199ea76766759735f829f99f20a45f5281def971cf507f3b0f8693a08020001789c4fa04ff63e8a10752baef743d8c414d475e9536e71f7a17156d7e7c50d520009820d47016256c07ac30b1d8ec83dcfa6df84916ac65768e1b801388890c606a2000b9a31669bbec3647a6795c6f72e4fe0d44ab0e769f31b1417c1e467f473e892d01000000a69d070002000000f5a7070084de01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120009317277092851c7f00c2527e5669a57038417dd4984660f37ed1512f09d92c292000ba3e8d9ed27361a46334762986dbf611eb5e42abbffcfb4b7f18852784833fd602000000f4a707000100000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e42669014600ca0220004827190c2e4d9970a4edca77e7485307a6171f5981760f4dd0f191b7d20f3d1920005ccbafb54acd3ff5d8482d41911e7db64847ac685d3ae1af62dd04ab3f9b105920003d66c9f7024b98492350541f5130f35a97167cd4e8c319459c969410e56cfaf02000ff75b968b330fb5eeb3bbcd349daa49910cde628d5813f6948472ae1069ee09a01000000a69d070003000000f4a7070084de01000000000000000000000000000000ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e4266901200045c9150792fcff16dc6430df2aee267d0919022a271f4601e6ba88a56387728c20006c7f8a8e60fc441d530cbea1b5210594fc6b34dbfd25f487509594421d53360c0201000100638801004600ca022000666293eb108763de780fd6ee5f2d8f92a9c69fc3e36b5a40a9e8d25523f619c7200097fc795b55d50a41dc8abd099adf96152a2f07a1c35480dd4512abc4e426690120a107000000000000000000000000005847735a02e2d130042d92c622007061736c2e66616972706f6f6c2e78797a5f463937303039373733353430303030302000262d4766f39d8bb6ef0fe3cd1381a01b4dfda22b3e6f4bb0406b16368c0603382000e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855200000000000000074097dbf6a8a6e6ba9aeff7e8239ba8dbe15c6b0d7aa11f8979900000000"
+
+func getTestBlocks(t *testing.T) (first SerializedBlock, second SerializedBlock) {
+	data, err := hex.DecodeString(testBlocksStream)
+	if err != nil {
+		t.FailNow()
+	}
+	reader := bytes.NewBuffer(data)
+	if err := utils.Deserialize(&first, reader); err != nil {
+		t.FailNow()
+	}
+	if err := utils.Deserialize(&second, reader); err != nil {
+		t.FailNow()
+	}
+	return
+}
+
+func TestBlocksEqual(t *testing.T) {
+	a, _ := getTestBlocks(t)
+	b, _ := getTestBlocks(t)
+
+	if !BlocksEqual(&a, &b) {
+		t.Fatalf("identical blocks differ at %s", a.Diff(&b))
+	}
+}
+
+func TestBlocksDiffOperation(t *testing.T) {
+	a, _ := getTestBlocks(t)
+	b, _ := getTestBlocks(t)
+	b.Operations[3] = b.Operations[4]
+
+	if BlocksEqual(&a, &b) {
+		t.FailNow()
+	}
+	if field := a.Diff(&b); field != "Operations[3]" {
+		t.Fatalf("%s != Operations[3]", field)
+	}
+
+	b.Operations = b.Operations[:len(b.Operations)-1]
+	if field := a.Diff(&b); field != "Operations" {
+		t.Fatalf("%s != Operations", field)
+	}
+}
+
+func TestBlocksDiffNonce(t *testing.T) {
+	a, _ := getTestBlocks(t)
+	b, _ := getTestBlocks(t)
+	b.Header.Nonce++
+
+	if BlocksEqual(&a, &b) {
+		t.FailNow()
+	}
+	if field := a.Diff(&b); field != "Header.Nonce" {
+		t.Fatalf("%s != Header.Nonce", field)
+	}
+}
+
+func TestDeserializeBlockStream(t *testing.T) {
+	block, _ := getTestBlocks(t)
+
+	operations := make([]tx.Tx, 0)
+	for i := 0; i < 100; i++ {
+		operations = append(operations, block.Operations...)
+	}
+	block.Operations = operations
+	serialized := utils.Serialize(&block)
+
+	var next uint32
+	header, err := DeserializeBlockStream(bytes.NewBuffer(serialized), func(index uint32, operation *tx.Tx) error {
+		if index != next {
+			t.Fatalf("%d != %d", index, next)
+		}
+		if !bytes.Equal(utils.Serialize(operation), utils.Serialize(&operations[index])) {
+			t.Fatalf("operation %d mismatch", index)
+		}
+		next++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(next) != len(operations) {
+		t.Fatalf("%d != %d", next, len(operations))
+	}
+	if field := header.Diff(&block.Header); field != "" {
+		t.Fatalf("header mismatch %s", field)
+	}
+}
+
+func TestDeserializeBlockStreamAbort(t *testing.T) {
+	block, _ := getTestBlocks(t)
+	serialized := utils.Serialize(&block)
+
+	var calls int
+	_, err := DeserializeBlockStream(bytes.NewBuffer(serialized), func(index uint32, operation *tx.Tx) error {
+		calls++
+		return errors.New("abort")
+	})
+	if err == nil || calls != 1 {
+		t.FailNow()
+	}
+}
+
+func TestHeaderOnlyWithOperations(t *testing.T) {
+	block, _ := getTestBlocks(t)
+	if block.Header.HeaderOnly != 2 {
+		t.FailNow()
+	}
+
+	var check SerializedBlock
+	if err := utils.Deserialize(&check, bytes.NewBuffer(utils.Serialize(&block))); err != nil {
+		t.Fatal(err)
+	}
+	if field := block.Diff(&check); field != "" {
+		t.Fatalf("mismatch %s", field)
+	}
+}
+
+func TestHeaderOnlyWithoutOperations(t *testing.T) {
+	block, _ := getTestBlocks(t)
+	block.Header.HeaderOnly = 3
+
+	serialized := utils.Serialize(&block)
+	if !bytes.Equal(serialized, utils.Serialize(&block.Header)) {
+		t.FailNow()
+	}
+
+	reader := bytes.NewBuffer(append(serialized, 0xFF))
+	var check SerializedBlock
+	if err := utils.Deserialize(&check, reader); err != nil {
+		t.Fatal(err)
+	}
+	if len(check.Operations) != 0 || reader.Len() != 1 {
+		t.FailNow()
+	}
+}
+
+func TestHeaderOnlyInvalid(t *testing.T) {
+	block, _ := getTestBlocks(t)
+	block.Header.HeaderOnly = 4
+
+	if err := block.Serialize(&bytes.Buffer{}); err == nil {
+		t.FailNow()
+	}
+
+	var check SerializedBlock
+	if err := check.Deserialize(bytes.NewBuffer(utils.Serialize(&block.Header))); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestHeaderOnlyMissingOperations(t *testing.T) {
+	block, _ := getTestBlocks(t)
+
+	var check SerializedBlock
+	if err := check.Deserialize(bytes.NewBuffer(utils.Serialize(&block.Header))); err == nil {
+		t.FailNow()
+	}
+}
+
+func getTestTransferWithFee(t *testing.T, source uint32, fee uint64) tx.Tx {
+	serialized := utils.Serialize(uint32(1))
+	serialized = append(serialized, utils.Serialize(&tx.Transfer{
+		Source:      source,
+		OperationId: 1,
+		Destination: 2,
+		Fee:         fee,
+		Payload:     []byte{},
+		PublicKey:   *crypto.NewKeyNil().Public,
+	})...)
+
+	var operation tx.Tx
+	if err := operation.Deserialize(bytes.NewBuffer(serialized)); err != nil {
+		t.Fatal(err)
+	}
+	return operation
+}
+
+func TestFeeOverflow(t *testing.T) {
+	meta := &BlockMetadata{
+		Miner: utils.Serialize(crypto.NewKeyNil().Public),
+		Operations: []tx.Tx{
+			getTestTransferWithFee(t, 1, 0xFFFFFFFFFFFFFFFF),
+			getTestTransferWithFee(t, 3, 2),
+		},
+	}
+	if _, err := NewBlock(meta); err == nil {
+		t.FailNow()
+	}
+
+	// The miner account receives the fee on top of the reward
+	meta.Operations[0] = getTestTransferWithFee(t, 1, 0xFFFFFFFFFFFFFFFD-getReward(0))
+	block, err := NewBlock(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.GetFee() != 0xFFFFFFFFFFFFFFFF-getReward(0) {
+		t.FailNow()
+	}
+
+	meta.Operations[0] = getTestTransferWithFee(t, 1, 0xFFFFFFFFFFFFFFFD)
+	if _, err := NewBlock(meta); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestHeaderValidate(t *testing.T) {
+	block, _ := getTestBlocks(t)
+	if err := block.Header.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	block.Header.OperationsHash = block.Header.OperationsHash[:31]
+	if err := block.Header.Validate(); err == nil {
+		t.FailNow()
+	}
+	block.Header.OperationsHash = append(block.Header.OperationsHash, 0, 0)
+	if err := block.Header.Validate(); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestBlockHash(t *testing.T) {
+	curve, err := crypto.CurveById(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner := crypto.Public{
+		TypeId: crypto.NIDsecp256k1,
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     curve.Params().Gx,
+			Y:     curve.Params().Gy,
+		},
+	}
+	block, err := NewBlock(&BlockMetadata{
+		Index:     2,
+		Miner:     utils.Serialize(&miner),
+		Timestamp: 1500000600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256 over little endian Index, then for each of the 5 accounts #10 .. #14 Number,
+	// raw miner key, Balance (reward for the first account), UpdatedIndex and Operations,
+	// followed by the Timestamp. There is no accounts count prefix.
+	expected := "e1770ba8bd4230ed1faf3929c9d900cd57053e84aced37bf8ccbf92c912c612f"
+	if hash := hex.EncodeToString(block.GetHash()); hash != expected {
+		t.Fatalf("%s != %s", hash, expected)
+	}
+}
+
+func getTestTx(t *testing.T, operation tx.Operation) tx.Tx {
+	deserialized, err := tx.DeserializeOperation(tx.SerializeOperation(operation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *deserialized.(*tx.Tx)
+}
+
+type testOperationVisitor struct {
+	visited []string
+}
+
+func (this *testOperationVisitor) VisitTransfer(operation *tx.Transfer) error {
+	this.visited = append(this.visited, fmt.Sprintf("transfer %d", operation.Source))
+	return nil
+}
+
+func (this *testOperationVisitor) VisitChangeKey(operation *tx.ChangeKey) error {
+	this.visited = append(this.visited, fmt.Sprintf("changekey %d", operation.Source))
+	return nil
+}
+
+func TestVisitOperations(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := SerializedBlock{
+		Operations: []tx.Tx{
+			getTestTx(t, &tx.Transfer{Source: 1, Destination: 2, Payload: []byte{}, PublicKey: *key.Public}),
+			getTestTx(t, &tx.ChangeKey{Source: 2, Payload: []byte{}, PublicKey: *key.Public, NewPublickey: utils.Serialize(key.Public)}),
+			getTestTx(t, &tx.Transfer{Source: 3, Destination: 4, Payload: []byte{}, PublicKey: *key.Public}),
+		},
+	}
+
+	visitor := &testOperationVisitor{}
+	if err := block.VisitOperations(visitor); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"transfer 1", "changekey 2", "transfer 3"}
+	if fmt.Sprint(visitor.visited) != fmt.Sprint(expected) {
+		t.Fatalf("%v", visitor.visited)
+	}
+}
+
+func TestDuplicateOperations(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := getTestTx(t, &tx.Transfer{Source: 1, OperationId: 1, Destination: 2, Amount: 1, Payload: []byte{}, PublicKey: *key.Public})
+	conflicting := getTestTx(t, &tx.Transfer{Source: 1, OperationId: 1, Destination: 3, Amount: 1, Payload: []byte{}, PublicKey: *key.Public})
+	next := getTestTx(t, &tx.Transfer{Source: 1, OperationId: 2, Destination: 3, Amount: 1, Payload: []byte{}, PublicKey: *key.Public})
+
+	newBlock := func(operations ...tx.Tx) error {
+		_, err := NewBlock(&BlockMetadata{
+			Miner:      utils.Serialize(key.Public),
+			Operations: operations,
+		})
+		return err
+	}
+
+	if err := newBlock(transfer, next); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBlock(transfer, next, transfer); err == nil {
+		t.FailNow()
+	}
+	if err := newBlock(transfer, conflicting); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestNewSerializedBlock(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &BlockMetadata{
+		Index:           3,
+		Miner:           utils.Serialize(key.Public),
+		Timestamp:       1500000900,
+		Target:          0x24000000,
+		Nonce:           7,
+		Payload:         []byte("payload"),
+		PrevSafeBoxHash: make([]byte, 32),
+		Operations: []tx.Tx{
+			getTestTx(t, &tx.Transfer{Source: 1, OperationId: 1, Destination: 2, Amount: 1, Fee: 1, Payload: []byte{}, PublicKey: *key.Public}),
+		},
+	}
+
+	serialized, err := NewSerializedBlock(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := NewBlock(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := block.Serialize()
+	if !bytes.Equal(utils.Serialize(&serialized), utils.Serialize(&expected)) {
+		t.FailNow()
+	}
+
+	meta.Miner = utils.Serialize(&crypto.PublicSerialized{TypeId: 1})
+	if _, err := NewSerializedBlock(meta); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestAccountsOrder(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := NewBlock(&BlockMetadata{Index: 7, Miner: utils.Serialize(key.Public), Timestamp: 1500002100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := base.(*Block)
+	expected := block.GetAccountsSerialized()
+	hash := block.GetHash()
+
+	shuffled := *block
+	shuffled.Accounts = append([]accounter.Account{}, block.Accounts...)
+	for i, j := range []int{3, 0, 4, 1, 2} {
+		shuffled.Accounts[i] = block.Accounts[j]
+	}
+
+	serialized := shuffled.GetAccountsSerialized()
+	if err := checkAccountsOrder(7, serialized); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(utils.Serialize(&serialized), utils.Serialize(&expected)) {
+		t.FailNow()
+	}
+	if !bytes.Equal(shuffled.GetHash(), hash) {
+		t.FailNow()
+	}
+
+	serialized[1], serialized[2] = serialized[2], serialized[1]
+	if checkAccountsOrder(7, serialized) == nil {
+		t.FailNow()
+	}
+	if checkAccountsOrder(6, expected) == nil {
+		t.FailNow()
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := getTestTx(t, &tx.Transfer{Source: 1, OperationId: 1, Destination: 2, Amount: 1, Payload: []byte{}, PublicKey: *key.Public})
+	block, err := NewSerializedBlock(&BlockMetadata{
+		Index:           3,
+		Miner:           utils.Serialize(key.Public),
+		Timestamp:       1500000900,
+		Target:          0x24000000,
+		PrevSafeBoxHash: make([]byte, 32),
+		Operations:      []tx.Tx{transfer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := defaults.MainnetParams()
+	if issues := block.ValidateAll(params); len(issues) != 0 {
+		t.Fatalf("%v", issues)
+	}
+
+	block.Header.PrevSafeboxHash = block.Header.PrevSafeboxHash[:31]
+	block.Header.Miner = utils.Serialize(&crypto.PublicSerialized{TypeId: 1})
+	block.Header.Reward++
+	block.Operations = append(block.Operations, transfer)
+
+	issues := block.ValidateAll(params)
+	fields := make([]string, len(issues))
+	for index := range issues {
+		fields[index] = issues[index].Field
+	}
+	expected := []string{"PrevSafeboxHash", "Miner", "Reward", "Operations", "OperationsHash"}
+	if fmt.Sprint(fields) != fmt.Sprint(expected) {
+		t.Fatalf("%v", issues)
+	}
+
+	// The consensus path still stops at the first problem
+	if err := block.Header.Validate(); err == nil || err.Error() != "Invalid block #3 PrevSafeboxHash length 31" {
+		t.Fatal(err)
+	}
+}
+
+func TestZeroOperationsBlock(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, operations := range [][]tx.Tx{nil, {}} {
+		meta := &BlockMetadata{
+			Index:           3,
+			Miner:           utils.Serialize(key.Public),
+			Timestamp:       1500000900,
+			Target:          0x24000000,
+			PrevSafeBoxHash: make([]byte, 32),
+			Operations:      operations,
+		}
+		block, err := NewBlock(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.GetFee() != 0 || !bytes.Equal(block.GetOperationsHash(), EmptyOperationsHash[:]) {
+			t.Fatalf("%d %x", block.GetFee(), block.GetOperationsHash())
+		}
+
+		serialized := block.Serialize()
+		var decoded SerializedBlock
+		if err := utils.DeserializeStrict(&decoded, bytes.NewBuffer(utils.Serialize(&serialized))); err != nil {
+			t.Fatal(err)
+		}
+		if !BlocksEqual(&serialized, &decoded) {
+			t.Fatalf("%s", serialized.Diff(&decoded))
+		}
+
+		meta.Operations = decoded.Operations
+		rebuilt, err := NewBlock(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rebuilt.GetPow(), decoded.Header.Pow) {
+			t.Fatalf("%x", rebuilt.GetPow())
+		}
+	}
+}
@@ -34,6 +34,10 @@ func (this *checkpoint) CheckBlock(currentTarget common.TargetBase, block BlockB
 	return nil
 }
 
+func (this *checkpoint) GetBlockHashingBlob(block BlockBase) (template []byte, reservedOffset int, reservedSize int) {
+	return getBlockHashingBlob(block)
+}
+
 func (this *checkpoint) GetNextTarget(currentTarget common.TargetBase, getLastTimestamps GetLastTimestamps) uint32 {
 	return currentTarget.GetCompact()
 }
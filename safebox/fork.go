@@ -24,6 +24,8 @@ package safebox
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
 
 	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/defaults"
@@ -46,7 +48,7 @@ type activatorSafebox struct {
 	prevSafeboxHash [32]byte
 }
 
-type ForkInitializer func() Fork
+type ForkInitializer func(params *defaults.NetworkParams) Fork
 
 type forkDetails struct {
 	activator   ForkActivator
@@ -58,7 +60,7 @@ var forks = map[uint32]forkDetails{
 		activator: &activatorSafebox{
 			prevSafeboxHash: defaults.GenesisSafeBox,
 		},
-		initializer: func() Fork {
+		initializer: func(*defaults.NetworkParams) Fork {
 			return &checkpoint{}
 		},
 	},
@@ -66,13 +68,13 @@ var forks = map[uint32]forkDetails{
 		activator: &activatorSafebox{
 			prevSafeboxHash: [32]byte{0x7A, 0x66, 0xCA, 0x0D, 0x45, 0x03, 0x8E, 0x97, 0xBA, 0xED, 0x24, 0x4B, 0x4B, 0xC5, 0x14, 0x9C, 0x1A, 0x77, 0xE8, 0x83, 0x19, 0x08, 0x20, 0x9F, 0x80, 0xCC, 0x9C, 0x09, 0x89, 0xCE, 0x3A, 0x80},
 		},
-		initializer: func() Fork {
-			return &antiHopDiff{}
+		initializer: func(params *defaults.NetworkParams) Fork {
+			return &antiHopDiff{blockTime: params.BlockTime}
 		},
 	},
 }
 
-func GetActiveFork(height uint32, prevSafeboxHash []byte) Fork {
+func GetActiveFork(params *defaults.NetworkParams, height uint32, prevSafeboxHash []byte) Fork {
 	var initializer ForkInitializer
 	var maxHeight uint32
 	for activationHeight, details := range forks {
@@ -83,13 +85,13 @@ func GetActiveFork(height uint32, prevSafeboxHash []byte) Fork {
 			break
 		}
 	}
-	return initializer()
+	return initializer(params)
 }
 
-func TryActivateFork(height uint32, prevSafeboxHash []byte) Fork {
+func TryActivateFork(params *defaults.NetworkParams, height uint32, prevSafeboxHash []byte) Fork {
 	if details, ok := forks[height]; ok {
 		if details.activator.Activate(prevSafeboxHash) {
-			return details.initializer()
+			return details.initializer(params)
 		}
 	}
 	return nil
@@ -98,3 +100,10 @@ func TryActivateFork(height uint32, prevSafeboxHash []byte) Fork {
 func (activator *activatorSafebox) Activate(prevSafeboxHash []byte) bool {
 	return bytes.Equal(prevSafeboxHash, activator.prevSafeboxHash[:])
 }
+
+func CheckCheckpoint(checkpoints map[uint32][32]byte, index uint32, prevSafeboxHash []byte) error {
+	if expected, ok := checkpoints[index]; ok && !bytes.Equal(prevSafeboxHash, expected[:]) {
+		return fmt.Errorf("Block #%d checkpoint mismatch, safeboxHash %s != %s expected", index, hex.EncodeToString(prevSafeboxHash), hex.EncodeToString(expected[:]))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package safebox
+
+import (
+	"testing"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+func TestCheckCheckpoint(t *testing.T) {
+	expected := defaults.Checkpoints[29000]
+	if err := CheckCheckpoint(defaults.Checkpoints, 29000, expected[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := expected
+	tampered[0] ^= 0xFF
+	if err := CheckCheckpoint(defaults.Checkpoints, 29000, tampered[:]); err == nil {
+		t.FailNow()
+	}
+
+	if err := CheckCheckpoint(defaults.Checkpoints, 29001, tampered[:]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package safebox
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pasl-project/pasl/safebox/tx"
+)
+
+var EmptyOperationsHash = sha256.Sum256([]byte(""))
+
+type OperationsHasher struct {
+	ids     []string
+	digests [][32]byte
+	hashes  [][32]byte
+	lock    sync.RWMutex
+}
+
+func NewOperationsHasher() *OperationsHasher {
+	return &OperationsHasher{
+		ids:     make([]string, 0),
+		digests: make([][32]byte, 0),
+		hashes:  make([][32]byte, 0),
+	}
+}
+
+func (this *OperationsHasher) getUnsafe(count int) [32]byte {
+	if count == 0 {
+		return EmptyOperationsHash
+	}
+	return this.hashes[count-1]
+}
+
+func (this *OperationsHasher) Add(id string, operation *tx.Tx) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	digest := getOperationDigest(operation)
+	this.ids = append(this.ids, id)
+	this.digests = append(this.digests, digest)
+	this.hashes = append(this.hashes, chainOperationsHash(this.getUnsafe(len(this.hashes)), digest))
+}
+
+func (this *OperationsHasher) Remove(id string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for index := range this.ids {
+		if this.ids[index] != id {
+			continue
+		}
+
+		this.ids = append(this.ids[:index], this.ids[index+1:]...)
+		this.digests = append(this.digests[:index], this.digests[index+1:]...)
+		this.hashes = this.hashes[:index]
+		for _, digest := range this.digests[index:] {
+			this.hashes = append(this.hashes, chainOperationsHash(this.getUnsafe(len(this.hashes)), digest))
+		}
+		return true
+	}
+
+	return false
+}
+
+func (this *OperationsHasher) Get() [32]byte {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.getUnsafe(len(this.hashes))
+}
+
+func (this *OperationsHasher) GetIds() []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	ids := make([]string, len(this.ids))
+	copy(ids, this.ids)
+	return ids
+}
@@ -0,0 +1,91 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package safebox
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pasl-project/pasl/safebox/tx"
+)
+
+func TestOperationsHasher(t *testing.T) {
+	block, _ := getTestBlocks(t)
+
+	hasher := NewOperationsHasher()
+	pending := make(map[string]tx.Tx)
+	check := func() {
+		operations := make([]tx.Tx, 0)
+		for _, id := range hasher.GetIds() {
+			operations = append(operations, pending[id])
+		}
+		if hasher.Get() != GetOperationsHash(operations) {
+			t.FailNow()
+		}
+	}
+
+	check()
+	for index := range block.Operations {
+		id := block.Operations[index].GetTxIdString()
+		hasher.Add(id, &block.Operations[index])
+		pending[id] = block.Operations[index]
+		check()
+	}
+
+	for _, index := range []int{4, 0, 9} {
+		id := block.Operations[index].GetTxIdString()
+		if !hasher.Remove(id) {
+			t.FailNow()
+		}
+		delete(pending, id)
+		check()
+	}
+	if hasher.Remove(block.Operations[0].GetTxIdString()) {
+		t.FailNow()
+	}
+
+	hasher.Add(block.Operations[0].GetTxIdString(), &block.Operations[0])
+	pending[block.Operations[0].GetTxIdString()] = block.Operations[0]
+	check()
+
+	for _, id := range hasher.GetIds() {
+		hasher.Remove(id)
+	}
+	if hasher.Get() != GetOperationsHash(nil) {
+		t.FailNow()
+	}
+}
+
+func TestEmptyOperationsHash(t *testing.T) {
+	expected, _ := hex.DecodeString("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	if !bytes.Equal(EmptyOperationsHash[:], expected) {
+		t.FailNow()
+	}
+	if GetOperationsHash(nil) != EmptyOperationsHash || GetOperationsHash([]tx.Tx{}) != EmptyOperationsHash {
+		t.FailNow()
+	}
+	if NewOperationsHasher().Get() != EmptyOperationsHash {
+		t.FailNow()
+	}
+}
@@ -23,6 +23,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package safebox
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/pasl-project/pasl/accounter"
@@ -35,14 +36,20 @@ import (
 type Safebox struct {
 	accounter *accounter.Accounter
 	fork      Fork
+	params    *defaults.NetworkParams
 	lock      sync.RWMutex
 }
 
 func NewSafebox(accounter *accounter.Accounter) *Safebox {
+	return NewSafeboxWithParams(accounter, defaults.MainnetParams())
+}
+
+func NewSafeboxWithParams(accounter *accounter.Accounter, params *defaults.NetworkParams) *Safebox {
 	height, SafeboxHash := accounter.GetState()
 	return &Safebox{
 		accounter: accounter,
-		fork:      GetActiveFork(height, SafeboxHash),
+		fork:      GetActiveFork(params, height, SafeboxHash),
+		params:    params,
 	}
 }
 
@@ -94,14 +101,19 @@ func (this *Safebox) ProcessOperations(miner *crypto.Public, timestamp uint32, o
 	newSafebox := &Safebox{
 		accounter: this.accounter.Copy(),
 		fork:      this.fork,
+		params:    this.params,
 	}
 
 	updatedAccounts := make([]*accounter.Account, 0)
 
 	newAccounts, newIndex := newSafebox.accounter.NewPack(miner, timestamp)
-	newAccounts[0].Balance = getReward(newIndex)
+	newAccounts[0].Balance = getNetworkReward(this.params, newIndex)
 	for _, it := range operations {
-		newAccounts[0].Balance += it.GetFee()
+		balance, err := utils.AddUint64(newAccounts[0].Balance, it.GetFee())
+		if err != nil {
+			return nil, nil, fmt.Errorf("Miner balance: %v", err)
+		}
+		newAccounts[0].Balance = balance
 	}
 	updatedAccounts = append(updatedAccounts, newAccounts...)
 
@@ -114,24 +126,71 @@ func (this *Safebox) ProcessOperations(miner *crypto.Public, timestamp uint32, o
 		return nil
 	}
 
-	for _, it := range operations {
+	for index := range operations {
+		it := &operations[index]
 		context, err := it.Validate(getMaturedAccountUnsafe)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, fmt.Errorf("Operation #%d %s: %v", index, it.GetTxIdString(), err)
 		}
 		historyPack, err := it.Apply(height, context)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, fmt.Errorf("Operation #%d %s: %v", index, it.GetTxIdString(), err)
 		}
-		for number := range historyPack {
+		for number, history := range historyPack {
+			if checkInvariants {
+				if err := accounter.CheckHistory(number, history); err != nil {
+					return nil, nil, fmt.Errorf("Operation #%d %s: %v", index, it.GetTxIdString(), err)
+				}
+			}
 			this.accounter.MarkAccountDirty(number)
 			updatedAccounts = append(updatedAccounts, this.accounter.GetAccount(number))
 		}
 	}
 
+	if checkInvariants {
+		if err := newSafebox.accounter.CheckAccounts(); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return newSafebox, updatedAccounts, nil
 }
 
+// Copies of the existing accounts, duplicates and unknown numbers are skipped
+func (this *Safebox) GetAccounts(numbers []uint32) []accounter.Account {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	height, _ := this.getStateUnsafe()
+	seen := make(map[uint32]struct{})
+	accounts := make([]accounter.Account, 0, len(numbers))
+	for _, number := range numbers {
+		if _, ok := seen[number]; ok || number/uint32(defaults.AccountsPerBlock) >= height {
+			continue
+		}
+		seen[number] = struct{}{}
+		accounts = append(accounts, *this.accounter.GetAccount(number))
+	}
+	return accounts
+}
+
+// Safebox as it was before the top block, previous holds the accounts state the block has modified
+func (this *Safebox) Revert(previous []accounter.Account) (*Safebox, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	reverted, err := this.accounter.Revert(previous)
+	if err != nil {
+		return nil, err
+	}
+	height, safeboxHash := reverted.GetState()
+	return &Safebox{
+		accounter: reverted,
+		fork:      GetActiveFork(this.params, height, safeboxHash),
+		params:    this.params,
+	}, nil
+}
+
 func (this *Safebox) GetLastTimestamps(count uint32) (timestamps []uint32) {
 	this.lock.RLock()
 	defer this.lock.RUnlock()
@@ -152,11 +211,53 @@ func (this *Safebox) GetLastTimestamps(count uint32) (timestamps []uint32) {
 	return timestamps
 }
 
+func (this *Safebox) CheckTotalBalance() error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	height, _ := this.getStateUnsafe()
+	expected := getTotalReward(this.params, height)
+	if total := this.accounter.TotalBalance(); total != expected {
+		return fmt.Errorf("Total balance %d != %d expected at height %d", total, expected, height)
+	}
+	return nil
+}
+
+func (this *Safebox) CheckAccounts() error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.accounter.CheckAccounts()
+}
+
+func getTotalReward(params *defaults.NetworkParams, height uint32) (total uint64) {
+	var index uint32
+	for index = 0; index < height; index++ {
+		total += getNetworkReward(params, index)
+	}
+	return total
+}
+
+func CheckReward(params *defaults.NetworkParams, index uint32, reward uint64) error {
+	if expected := getNetworkReward(params, index); reward != expected {
+		return fmt.Errorf("Invalid block %d reward %d != %d expected", index, reward, expected)
+	}
+	return nil
+}
+
 func getReward(index uint32) uint64 {
-	magnitude := uint64(index / defaults.RewardDecreaseBlocks)
-	reward := defaults.GenesisReward
+	return getNetworkReward(defaults.MainnetParams(), index)
+}
+
+func getNetworkReward(params *defaults.NetworkParams, index uint32) uint64 {
+	magnitude := uint64(index / params.RewardDecreaseBlocks)
+	reward := params.GenesisReward
 	if magnitude > 0 {
 		reward = reward / (magnitude * 2)
 	}
-	return utils.MaxUint64(reward, defaults.MinReward)
+	return utils.MaxUint64(reward, params.MinReward)
+}
+
+func (this *Safebox) GetParams() *defaults.NetworkParams {
+	return this.params
 }
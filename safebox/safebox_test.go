@@ -23,7 +23,19 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package safebox
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"math/big"
+	"strings"
 	"testing"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
 )
 
 func TestReward(t *testing.T) {
@@ -43,3 +55,165 @@ func TestReward(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestNetworkParams(t *testing.T) {
+	params := defaults.TestnetParams()
+	params.GenesisReward = 1000000
+	params.BlockTime = 60
+
+	block, err := NewBlockWithParams(params, &BlockMetadata{Miner: utils.Serialize(crypto.NewKeyNil().Public)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.GetReward() != 1000000 {
+		t.FailNow()
+	}
+
+	// Blocks found every 600 seconds lag behind the testnet block time further than the mainnet one
+	getLastTimestamps := func(maxCount uint32) []uint32 {
+		timestamps := make([]uint32, maxCount)
+		for index := range timestamps {
+			timestamps[index] = 1500000000 - uint32(index)*600
+		}
+		return timestamps
+	}
+	target := common.NewTarget(0x25000000)
+	testnet := GetActiveFork(params, 29000, nil).GetNextTarget(target, getLastTimestamps)
+	mainnet := GetActiveFork(defaults.MainnetParams(), 29000, nil).GetNextTarget(target, getLastTimestamps)
+	if testnet == mainnet {
+		t.FailNow()
+	}
+}
+
+func TestCheckReward(t *testing.T) {
+	params := defaults.MainnetParams()
+	for _, index := range []uint32{0, 1, 420479, 420480, 1000000000} {
+		reward := getNetworkReward(params, index)
+		if err := CheckReward(params, index, reward); err != nil {
+			t.Fatal(err)
+		}
+		for _, tampered := range []uint64{0, reward - 1, reward + 1, reward * 2} {
+			if CheckReward(params, index, tampered) == nil {
+				t.Fatalf("%d %d", index, tampered)
+			}
+		}
+	}
+}
+
+func TestCheckTotalBalance(t *testing.T) {
+	safebox := NewSafebox(accounter.NewAccounter())
+	if err := safebox.CheckTotalBalance(); err != nil {
+		t.Fatal(err)
+	}
+
+	miner := crypto.NewKeyNil().Public
+	for i := uint32(0); i < 5; i++ {
+		var err error
+		if safebox, _, err = safebox.ProcessOperations(miner, 1500000000+i, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := safebox.CheckTotalBalance(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if total := safebox.accounter.TotalBalance(); total != 5*getReward(0) {
+		t.Fatalf("%d != %d", total, 5*getReward(0))
+	}
+
+	safebox.accounter.GetAccount(0).Balance++
+	if err := safebox.CheckTotalBalance(); err == nil {
+		t.FailNow()
+	}
+}
+
+func getTestSignedTransfer(t *testing.T, key *crypto.Key, source, operationId, destination uint32, amount uint64) tx.Tx {
+	transfer := tx.Transfer{
+		Source:      source,
+		OperationId: operationId,
+		Destination: destination,
+		Amount:      amount,
+		Payload:     []byte{},
+		PublicKey:   *key.Public,
+	}
+	deserialize := func() (operation tx.Tx) {
+		serialized := append(utils.Serialize(uint32(1)), utils.Serialize(&transfer)...)
+		if err := operation.Deserialize(bytes.NewBuffer(serialized)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	operation := deserialize()
+	private := &ecdsa.PrivateKey{
+		PublicKey: key.Public.PublicKey,
+		D:         (&big.Int{}).SetBytes(key.Private),
+	}
+	toSign, err := tx.SignableBytes(&operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, private, toSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer.Signature = crypto.SignatureSerialized{
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+	return deserialize()
+}
+
+func getTestMaturedSafebox(t *testing.T, miner *crypto.Public) *Safebox {
+	safebox := NewSafebox(accounter.NewAccounter())
+	for i := uint32(0); i <= defaults.MaturationHeight+1; i++ {
+		var err error
+		if safebox, _, err = safebox.ProcessOperations(miner, 1500000000+i, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return safebox
+}
+
+func TestProcessOperationsErrorIndex(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	safebox := getTestMaturedSafebox(t, key.Public)
+
+	operations := []tx.Tx{
+		getTestSignedTransfer(t, key, 0, 1, 1, 1),
+		getTestSignedTransfer(t, key, 0, 2, 1, 1),
+		getTestSignedTransfer(t, key, 0, 3, 1, 1),
+		getTestSignedTransfer(t, key, 0, 5, 1, 1),
+		getTestSignedTransfer(t, key, 0, 4, 1, 1),
+	}
+	_, _, err = safebox.ProcessOperations(key.Public, 1600000000, operations)
+	if err == nil {
+		t.FailNow()
+	}
+	if !strings.HasPrefix(err.Error(), "Operation #3 "+operations[3].GetTxIdString()) || !strings.Contains(err.Error(), "Invalid operation index") {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckAccounts(t *testing.T) {
+	safebox := NewSafebox(accounter.NewAccounter())
+	miner := crypto.NewKeyNil().Public
+	for i := uint32(0); i < 3; i++ {
+		var err error
+		if safebox, _, err = safebox.ProcessOperations(miner, 1500000000+i, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := safebox.CheckAccounts(); err != nil {
+		t.Fatal(err)
+	}
+
+	safebox.accounter.GetAccount(7).UpdatedIndex = 3
+	err := safebox.CheckAccounts()
+	if err == nil || !strings.Contains(err.Error(), "Account 7 ") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+type PayloadType uint8
+
+const (
+	PayloadTypePublic PayloadType = iota
+	PayloadTypeEncrypted
+	PayloadTypePassword
+)
+
+const (
+	eciesHeaderSize    = 6
+	aesBlockSize       = 16
+	passwordSaltPrefix = "Salted__"
+	passwordSaltSize   = 8
+)
+
+func checkPayloadSize(payload []byte) error {
+	if len(payload) > defaults.MaxPayloadSize {
+		return fmt.Errorf("Payload size %d exceeds %d bytes limit", len(payload), defaults.MaxPayloadSize)
+	}
+	return nil
+}
+
+// The protocol doesn't carry the payload type, it is derived from the payload itself.
+// Public payloads are text, ECIES header lengths always contain non printable bytes
+func GetPayloadType(payload []byte) PayloadType {
+	if bytes.HasPrefix(payload, []byte(passwordSaltPrefix)) {
+		return PayloadTypePassword
+	}
+	if !utf8.Valid(payload) {
+		return PayloadTypeEncrypted
+	}
+	for _, r := range string(payload) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return PayloadTypeEncrypted
+		}
+	}
+	return PayloadTypePublic
+}
+
+func ValidatePayload(payloadType PayloadType, payload []byte) error {
+	if err := checkPayloadSize(payload); err != nil {
+		return err
+	}
+
+	switch payloadType {
+	case PayloadTypePublic:
+		return nil
+	case PayloadTypeEncrypted:
+		return validateEncryptedPayload(payload)
+	case PayloadTypePassword:
+		return validatePasswordPayload(payload)
+	}
+	return fmt.Errorf("Unknown payload type %d", payloadType)
+}
+
+// ECIES: key and mac lengths (uint8), original and body lengths (uint16), then key, mac and body
+func validateEncryptedPayload(payload []byte) error {
+	if len(payload) < eciesHeaderSize {
+		return errors.New("Encrypted payload is too short")
+	}
+	key := int(payload[0])
+	mac := int(payload[1])
+	original := int(binary.LittleEndian.Uint16(payload[2:]))
+	body := int(binary.LittleEndian.Uint16(payload[4:]))
+
+	if key == 0 || mac == 0 {
+		return errors.New("Encrypted payload has empty key or mac")
+	}
+	if body == 0 || body%aesBlockSize != 0 || body < original {
+		return fmt.Errorf("Encrypted payload has invalid body size %d for %d bytes message", body, original)
+	}
+	if expected := eciesHeaderSize + key + mac + body; len(payload) != expected {
+		return fmt.Errorf("Encrypted payload size %d != %d expected", len(payload), expected)
+	}
+	return nil
+}
+
+// OpenSSL compatible AES: "Salted__", 8 bytes salt, then the cipher text
+func validatePasswordPayload(payload []byte) error {
+	headerSize := len(passwordSaltPrefix) + passwordSaltSize
+	if len(payload) < headerSize+aesBlockSize || !bytes.HasPrefix(payload, []byte(passwordSaltPrefix)) {
+		return errors.New("Password protected payload has invalid header")
+	}
+	if (len(payload)-headerSize)%aesBlockSize != 0 {
+		return errors.New("Password protected payload has invalid cipher text size")
+	}
+	return nil
+}
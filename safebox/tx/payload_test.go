@@ -0,0 +1,136 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/defaults"
+)
+
+func getTestEncryptedPayload(key, mac, original, body int) []byte {
+	header := []byte{byte(key), byte(mac), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(header[2:], uint16(original))
+	binary.LittleEndian.PutUint16(header[4:], uint16(body))
+	return append(header, make([]byte, key+mac+body)...)
+}
+
+func TestValidatePayload(t *testing.T) {
+	password := append([]byte("Salted__"), make([]byte, 8+32)...)
+
+	valid := map[PayloadType][][]byte{
+		PayloadTypePublic:    {{}, []byte("hello"), make([]byte, defaults.MaxPayloadSize)},
+		PayloadTypeEncrypted: {getTestEncryptedPayload(33, 16, 5, 16), getTestEncryptedPayload(33, 16, 32, 32)},
+		PayloadTypePassword:  {password},
+	}
+	for payloadType, payloads := range valid {
+		for _, payload := range payloads {
+			if err := ValidatePayload(payloadType, payload); err != nil {
+				t.Fatalf("%d %x: %v", payloadType, payload, err)
+			}
+		}
+	}
+
+	malformedEncrypted := getTestEncryptedPayload(33, 16, 5, 16)
+	invalid := map[PayloadType][][]byte{
+		PayloadTypePublic: {make([]byte, defaults.MaxPayloadSize+1)},
+		PayloadTypeEncrypted: {
+			{},
+			[]byte("hello"),
+			malformedEncrypted[:len(malformedEncrypted)-1],
+			append(malformedEncrypted, 0),
+			getTestEncryptedPayload(0, 16, 5, 16),
+			getTestEncryptedPayload(33, 16, 5, 15),
+			getTestEncryptedPayload(33, 16, 17, 16),
+		},
+		PayloadTypePassword: {
+			[]byte("hello"),
+			password[:len(password)-1],
+			append([]byte("Salted_!"), password[8:]...),
+			password[:16],
+		},
+		PayloadType(3): {{}},
+	}
+	for payloadType, payloads := range invalid {
+		for _, payload := range payloads {
+			if ValidatePayload(payloadType, payload) == nil {
+				t.Fatalf("%d %x", payloadType, payload)
+			}
+		}
+	}
+}
+
+func TestGetPayloadType(t *testing.T) {
+	password := append([]byte("Salted__"), make([]byte, 8+32)...)
+
+	expected := map[PayloadType][][]byte{
+		PayloadTypePublic:    {{}, []byte("hello"), []byte("multi\nline\tpayload"), []byte("π")},
+		PayloadTypeEncrypted: {getTestEncryptedPayload(33, 16, 5, 16), {0xFF}, []byte("hello\x00")},
+		PayloadTypePassword:  {password, []byte("Salted__")},
+	}
+	for payloadType, payloads := range expected {
+		for _, payload := range payloads {
+			if GetPayloadType(payload) != payloadType {
+				t.Fatalf("%d %x", payloadType, payload)
+			}
+		}
+	}
+}
+
+func TestOperationPayloadType(t *testing.T) {
+	getAccount := func(number uint32) *accounter.Account { return nil }
+
+	malformed := getTestEncryptedPayload(33, 16, 5, 16)
+	malformed = malformed[:len(malformed)-1]
+	for _, payload := range [][]byte{malformed, []byte("Salted__")} {
+		if _, err := (&Transfer{Payload: payload}).Validate(getAccount); err == nil || !strings.Contains(err.Error(), "payload") {
+			t.Fatalf("%x: %v", payload, err)
+		}
+		if _, err := (&ChangeKey{Payload: payload}).Validate(getAccount); err == nil || !strings.Contains(err.Error(), "payload") {
+			t.Fatalf("%x: %v", payload, err)
+		}
+	}
+
+	for _, payload := range [][]byte{[]byte("hello"), getTestEncryptedPayload(33, 16, 5, 16)} {
+		if _, err := (&Transfer{Payload: payload}).Validate(getAccount); err == nil || strings.Contains(err.Error(), "payload") {
+			t.Fatalf("%x: %v", payload, err)
+		}
+		if _, err := (&ChangeKey{Payload: payload}).Validate(getAccount); err == nil || strings.Contains(err.Error(), "payload") {
+			t.Fatalf("%x: %v", payload, err)
+		}
+	}
+}
+
+func TestOperationPayloadSize(t *testing.T) {
+	transfer := Transfer{Payload: make([]byte, defaults.MaxPayloadSize+1)}
+	if _, err := transfer.Validate(func(number uint32) *accounter.Account { return nil }); err == nil || !strings.HasPrefix(err.Error(), "Payload") {
+		t.FailNow()
+	}
+	changeKey := ChangeKey{Payload: make([]byte, defaults.MaxPayloadSize+1)}
+	if _, err := changeKey.Validate(func(number uint32) *accounter.Account { return nil }); err == nil || !strings.HasPrefix(err.Error(), "Payload") {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,99 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+type signatureCache struct {
+	limit int
+	order *list.List
+	items map[[32]byte]*list.Element
+	lock  sync.Mutex
+}
+
+var verifySignature = checkSignature
+var verifiedSignatures = newSignatureCache(defaults.SignatureCacheSize)
+
+func newSignatureCache(limit int) *signatureCache {
+	return &signatureCache{
+		limit: limit,
+		order: list.New(),
+		items: make(map[[32]byte]*list.Element),
+	}
+}
+
+func (this *signatureCache) Has(key [32]byte) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	_, exists := this.items[key]
+	return exists
+}
+
+func (this *signatureCache) Add(key [32]byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, exists := this.items[key]; exists {
+		return
+	}
+
+	this.items[key] = this.order.PushBack(key)
+	for this.order.Len() > this.limit {
+		oldest := this.order.Front()
+		delete(this.items, oldest.Value.([32]byte))
+		this.order.Remove(oldest)
+	}
+}
+
+func getSignatureKey(public *crypto.Public, data []byte, signature *crypto.SignatureSerialized) (key [32]byte) {
+	hash := sha256.New()
+	hash.Write(utils.Serialize(public))
+	// Signed data may exceed the uint16 length prefix of SerializeBytes
+	for _, field := range [][]byte{data, signature.R, signature.S} {
+		hash.Write(utils.Serialize(uint32(len(field))))
+		hash.Write(field)
+	}
+	copy(key[:], hash.Sum(nil))
+	return
+}
+
+func checkSignatureCached(public *crypto.Public, data []byte, signature *crypto.SignatureSerialized) error {
+	key := getSignatureKey(public, data, signature)
+	if verifiedSignatures.Has(key) {
+		return nil
+	}
+	if err := verifySignature(public, data, signature); err != nil {
+		return err
+	}
+	verifiedSignatures.Add(key)
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestSignatureCache(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := &Transfer{
+		Source:      1,
+		OperationId: 1,
+		Destination: 2,
+		Amount:      1,
+		Payload:     []byte{},
+		PublicKey:   *key.Public,
+	}
+	private := &ecdsa.PrivateKey{
+		PublicKey: key.Public.PublicKey,
+		D:         (&big.Int{}).SetBytes(key.Private),
+	}
+	toSign, err := SignableBytes(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, private, toSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer.Signature = crypto.SignatureSerialized{
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+
+	calls := 0
+	defer func(verify func(*crypto.Public, []byte, *crypto.SignatureSerialized) error) {
+		verifySignature = verify
+	}(verifySignature)
+	verifySignature = func(public *crypto.Public, data []byte, signature *crypto.SignatureSerialized) error {
+		calls++
+		return checkSignature(public, data, signature)
+	}
+	verifiedSignatures = newSignatureCache(2)
+
+	getAccount := func(number uint32) *accounter.Account {
+		return &accounter.Account{
+			Number:    number,
+			PublicKey: *key.Public,
+			Balance:   10,
+		}
+	}
+
+	// Relayed first, then received again as a part of a block
+	relayed, err := DeserializeOperation(SerializeOperation(transfer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	included, err := DeserializeOperation(SerializeOperation(transfer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, operation := range []Operation{relayed, included} {
+		if _, err := operation.(*Tx).Validate(getAccount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("%d", calls)
+	}
+
+	transfer.Signature.S = utils.Serialize(uint32(1))
+	tampered, err := DeserializeOperation(SerializeOperation(transfer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tampered.(*Tx).Validate(getAccount); err == nil || calls != 2 {
+		t.Fatalf("%v %d", err, calls)
+	}
+}
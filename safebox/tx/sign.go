@@ -0,0 +1,65 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+// Payload is signed as is, without the length prefix
+type payloadToSign []byte
+
+func buildSignBuffer(fields ...interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	for _, field := range fields {
+		switch value := field.(type) {
+		case payloadToSign:
+			buffer.Write(value)
+		case []byte:
+			serialized, err := utils.SerializeBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("Signed field serialization failed: %v", err)
+			}
+			buffer.Write(serialized)
+		case *crypto.Public:
+			buffer.Write(utils.Serialize(value.SerializedPlain()))
+		default:
+			buffer.Write(utils.Serialize(value))
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+type Operation interface {
+	GetFee() uint64
+	SerializedSize() int
+	getBufferToSign() ([]byte, error)
+}
+
+func SignableBytes(operation Operation) ([]byte, error) {
+	return operation.getBufferToSign()
+}
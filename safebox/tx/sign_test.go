@@ -0,0 +1,169 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func getTestPublic(t *testing.T) crypto.Public {
+	curve, err := crypto.CurveById(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.Public{
+		TypeId: crypto.NIDsecp256k1,
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     curve.Params().Gx,
+			Y:     curve.Params().Gy,
+		},
+	}
+}
+
+func TestChangeKeyBufferToSign(t *testing.T) {
+	public := getTestPublic(t)
+	changeKey := ChangeKey{
+		Source:       1234,
+		OperationId:  5,
+		Fee:          10,
+		Payload:      []byte("payload"),
+		PublicKey:    public,
+		NewPublickey: utils.Serialize(&public),
+	}
+
+	expected := "d2040000050000000a000000000000007061796c6f6164ca0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b84600ca02200079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817982000483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"
+	toSign, err := changeKey.getBufferToSign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer := hex.EncodeToString(toSign); buffer != expected {
+		t.Fatalf("%s != %s", buffer, expected)
+	}
+}
+
+func TestTransferBufferToSign(t *testing.T) {
+	transfer := Transfer{
+		Source:      1234,
+		OperationId: 5,
+		Destination: 77,
+		Amount:      1000,
+		Fee:         10,
+		Payload:     []byte("payload"),
+		PublicKey:   getTestPublic(t),
+	}
+
+	expected := "d2040000050000004d000000e8030000000000000a000000000000007061796c6f6164ca0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"
+	toSign, err := transfer.getBufferToSign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer := hex.EncodeToString(toSign); buffer != expected {
+		t.Fatalf("%s != %s", buffer, expected)
+	}
+}
+
+func TestSignableBytes(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := getTestPublic(t)
+	operation := Tx{
+		Type: txTypeChangekey,
+		commonOperation: &ChangeKey{
+			Source:       1,
+			OperationId:  1,
+			Fee:          1,
+			Payload:      []byte("payload"),
+			PublicKey:    *key.Public,
+			NewPublickey: utils.Serialize(&public),
+		},
+	}
+
+	signable, err := SignableBytes(&operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changeKey, err := SignableBytes(operation.commonOperation.(*ChangeKey)); err != nil || !bytes.Equal(signable, changeKey) {
+		t.FailNow()
+	}
+
+	private := &ecdsa.PrivateKey{
+		PublicKey: key.Public.PublicKey,
+		D:         (&big.Int{}).SetBytes(key.Private),
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, private, signable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operation.commonOperation.(*ChangeKey).Signature = crypto.SignatureSerialized{
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+
+	source := &accounter.Account{
+		Number:    1,
+		PublicKey: *key.Public,
+		Balance:   10,
+	}
+	if _, err := operation.Validate(func(number uint32) *accounter.Account {
+		return source
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildSignBufferOversizedField(t *testing.T) {
+	if _, err := buildSignBuffer(uint32(1), make([]byte, 0x10000)); err == nil {
+		t.FailNow()
+	}
+
+	public := getTestPublic(t)
+	operation := Tx{
+		Type: txTypeChangekey,
+		commonOperation: &ChangeKey{
+			Source:       1,
+			PublicKey:    public,
+			NewPublickey: make([]byte, 0x10000),
+		},
+	}
+	if _, err := SignableBytes(&operation); err == nil {
+		t.FailNow()
+	}
+	if _, err := operation.Validate(func(number uint32) *accounter.Account {
+		return &accounter.Account{Number: 1, PublicKey: public}
+	}); err == nil || !strings.HasPrefix(err.Error(), "Signed field") {
+		t.Fatal(err)
+	}
+}
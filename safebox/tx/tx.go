@@ -23,12 +23,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package tx
 
 import (
-	"crypto/ecdsa"
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"unsafe"
 
 	"github.com/pasl-project/pasl/accounter"
 	"github.com/pasl-project/pasl/crypto"
@@ -47,14 +48,54 @@ const (
 
 type commonOperation interface {
 	GetFee() uint64
+	SerializedSize() int
 	Validate(getAccount func(number uint32) *accounter.Account) (context interface{}, err error)
 	Apply(index uint32, context interface{}) (map[uint32][]accounter.Micro, error)
 
 	Serialize(w io.Writer) error
 
-	getBufferToSign() []byte
+	getBufferToSign() ([]byte, error)
 	getSignature() *crypto.SignatureSerialized
 	getSourceInfo() (number uint32, operationId uint32, publicKey *crypto.Public)
+	getAffectedAccounts() []uint32
+	getType() txType
+	accept(visitor OperationVisitor) error
+}
+
+type OperationVisitor interface {
+	VisitTransfer(operation *Transfer) error
+	VisitChangeKey(operation *ChangeKey) error
+}
+
+var operationTypes = map[txType]func() commonOperation{
+	txTypeTransfer: func() commonOperation {
+		return &Transfer{}
+	},
+	txTypeChangekey: func() commonOperation {
+		return &ChangeKey{}
+	},
+}
+
+// Operations held by interface are written as Tx, uint32 type followed by the body
+func init() {
+	utils.RegisterInterface((*Operation)(nil), utils.InterfaceCodec{
+		Serialize: func(w io.Writer, value interface{}) error {
+			return toTx(value.(Operation)).Serialize(w)
+		},
+		Deserialize: func(r io.Reader) (interface{}, error) {
+			var operation Tx
+			if err := operation.Deserialize(r); err != nil {
+				return nil, err
+			}
+			return Operation(&operation), nil
+		},
+	})
+}
+
+// Lowest block index each operation type is accepted at
+var activationHeights = map[txType]uint32{
+	txTypeTransfer:  0,
+	txTypeChangekey: 0,
 }
 
 // TODO: rename to transaction
@@ -71,6 +112,34 @@ func (this *Tx) GetFee() uint64 {
 	return this.commonOperation.GetFee()
 }
 
+// Size of the Serialize output, the type is written as uint32
+func (this *Tx) SerializedSize() int {
+	return 4 + this.commonOperation.SerializedSize()
+}
+
+func (this *Tx) GetSourceInfo() (number uint32, operationId uint32, publicKey *crypto.Public) {
+	return this.commonOperation.getSourceInfo()
+}
+
+func (this *Tx) GetAffectedAccounts() []uint32 {
+	return this.commonOperation.getAffectedAccounts()
+}
+
+func (this *Tx) Accept(visitor OperationVisitor) error {
+	return this.commonOperation.accept(visitor)
+}
+
+func (this *Tx) CheckActivation(index uint32) error {
+	height, ok := activationHeights[this.Type]
+	if !ok {
+		return fmt.Errorf("Operation type %d is not activated", this.Type)
+	}
+	if index < height {
+		return fmt.Errorf("Operation type %d is not activated before block %d", this.Type, height)
+	}
+	return nil
+}
+
 func (this *Tx) Validate(getAccount func(number uint32) *accounter.Account) (context interface{}, err error) {
 	number, _, publicKey := this.commonOperation.getSourceInfo()
 
@@ -82,7 +151,11 @@ func (this *Tx) Validate(getAccount func(number uint32) *accounter.Account) (con
 		return nil, errors.New("Source account invalid public key")
 	}
 
-	if err := checkSignature(publicKey, this.commonOperation.getBufferToSign(), this.commonOperation.getSignature()); err != nil {
+	toSign, err := this.commonOperation.getBufferToSign()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignatureCached(publicKey, toSign, this.commonOperation.getSignature()); err != nil {
 		return nil, err
 	}
 
@@ -95,9 +168,13 @@ func (this *Tx) GetTxId() []byte {
 		R      utils.Serializable
 		S      utils.Serializable
 	}
+	toSign, err := this.commonOperation.getBufferToSign()
+	if err != nil {
+		return nil
+	}
 	buffer := utils.Serialize(toHash{
 		ToSign: &utils.BytesWithoutLengthPrefix{
-			Bytes: this.commonOperation.getBufferToSign(),
+			Bytes: toSign,
 		},
 		R: &utils.BytesWithoutLengthPrefix{
 			Bytes: this.getSignature().R,
@@ -135,11 +212,7 @@ func (this *Tx) GetTxIdString() string {
 }
 
 func checkSignature(public *crypto.Public, data []byte, signatureSerialized *crypto.SignatureSerialized) error {
-	signature := signatureSerialized.Decompress()
-	if !ecdsa.Verify(&public.PublicKey, data, signature.R, signature.S) {
-		return errors.New("Invalid signature")
-	}
-	return nil
+	return public.Verify(data, signatureSerialized.Decompress())
 }
 
 func (this *Tx) Serialize(w io.Writer) error {
@@ -154,24 +227,16 @@ func (this *Tx) SerializeUnderlying(w io.Writer) error {
 }
 
 func (this *Tx) deserializeUnderlying(r io.Reader) error {
-	switch this.Type {
-	case txTypeTransfer:
-		var tx Transfer
-		if err := utils.Deserialize(&tx, r); err != nil {
-			return err
-		}
-		this.commonOperation = &tx
-		return nil
-	case txTypeChangekey:
-		var changeKey ChangeKey
-		if err := utils.Deserialize(&changeKey, r); err != nil {
-			return err
-		}
-		this.commonOperation = &changeKey
-		return nil
-	default:
+	newOperation, ok := operationTypes[this.Type]
+	if !ok {
 		return errors.New("Unknown operation type")
 	}
+	operation := newOperation()
+	if err := utils.Deserialize(operation, r); err != nil {
+		return err
+	}
+	this.commonOperation = operation
+	return nil
 }
 
 func (this *Tx) Deserialize(r io.Reader) error {
@@ -186,11 +251,8 @@ func (this *OperationsNetwork) Serialize(w io.Writer) error {
 		return err
 	}
 
-	for _, each := range this.Operations {
-		if _, err := w.Write(utils.Serialize(uint8(each.Type))); err != nil {
-			return err
-		}
-		if err := each.SerializeUnderlying(w); err != nil {
+	for index := range this.Operations {
+		if err := this.Operations[index].serializeTagged(w); err != nil {
 			return err
 		}
 	}
@@ -203,20 +265,105 @@ func (this *OperationsNetwork) Deserialize(r io.Reader) error {
 	if err := utils.Deserialize(&count, r); err != nil {
 		return err
 	}
+	if err := utils.CheckSliceLength(count, unsafe.Sizeof(Tx{}), r); err != nil {
+		return err
+	}
 
 	this.Operations = make([]Tx, count)
 
 	var i uint32
 	for i = 0; i < count; i++ {
-		var transactionType uint8
-		if err := utils.Deserialize(&transactionType, r); err != nil {
-			return err
-		}
-		this.Operations[i].Type = txType(transactionType)
-		if err := this.Operations[i].deserializeUnderlying(r); err != nil {
+		if err := this.Operations[i].deserializeTagged(r); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+func (this *Tx) serializeTagged(w io.Writer) error {
+	if _, err := w.Write(utils.Serialize(uint8(this.Type))); err != nil {
+		return err
+	}
+	return this.SerializeUnderlying(w)
+}
+
+func (this *Tx) deserializeTagged(r io.Reader) error {
+	var transactionType uint8
+	if err := utils.Deserialize(&transactionType, r); err != nil {
+		return err
+	}
+	this.Type = txType(transactionType)
+	return this.deserializeUnderlying(r)
+}
+
+func toTx(operation Operation) *Tx {
+	if tx, ok := operation.(*Tx); ok {
+		return tx
+	}
+	underlying := operation.(commonOperation)
+	return &Tx{
+		Type:            underlying.getType(),
+		commonOperation: underlying,
+	}
+}
+
+func SerializeOperation(operation Operation) []byte {
+	buffer := &bytes.Buffer{}
+	if err := toTx(operation).serializeTagged(buffer); err != nil {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeOperation(data []byte) (Operation, error) {
+	buffer := bytes.NewBuffer(data)
+
+	var operation Tx
+	if err := operation.deserializeTagged(buffer); err != nil {
+		return nil, err
+	}
+	if buffer.Len() != 0 {
+		return nil, fmt.Errorf("Unexpected %d trailing bytes", buffer.Len())
+	}
+	return &operation, nil
+}
+
+// Raw operations batch as used by RPC: uint32 count, then uint32 type and body for each operation
+func SerializeOperations(operations []Operation) []byte {
+	buffer := &bytes.Buffer{}
+	if _, err := buffer.Write(utils.Serialize(uint32(len(operations)))); err != nil {
+		return nil
+	}
+	for _, operation := range operations {
+		if err := toTx(operation).Serialize(buffer); err != nil {
+			return nil
+		}
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeOperations(data []byte) ([]Operation, error) {
+	buffer := bytes.NewBuffer(data)
+
+	var count uint32
+	if err := utils.Deserialize(&count, buffer); err != nil {
+		return nil, err
+	}
+	if count > uint32(buffer.Len()) {
+		return nil, fmt.Errorf("Operations count %d exceeds data size", count)
+	}
+
+	operations := make([]Operation, count)
+	for index := range operations {
+		var operation Tx
+		if err := operation.Deserialize(buffer); err != nil {
+			return nil, fmt.Errorf("Operation #%d: %v", index, err)
+		}
+		operations[index] = &operation
+	}
+	if buffer.Len() != 0 {
+		return nil, fmt.Errorf("Unexpected %d trailing bytes", buffer.Len())
+	}
+	return operations, nil
+}
@@ -0,0 +1,279 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestSerializeOperation(t *testing.T) {
+	public := getTestPublic(t)
+	signature := crypto.SignatureSerialized{
+		R: []byte{1, 2, 3},
+		S: []byte{4, 5, 6},
+	}
+	operations := []Operation{
+		&ChangeKey{
+			Source:       1,
+			OperationId:  2,
+			Fee:          3,
+			Payload:      []byte("payload"),
+			PublicKey:    public,
+			NewPublickey: utils.Serialize(&public),
+			Signature:    signature,
+		},
+		&Transfer{
+			Source:      1,
+			OperationId: 2,
+			Destination: 3,
+			Amount:      4,
+			Fee:         5,
+			Payload:     []byte{},
+			PublicKey:   public,
+			Signature:   signature,
+		},
+	}
+
+	for _, operation := range operations {
+		serialized := SerializeOperation(operation)
+		if serialized[0] != uint8(operation.(commonOperation).getType()) {
+			t.Fatalf("%x", serialized)
+		}
+
+		decoded, err := DeserializeOperation(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.(*Tx).Type != operation.(commonOperation).getType() {
+			t.FailNow()
+		}
+		if !bytes.Equal(SerializeOperation(decoded), serialized) {
+			t.FailNow()
+		}
+		decodedToSign, err := SignableBytes(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if toSign, err := SignableBytes(operation); err != nil || !bytes.Equal(decodedToSign, toSign) {
+			t.FailNow()
+		}
+
+		if _, err := DeserializeOperation(append(serialized, 0)); err == nil {
+			t.FailNow()
+		}
+	}
+
+	if _, err := DeserializeOperation([]byte{0xFF}); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestCheckActivation(t *testing.T) {
+	operation := Tx{Type: txTypeChangekey}
+	if err := operation.CheckActivation(0); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(height uint32) { activationHeights[txTypeChangekey] = height }(activationHeights[txTypeChangekey])
+	activationHeights[txTypeChangekey] = 100
+
+	if err := operation.CheckActivation(99); err == nil {
+		t.FailNow()
+	}
+	if err := operation.CheckActivation(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Tx{Type: 0xFF}).CheckActivation(100); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestSerializeOperations(t *testing.T) {
+	public := getTestPublic(t)
+	operations := []Operation{
+		&Transfer{
+			Source:      1,
+			OperationId: 2,
+			Destination: 3,
+			Amount:      4,
+			Fee:         5,
+			Payload:     []byte{},
+			PublicKey:   public,
+		},
+		&ChangeKey{
+			Source:       1,
+			OperationId:  3,
+			Fee:          3,
+			Payload:      []byte("payload"),
+			PublicKey:    public,
+			NewPublickey: utils.Serialize(&public),
+		},
+	}
+
+	serialized := SerializeOperations(operations)
+	decoded, err := DeserializeOperations(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(operations) {
+		t.Fatalf("%d", len(decoded))
+	}
+	for index := range operations {
+		if !bytes.Equal(SerializeOperation(decoded[index]), SerializeOperation(operations[index])) {
+			t.Fatalf("%d", index)
+		}
+	}
+	if !bytes.Equal(SerializeOperations(decoded), serialized) {
+		t.FailNow()
+	}
+
+	if _, err := DeserializeOperations(append(serialized, 0)); err == nil {
+		t.FailNow()
+	}
+
+	empty := SerializeOperations(nil)
+	if !bytes.Equal(empty, []byte{0, 0, 0, 0}) {
+		t.Fatalf("%x", empty)
+	}
+	if decoded, err := DeserializeOperations(empty); err != nil || len(decoded) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestApplyBalanceUnderflow(t *testing.T) {
+	source := &accounter.Account{Number: 1, Balance: 10}
+	destination := &accounter.Account{Number: 2}
+	transfer := &Transfer{Source: 1, OperationId: 1, Destination: 2, Amount: 10, Fee: 1}
+
+	// Validation is bypassed, Apply must not wrap the source balance around
+	if _, err := transfer.Apply(5, &transferContext{source, destination}); err == nil {
+		t.FailNow()
+	}
+	if source.Balance != 10 || destination.Balance != 0 {
+		t.Fatalf("%d %d", source.Balance, destination.Balance)
+	}
+}
+
+func TestSerializeOperationsSlice(t *testing.T) {
+	public := getTestPublic(t)
+	transfer := &Transfer{
+		Source:      1,
+		OperationId: 2,
+		Destination: 3,
+		Amount:      4,
+		Fee:         5,
+		Payload:     []byte{},
+		PublicKey:   public,
+	}
+	changeKey := &ChangeKey{
+		Source:       1,
+		OperationId:  3,
+		Fee:          3,
+		Payload:      []byte("payload"),
+		PublicKey:    public,
+		NewPublickey: utils.Serialize(&public),
+	}
+
+	operations := []Operation{toTx(transfer), toTx(changeKey)}
+	serialized := utils.Serialize(&struct{ Operations []Operation }{operations})
+	if !bytes.Equal(serialized, SerializeOperations(operations)) {
+		t.Fatalf("%x", serialized)
+	}
+
+	var decoded struct{ Operations []*Tx }
+	if err := utils.DeserializeStrict(&decoded, bytes.NewBuffer(serialized)); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Operations) != 2 {
+		t.Fatalf("%d", len(decoded.Operations))
+	}
+	for index := range operations {
+		if !bytes.Equal(SerializeOperation(decoded.Operations[index]), SerializeOperation(operations[index])) {
+			t.Fatalf("%d", index)
+		}
+	}
+
+	changeKeys := utils.Serialize(&struct{ ChangeKeys []*ChangeKey }{[]*ChangeKey{changeKey}})
+	var decodedChangeKeys struct{ ChangeKeys []*ChangeKey }
+	if err := utils.DeserializeStrict(&decodedChangeKeys, bytes.NewBuffer(changeKeys)); err != nil {
+		t.Fatal(err)
+	}
+	if len(decodedChangeKeys.ChangeKeys) != 1 || !bytes.Equal(SerializeOperation(decodedChangeKeys.ChangeKeys[0]), SerializeOperation(changeKey)) {
+		t.FailNow()
+	}
+}
+
+func TestDeserializeOperationInterface(t *testing.T) {
+	public := getTestPublic(t)
+	type container struct {
+		Height    uint32
+		Operation Operation
+		Others    []Operation
+	}
+	original := container{
+		Height: 7,
+		Operation: &ChangeKey{
+			Source:       1,
+			OperationId:  3,
+			Fee:          3,
+			Payload:      []byte("payload"),
+			PublicKey:    public,
+			NewPublickey: utils.Serialize(&public),
+		},
+		Others: []Operation{
+			&Transfer{Source: 1, OperationId: 2, Destination: 3, Amount: 4, Fee: 5, Payload: []byte{}, PublicKey: public},
+		},
+	}
+
+	serialized := utils.Serialize(&original)
+	if len(serialized) != utils.SerializedSize(&original) {
+		t.FailNow()
+	}
+	var decoded container
+	if err := utils.DeserializeStrict(&decoded, bytes.NewBuffer(serialized)); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Height != 7 || len(decoded.Others) != 1 {
+		t.Fatalf("%v", decoded)
+	}
+	if decoded.Operation.(*Tx).Type != txTypeChangekey || decoded.Others[0].(*Tx).Type != txTypeTransfer {
+		t.FailNow()
+	}
+	if !bytes.Equal(SerializeOperation(decoded.Operation), SerializeOperation(original.Operation)) {
+		t.FailNow()
+	}
+	if !bytes.Equal(SerializeOperation(decoded.Others[0]), SerializeOperation(original.Others[0])) {
+		t.FailNow()
+	}
+
+	// Unknown operation types fail to decode instead of panicking
+	serialized[4] = 0xFF
+	if err := utils.Deserialize(&decoded, bytes.NewBuffer(serialized)); err == nil {
+		t.FailNow()
+	}
+}
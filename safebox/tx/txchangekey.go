@@ -47,20 +47,19 @@ type changeKeyContext struct {
 	NewPublic *crypto.Public
 }
 
-type changeKeyToSign struct {
-	Source    uint32
-	Operation uint32
-	Fee       uint64
-	Payload   utils.Serializable
-	Public    crypto.PublicSerializedPlain
-	NewPublic []byte
-}
-
 func (this *ChangeKey) GetFee() uint64 {
 	return this.Fee
 }
 
+func (this *ChangeKey) SerializedSize() int {
+	return utils.SerializedSize(this)
+}
+
 func (this *ChangeKey) Validate(getAccount func(number uint32) *accounter.Account) (context interface{}, err error) {
+	if err := ValidatePayload(GetPayloadType(this.Payload), this.Payload); err != nil {
+		return nil, err
+	}
+
 	source := getAccount(this.Source)
 	if source == nil {
 		return nil, fmt.Errorf("Source account %d not found", this.Source)
@@ -73,6 +72,9 @@ func (this *ChangeKey) Validate(getAccount func(number uint32) *accounter.Accoun
 	if err != nil {
 		return nil, err
 	}
+	if public.Equal(&source.PublicKey) {
+		return nil, errors.New("New public key is the same as the current one")
+	}
 
 	return &changeKeyContext{source, public}, nil
 }
@@ -82,7 +84,11 @@ func (this *ChangeKey) Apply(index uint32, context interface{}) (map[uint32][]ac
 
 	params := context.(*changeKeyContext)
 	result[params.Source.Number] = params.Source.KeyChange(params.NewPublic, index)
-	result[params.Source.Number] = append(result[params.Source.Number], params.Source.BalanceSub(this.Fee, index)...)
+	balance, err := params.Source.BalanceSub(this.Fee, index)
+	if err != nil {
+		return nil, err
+	}
+	result[params.Source.Number] = append(result[params.Source.Number], balance...)
 	return result, nil
 }
 
@@ -91,17 +97,15 @@ func (this *ChangeKey) Serialize(w io.Writer) error {
 	return err
 }
 
-func (this *ChangeKey) getBufferToSign() []byte {
-	return utils.Serialize(changeKeyToSign{
-		Source:    this.Source,
-		Operation: this.OperationId,
-		Fee:       this.Fee,
-		Payload: &utils.BytesWithoutLengthPrefix{
-			Bytes: this.Payload,
-		},
-		Public:    this.PublicKey.SerializedPlain(),
-		NewPublic: this.NewPublickey,
-	})
+func (this *ChangeKey) getBufferToSign() ([]byte, error) {
+	return buildSignBuffer(
+		this.Source,
+		this.OperationId,
+		this.Fee,
+		payloadToSign(this.Payload),
+		&this.PublicKey,
+		this.NewPublickey,
+	)
 }
 
 func (this *ChangeKey) getSignature() *crypto.SignatureSerialized {
@@ -111,3 +115,15 @@ func (this *ChangeKey) getSignature() *crypto.SignatureSerialized {
 func (this *ChangeKey) getSourceInfo() (number uint32, operationId uint32, publicKey *crypto.Public) {
 	return this.Source, this.OperationId, &this.PublicKey
 }
+
+func (this *ChangeKey) getAffectedAccounts() []uint32 {
+	return []uint32{this.Source}
+}
+
+func (this *ChangeKey) getType() txType {
+	return txTypeChangekey
+}
+
+func (this *ChangeKey) accept(visitor OperationVisitor) error {
+	return visitor.VisitChangeKey(this)
+}
@@ -0,0 +1,105 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestChangeKeyValidate(t *testing.T) {
+	key, err := crypto.NewKey(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getAccount := func(number uint32) *accounter.Account {
+		return &accounter.Account{
+			Number:    number,
+			PublicKey: *key.Public,
+			Balance:   10,
+		}
+	}
+
+	public := getTestPublic(t)
+	changeKey := ChangeKey{
+		Source:       1,
+		OperationId:  1,
+		Fee:          1,
+		PublicKey:    *key.Public,
+		NewPublickey: utils.Serialize(&public),
+	}
+	if _, err := changeKey.Validate(getAccount); err != nil {
+		t.Fatal(err)
+	}
+
+	changeKey.NewPublickey = utils.Serialize(key.Public)
+	if _, err := changeKey.Validate(getAccount); err == nil {
+		t.FailNow()
+	}
+
+	// Same key with zero padded coordinates
+	serialized := key.Public.Serialized()
+	serialized.X = append([]byte{0}, serialized.X...)
+	serialized.Y = append([]byte{0, 0}, serialized.Y...)
+	changeKey.NewPublickey = utils.Serialize(serialized)
+	if _, err := changeKey.Validate(getAccount); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestChangeKeySerializedSize(t *testing.T) {
+	public := getTestPublic(t)
+	changeKey := &ChangeKey{
+		Source:       1,
+		OperationId:  2,
+		Fee:          3,
+		Payload:      []byte("payload"),
+		PublicKey:    public,
+		NewPublickey: utils.Serialize(&public),
+		Signature: crypto.SignatureSerialized{
+			R: []byte{1, 2, 3},
+			S: []byte{4, 5, 6},
+		},
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := changeKey.Serialize(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if size := changeKey.SerializedSize(); size != buffer.Len() {
+		t.Fatalf("%d != %d", size, buffer.Len())
+	}
+
+	operation := toTx(changeKey)
+	buffer.Reset()
+	if err := operation.Serialize(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if size := operation.SerializedSize(); size != buffer.Len() {
+		t.Fatalf("%d != %d", size, buffer.Len())
+	}
+}
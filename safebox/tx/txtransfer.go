@@ -48,21 +48,19 @@ type transferContext struct {
 	Destination *accounter.Account
 }
 
-type transferToSign struct {
-	Source      uint32
-	Operation   uint32
-	Destination uint32
-	Amount      uint64
-	Fee         uint64
-	Payload     utils.Serializable
-	Public      crypto.PublicSerializedPlain
-}
-
 func (this *Transfer) GetFee() uint64 {
 	return this.Fee
 }
 
+func (this *Transfer) SerializedSize() int {
+	return utils.SerializedSize(this)
+}
+
 func (this *Transfer) Validate(getAccount func(number uint32) *accounter.Account) (context interface{}, err error) {
+	if err := ValidatePayload(GetPayloadType(this.Payload), this.Payload); err != nil {
+		return nil, err
+	}
+
 	destination := getAccount(this.Destination)
 	if destination == nil {
 		return nil, fmt.Errorf("Destination account %d not found", this.Destination)
@@ -90,9 +88,21 @@ func (this *Transfer) Validate(getAccount func(number uint32) *accounter.Account
 
 func (this *Transfer) Apply(index uint32, context interface{}) (map[uint32][]accounter.Micro, error) {
 	params := context.(*transferContext)
+	if _, err := utils.AddUint64(params.Destination.Balance, this.Amount); err != nil {
+		return nil, err
+	}
+
+	total, err := utils.AddUint64(this.Amount, this.Fee)
+	if err != nil {
+		return nil, err
+	}
+	source, err := params.Source.BalanceSub(total, index)
+	if err != nil {
+		return nil, err
+	}
 
 	result := make(map[uint32][]accounter.Micro)
-	result[params.Source.Number] = params.Source.BalanceSub(this.Amount+this.Fee, index)
+	result[params.Source.Number] = source
 	result[params.Destination.Number] = params.Destination.BalanceAdd(this.Amount, index)
 	return result, nil
 }
@@ -102,18 +112,16 @@ func (this *Transfer) Serialize(w io.Writer) error {
 	return err
 }
 
-func (this *Transfer) getBufferToSign() []byte {
-	return utils.Serialize(transferToSign{
-		Source:      this.Source,
-		Operation:   this.OperationId,
-		Destination: this.Destination,
-		Amount:      this.Amount,
-		Fee:         this.Fee,
-		Payload: &utils.BytesWithoutLengthPrefix{
-			Bytes: this.Payload,
-		},
-		Public: this.PublicKey.SerializedPlain(),
-	})
+func (this *Transfer) getBufferToSign() ([]byte, error) {
+	return buildSignBuffer(
+		this.Source,
+		this.OperationId,
+		this.Destination,
+		this.Amount,
+		this.Fee,
+		payloadToSign(this.Payload),
+		&this.PublicKey,
+	)
 }
 
 func (this *Transfer) getSourceInfo() (number uint32, operationId uint32, publicKey *crypto.Public) {
@@ -123,3 +131,15 @@ func (this *Transfer) getSourceInfo() (number uint32, operationId uint32, public
 func (this *Transfer) getSignature() *crypto.SignatureSerialized {
 	return &this.Signature
 }
+
+func (this *Transfer) getAffectedAccounts() []uint32 {
+	return []uint32{this.Source, this.Destination}
+}
+
+func (this *Transfer) getType() txType {
+	return txTypeTransfer
+}
+
+func (this *Transfer) accept(visitor OperationVisitor) error {
+	return visitor.VisitTransfer(this)
+}
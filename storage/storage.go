@@ -24,6 +24,7 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sync"
@@ -32,6 +33,8 @@ import (
 	"github.com/pasl-project/pasl/utils"
 )
 
+var ErrNotFound = errors.New("Not found")
+
 const (
 	blocksCacheLimit   = 50
 	accountsCacheLimit = 1000
@@ -43,11 +46,24 @@ type Storage struct {
 	lock             sync.RWMutex
 	blocksCache      map[uint32][]byte
 	accountsCache    map[uint32][]byte
+	undoCache        map[uint32][]byte
 }
 
 func WithStorage(accountsPerBlock uint32, fn func(storage *Storage) error) error {
+	return WithStorageName("storage.db", accountsPerBlock, fn)
+}
+
+// Opens the named storage file in the data dir
+func WithStorageName(name string, accountsPerBlock uint32, fn func(storage *Storage) error) error {
 	dataDir, err := utils.CreateDataDir()
-	db, err := bolt.Open(filepath.Join(dataDir, "storage.db"), 0600, nil)
+	if err != nil {
+		return err
+	}
+	return WithStorageFile(filepath.Join(dataDir, name), accountsPerBlock, fn)
+}
+
+func WithStorageFile(path string, accountsPerBlock uint32, fn func(storage *Storage) error) error {
+	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
 		return err
 	}
@@ -58,6 +74,7 @@ func WithStorage(accountsPerBlock uint32, fn func(storage *Storage) error) error
 		accountsPerBlock: accountsPerBlock,
 		blocksCache:      make(map[uint32][]byte),
 		accountsCache:    make(map[uint32][]byte),
+		undoCache:        make(map[uint32][]byte),
 	}
 
 	defer storage.flush()
@@ -153,6 +170,17 @@ func (this *Storage) flush() error {
 				}
 			}
 
+			if bucket, err = tx.CreateBucketIfNotExists([]byte("undo")); err != nil {
+				return err
+			}
+
+			for index, data := range this.undoCache {
+				binary.BigEndian.PutUint32(buffer[:], index)
+				if err = bucket.Put(buffer[:], data); err != nil {
+					return err
+				}
+			}
+
 			return nil
 		})()
 		if err != nil {
@@ -162,6 +190,7 @@ func (this *Storage) flush() error {
 
 		this.blocksCache = make(map[uint32][]byte)
 		this.accountsCache = make(map[uint32][]byte)
+		this.undoCache = make(map[uint32][]byte)
 
 		return nil
 	})
@@ -179,13 +208,115 @@ func (this *Storage) GetBlock(index uint32) (data []byte, err error) {
 		var bucket *bolt.Bucket
 
 		if bucket = tx.Bucket([]byte("blocks")); bucket == nil {
-			return nil
+			return ErrNotFound
+		}
+		var indexBuf [4]byte
+		binary.BigEndian.PutUint32(indexBuf[:], index)
+		value := bucket.Get(indexBuf[:])
+		if value == nil {
+			return ErrNotFound
+		}
+		data = make([]byte, len(value))
+		copy(data, value)
+		return nil
+	})
+	return
+}
+
+// Undo data is what it takes to revert the block, it is flushed along with the block
+func (this *Storage) StoreUndo(index uint32, data []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.undoCache[index] = make([]byte, len(data))
+	copy(this.undoCache[index], data)
+}
+
+func (this *Storage) GetUndo(index uint32) (data []byte, err error) {
+	this.lock.RLock()
+	data = this.undoCache[index]
+	this.lock.RUnlock()
+	if data != nil {
+		return data, nil
+	}
+
+	err = this.db.View(func(tx *bolt.Tx) error {
+		var bucket *bolt.Bucket
+
+		if bucket = tx.Bucket([]byte("undo")); bucket == nil {
+			return ErrNotFound
 		}
 		var indexBuf [4]byte
 		binary.BigEndian.PutUint32(indexBuf[:], index)
-		if data = bucket.Get(indexBuf[:]); data == nil {
-			return fmt.Errorf("Failed to get block #%d", index)
+		value := bucket.Get(indexBuf[:])
+		if value == nil {
+			return ErrNotFound
+		}
+		data = make([]byte, len(value))
+		copy(data, value)
+		return nil
+	})
+	return
+}
+
+// Removes the top block along with its accounts, the accounts it modified are overwritten with the restored ones
+func (this *Storage) Revert(index uint32, restoredAccounts func(func(number uint32, data []byte) error) error) error {
+	if err := this.flush(); err != nil {
+		return err
+	}
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		var buffer [4]byte
+		binary.BigEndian.PutUint32(buffer[:], index)
+		for _, name := range []string{"blocks", "undo"} {
+			if bucket := tx.Bucket([]byte(name)); bucket != nil {
+				if err := bucket.Delete(buffer[:]); err != nil {
+					return err
+				}
+			}
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists([]byte("accounts"))
+		if err != nil {
+			return err
+		}
+		for number := index * this.accountsPerBlock; number < (index+1)*this.accountsPerBlock; number++ {
+			binary.BigEndian.PutUint32(buffer[:], number)
+			if err := bucket.Delete(buffer[:]); err != nil {
+				return err
+			}
+		}
+
+		return restoredAccounts(func(number uint32, data []byte) error {
+			binary.BigEndian.PutUint32(buffer[:], number)
+			return bucket.Put(buffer[:], data)
+		})
+	})
+}
+
+func (this *Storage) StorePendingOperations(data []byte) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("pending"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("operations"), data)
+	})
+}
+
+func (this *Storage) LoadPendingOperations() (data []byte, err error) {
+	err = this.db.View(func(tx *bolt.Tx) error {
+		var bucket *bolt.Bucket
+
+		if bucket = tx.Bucket([]byte("pending")); bucket == nil {
+			return ErrNotFound
+		}
+		value := bucket.Get([]byte("operations"))
+		if value == nil {
+			return ErrNotFound
 		}
+		data = make([]byte, len(value))
+		copy(data, value)
 		return nil
 	})
 	return
@@ -24,10 +24,17 @@ package utils
 
 import (
 	"bytes"
-	"container/list"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pasl-project/pasl/defaults"
 )
 
 type Serializable interface {
@@ -45,21 +52,25 @@ func (this *BytesWithoutLengthPrefix) Serialize(w io.Writer) error {
 }
 
 func (this *BytesWithoutLengthPrefix) Deserialize(r io.Reader) error {
-	_, err := r.Read(this.Bytes[:])
+	_, err := io.ReadFull(r, this.Bytes)
 	return err
 }
 
-func SerializeBytes(data []byte) []byte {
+// Length prefix is uint16 on the wire, longer data can't be represented
+func SerializeBytes(data []byte) ([]byte, error) {
 	dataLen := len(data)
+	if dataLen > math.MaxUint16 {
+		return nil, fmt.Errorf("Data size %d exceeds %d bytes limit", dataLen, math.MaxUint16)
+	}
 	serialized := make([]byte, 2+dataLen)
 	serialized[0] = (byte)(dataLen & 0xFF)
 	serialized[1] = (byte)(dataLen >> 8)
 	copy(serialized[2:], data)
-	return serialized
+	return serialized, nil
 }
 
 func DeserializeBytes(reader io.Reader) (data []byte, err error) {
-	var size int16
+	var size uint16
 	if err = binary.Read(reader, binary.LittleEndian, &size); err != nil {
 		return
 	}
@@ -71,191 +82,459 @@ func DeserializeBytes(reader io.Reader) (data []byte, err error) {
 }
 
 type pair struct {
-	a interface{}
-	b int
+	value reflect.Value
+	next  int
+	name  string
+}
+
+var serializableType = reflect.TypeOf((*Serializable)(nil)).Elem()
+var serializableTypes sync.Map
+var interfaceCodecs sync.Map
+
+// Text is decoded only if it holds valid UTF-8, plain strings stay opaque bytes
+type Text string
+
+var textType = reflect.TypeOf(Text(""))
+
+// Upper bound for decoded slice element counts, meant to be set once on startup
+var MaxSliceLength = defaults.MaxSliceLength
+var MaxSliceBytes = defaults.MaxSliceBytes
+
+// Every element takes at least one byte, readers that know their remaining size are checked against it too
+func CheckSliceLength(count uint32, elemSize uintptr, r io.Reader) error {
+	if count > MaxSliceLength {
+		return fmt.Errorf("Slice length %d exceeds %d elements limit", count, MaxSliceLength)
+	}
+	if uint64(count)*uint64(elemSize) > MaxSliceBytes {
+		return fmt.Errorf("Slice of %d elements %d bytes each exceeds %d bytes limit", count, elemSize, MaxSliceBytes)
+	}
+	if sized, ok := r.(interface{ Len() int }); ok && uint64(count) > uint64(sized.Len()) {
+		return fmt.Errorf("Slice length %d exceeds %d remaining bytes", count, sized.Len())
+	}
+	return nil
+}
+
+// Encodes values held by an interface and instantiates the concrete type on decoding
+type InterfaceCodec struct {
+	Serialize   func(w io.Writer, value interface{}) error
+	Deserialize func(r io.Reader) (interface{}, error)
+}
+
+// Expects a nil pointer to the interface type, e.g. (*Operation)(nil)
+func RegisterInterface(pointerToInterface interface{}, codec InterfaceCodec) {
+	interfaceCodecs.Store(reflect.TypeOf(pointerToInterface).Elem(), codec)
+}
+
+func getInterfaceCodec(t reflect.Type) (InterfaceCodec, bool) {
+	codec, ok := interfaceCodecs.Load(t)
+	if !ok {
+		return InterfaceCodec{}, false
+	}
+	return codec.(InterfaceCodec), true
+}
+
+func isSerializable(v reflect.Value) bool {
+	if !v.CanAddr() {
+		return false
+	}
+	t := v.Type()
+	if cached, ok := serializableTypes.Load(t); ok {
+		return cached.(bool)
+	}
+	implements := reflect.PtrTo(t).Implements(serializableType)
+	serializableTypes.Store(t, implements)
+	return implements
+}
+
+// Walking stops as soon as callback returns false
+func strucWalker(struc interface{}, callback func(*reflect.Value) bool) {
+	walk(struc, false, func(_ string, value *reflect.Value) bool {
+		return callback(value)
+	})
 }
 
-func strucWalker(struc interface{}, callback func(*reflect.Value)) {
+// Field names are built only if requested, the serializer doesn't need them
+func walk(struc interface{}, withNames bool, callback func(string, *reflect.Value) bool) {
 	v := reflect.ValueOf(struc)
-	if reflect.TypeOf(struc).Kind() == reflect.Ptr {
+	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
 
-	wayBack := list.New()
-	wayBack.PushBack(pair{
-		a: v,
-		b: 0,
-	})
+	wayBack := make([]pair, 1, 8)
+	wayBack[0] = pair{
+		value: v,
+		next:  0,
+	}
+
+	nameOf := func(parent string, v reflect.Value, i int) string {
+		if v.Kind() == reflect.Slice {
+			return fmt.Sprintf("%s[%d]", parent, i)
+		}
+		if parent == "" {
+			return v.Type().Field(i).Name
+		}
+		return parent + "." + v.Type().Field(i).Name
+	}
 
-	step := func(i int, v reflect.Value, el reflect.Value) bool {
+	stopped := false
+	visit := func(name string, value *reflect.Value) {
+		if !callback(name, value) {
+			stopped = true
+		}
+	}
+
+	step := func(i int, v reflect.Value, el reflect.Value, parent string) bool {
+		var name string
+		if withNames {
+			name = nameOf(parent, v, i)
+		}
 		switch kind := el.Kind(); kind {
 		case reflect.Struct:
-			if el.CanAddr() {
-				if _, ok := el.Addr().Interface().(Serializable); ok {
-					callback(&el)
-					break
-				}
+			if isSerializable(el) {
+				visit(name, &el)
+				break
 			}
-			wayBack.PushBack(pair{
-				a: v,
-				b: i + 1,
-			})
-			wayBack.PushBack(pair{
-				a: el,
-				b: 0,
+			wayBack = append(wayBack, pair{
+				value: v,
+				next:  i + 1,
+				name:  parent,
+			}, pair{
+				value: el,
+				next:  0,
+				name:  name,
 			})
 			return false
 		case reflect.Slice:
 			switch el.Type().Elem().Kind() {
 			case reflect.Uint8:
-				callback(&el)
+				visit(name, &el)
 			default:
-				callback(&el)
-				wayBack.PushBack(pair{
-					a: v,
-					b: i + 1,
-				})
-				wayBack.PushBack(pair{
-					a: el,
-					b: 0,
+				visit(name, &el)
+				wayBack = append(wayBack, pair{
+					value: v,
+					next:  i + 1,
+					name:  parent,
+				}, pair{
+					value: el,
+					next:  0,
+					name:  name,
 				})
 				return false
 			}
 		default:
-			callback(&el)
+			visit(name, &el)
 		}
-		return true
+		return !stopped
 	}
 
-	for wayBack.Len() > 0 {
-		el := wayBack.Back()
-		current := el.Value
-		wayBack.Remove(el)
+	for len(wayBack) > 0 && !stopped {
+		current := wayBack[len(wayBack)-1]
+		wayBack = wayBack[:len(wayBack)-1]
 
-		v := current.(pair).a.(reflect.Value)
+		v := current.value
 
 		switch kind := v.Kind(); kind {
 		case reflect.Struct:
-			if v.CanAddr() {
-				if _, ok := v.Addr().Interface().(Serializable); ok {
-					callback(&v)
-					break
-				}
+			if isSerializable(v) {
+				visit(current.name, &v)
+				break
 			}
 			total := v.NumField()
-			for i := current.(pair).b; i < total; i++ {
-				if !step(i, v, v.Field(i)) {
+			for i := current.next; i < total; i++ {
+				if !step(i, v, v.Field(i), current.name) {
 					break
 				}
 			}
 		case reflect.Slice:
 			total := v.Len()
-			for i := current.(pair).b; i < total; i++ {
-				if !step(i, v, v.Index(i)) {
+			for i := current.next; i < total; i++ {
+				if !step(i, v, v.Index(i), current.name) {
 					break
 				}
 			}
 		default:
-			callback(&v)
+			visit(current.name, &v)
 		}
 	}
 }
 
 func Serialize(struc interface{}) []byte {
 	serialized := &bytes.Buffer{}
+	serializeTo(serialized, struc)
+	return serialized.Bytes()
+}
 
-	strucWalker(struc, func(value *reflect.Value) {
-		switch kind := value.Kind(); kind {
-		case reflect.Ptr:
-			if err := value.Interface().(Serializable).Serialize(serialized); err != nil {
-				Panicf("Custom type serialization failed: %v", err)
-			}
-		case reflect.Interface:
-			if err := value.Interface().(Serializable).Serialize(serialized); err != nil {
-				Panicf("Custom type serialization failed: %v", err)
+type serializeWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+func serializeTo(serialized serializeWriter, struc interface{}) {
+	var scratch [8]byte
+
+	walk(struc, false, func(_ string, value *reflect.Value) bool {
+		serializeValue(serialized, &scratch, value)
+		return true
+	})
+}
+
+// Renders serialized struc one field per line: offset, field name and bytes
+func DebugDump(struc interface{}) string {
+	serialized := &bytes.Buffer{}
+	var scratch [8]byte
+
+	dump := &strings.Builder{}
+	walk(struc, true, func(name string, value *reflect.Value) bool {
+		offset := serialized.Len()
+		serializeValue(serialized, &scratch, value)
+		if name == "" {
+			name = value.Type().String()
+		}
+		fmt.Fprintf(dump, "%08x %-32s %x\n", offset, name, serialized.Bytes()[offset:])
+		return true
+	})
+
+	return dump.String()
+}
+
+func serializeValue(serialized serializeWriter, scratch *[8]byte, value *reflect.Value) {
+	switch kind := value.Kind(); kind {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			Panicf("Nil %v can't be serialized", value.Type())
+		}
+		if codec, ok := getInterfaceCodec(value.Type()); ok {
+			if err := codec.Serialize(serialized, value.Interface()); err != nil {
+				Panicf("Interface serialization failed: %v", err)
 			}
-		case reflect.Struct:
-			if err := value.Addr().Interface().(Serializable).Serialize(serialized); err != nil {
+			break
+		}
+		if serializable, ok := value.Interface().(Serializable); ok {
+			if err := serializable.Serialize(serialized); err != nil {
 				Panicf("Custom type serialization failed: %v", err)
 			}
+			break
+		}
+		// Plain structs behind pointers and interfaces are walked as usual
+		underlying := *value
+		if kind == reflect.Interface {
+			underlying = value.Elem()
+		}
+		if underlying.Kind() != reflect.Ptr {
+			addressable := reflect.New(underlying.Type())
+			addressable.Elem().Set(underlying)
+			underlying = addressable
+		}
+		serializeTo(serialized, underlying.Interface())
+	case reflect.Struct:
+		if err := value.Addr().Interface().(Serializable).Serialize(serialized); err != nil {
+			Panicf("Custom type serialization failed: %v", err)
+		}
+	case reflect.Bool:
+		if value.Bool() {
+			serialized.WriteByte(1)
+		} else {
+			serialized.WriteByte(0)
+		}
+	case reflect.Uint8:
+		serialized.WriteByte(uint8(value.Uint()))
+	case reflect.Uint16:
+		binary.LittleEndian.PutUint16(scratch[:2], uint16(value.Uint()))
+		serialized.Write(scratch[:2])
+	case reflect.Uint32:
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(value.Uint()))
+		serialized.Write(scratch[:4])
+	case reflect.Uint64:
+		binary.LittleEndian.PutUint64(scratch[:8], value.Uint())
+		serialized.Write(scratch[:8])
+	case reflect.String:
+		value := value.String()
+		if len(value) > math.MaxUint16 {
+			Panicf("String of %d bytes exceeds %d bytes limit", len(value), math.MaxUint16)
+		}
+		binary.LittleEndian.PutUint16(scratch[:2], uint16(len(value)))
+		serialized.Write(scratch[:2])
+		serialized.WriteString(value)
+	case reflect.Slice:
+		switch value.Type().Elem().Kind() {
 		case reflect.Uint8:
-			binary.Write(serialized, binary.LittleEndian, uint8(value.Uint()))
-		case reflect.Uint16:
-			binary.Write(serialized, binary.LittleEndian, uint16(value.Uint()))
-		case reflect.Uint32:
-			binary.Write(serialized, binary.LittleEndian, uint32(value.Uint()))
-		case reflect.Uint64:
-			binary.Write(serialized, binary.LittleEndian, uint64(value.Uint()))
-		case reflect.String:
-			value := value.String()
-			binary.Write(serialized, binary.LittleEndian, uint16(len(value)))
-			binary.Write(serialized, binary.LittleEndian, []byte(value))
-		case reflect.Slice:
-			switch value.Type().Elem().Kind() {
-			case reflect.Uint8:
-				value := value.Bytes()
-				binary.Write(serialized, binary.LittleEndian, uint16(len(value)))
-				binary.Write(serialized, binary.LittleEndian, value)
-			default:
-				binary.Write(serialized, binary.LittleEndian, uint32(value.Len()))
+			value := value.Bytes()
+			if len(value) > math.MaxUint16 {
+				Panicf("Bytes of %d bytes exceed %d bytes limit", len(value), math.MaxUint16)
 			}
+			binary.LittleEndian.PutUint16(scratch[:2], uint16(len(value)))
+			serialized.Write(scratch[:2])
+			serialized.Write(value)
 		default:
-			Panicf("Unimplemented %v", kind)
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(value.Len()))
+			serialized.Write(scratch[:4])
 		}
-	})
+	default:
+		Panicf("Unimplemented %v", kind)
+	}
+}
 
-	return serialized.Bytes()
+type countingWriter struct {
+	count int
+}
+
+func (this *countingWriter) Write(data []byte) (int, error) {
+	this.count += len(data)
+	return len(data), nil
+}
+
+func (this *countingWriter) WriteByte(byte) error {
+	this.count++
+	return nil
+}
+
+func (this *countingWriter) WriteString(data string) (int, error) {
+	this.count += len(data)
+	return len(data), nil
+}
+
+// Same as len(Serialize(struc)) without building the buffer
+func SerializedSize(struc interface{}) int {
+	counter := &countingWriter{}
+	serializeTo(counter, struc)
+	return counter.count
 }
 
 func Deserialize(struc interface{}, r io.Reader) error {
-	strucWalker(struc, func(value *reflect.Value) {
+	return deserialize(struc, r, false)
+}
+
+// Fields missing at the end of the stream are left with zero values
+func DeserializeOptionalTail(struc interface{}, r io.Reader) error {
+	return deserialize(struc, r, true)
+}
+
+func DeserializeStrict(struc interface{}, r io.Reader) error {
+	if err := Deserialize(struc, r); err != nil {
+		return err
+	}
+	var trailing [1]byte
+	if n, _ := r.Read(trailing[:]); n != 0 {
+		return errors.New("Unexpected trailing bytes")
+	}
+	return nil
+}
+
+func deserialize(struc interface{}, r io.Reader, optionalTail bool) (err error) {
+	eof := false
+	var scratch [8]byte
+	read := func(data []byte, fieldStart bool) bool {
+		_, readErr := io.ReadFull(r, data)
+		switch {
+		case readErr == nil:
+			return true
+		case !optionalTail:
+			err = readErr
+		case readErr == io.EOF && fieldStart:
+			eof = true
+		case readErr == io.EOF:
+			err = io.ErrUnexpectedEOF
+		default:
+			err = readErr
+		}
+		return false
+	}
+	readUint := func(size int) uint64 {
+		scratch = [8]byte{}
+		if !read(scratch[:size], true) {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(scratch[:])
+	}
+
+	strucWalker(struc, func(value *reflect.Value) bool {
 		switch kind := value.Kind(); kind {
 		case reflect.Ptr:
-			if err := value.Interface().(Serializable).Deserialize(r); err != nil {
-				Panicf("Custom type deserialization failed: %v", err)
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
 			}
-		case reflect.Struct:
-			if err := value.Addr().Interface().(Serializable).Deserialize(r); err != nil {
-				Panicf("Custom type deserialization failed: %v", err)
+			if serializable, ok := value.Interface().(Serializable); ok {
+				err = deserializeCustom(serializable, r)
+				break
+			}
+			err = deserialize(value.Interface(), r, optionalTail)
+		case reflect.Interface:
+			if codec, ok := getInterfaceCodec(value.Type()); ok {
+				var decoded interface{}
+				if decoded, err = codec.Deserialize(r); err == nil {
+					value.Set(reflect.ValueOf(decoded))
+				}
+				break
+			}
+			if value.IsNil() || value.Elem().Kind() != reflect.Ptr {
+				err = fmt.Errorf("Interface %v needs a preallocated pointer to deserialize into", value.Type())
+				break
 			}
+			if serializable, ok := value.Interface().(Serializable); ok {
+				err = deserializeCustom(serializable, r)
+				break
+			}
+			err = deserialize(value.Elem().Interface(), r, optionalTail)
+		case reflect.Struct:
+			err = deserializeCustom(value.Addr().Interface().(Serializable), r)
+		case reflect.Bool:
+			// Any nonzero byte is true
+			value.SetBool(readUint(1) != 0)
 		case reflect.Uint8:
-			var val uint8
-			binary.Read(r, binary.LittleEndian, &val)
-			value.SetUint(uint64(val))
+			value.SetUint(readUint(1))
 		case reflect.Uint16:
-			var val uint16
-			binary.Read(r, binary.LittleEndian, &val)
-			value.SetUint(uint64(val))
+			value.SetUint(readUint(2))
 		case reflect.Uint32:
-			var val uint32
-			binary.Read(r, binary.LittleEndian, &val)
-			value.SetUint(uint64(val))
+			value.SetUint(readUint(4))
 		case reflect.Uint64:
-			var val uint64
-			binary.Read(r, binary.LittleEndian, &val)
-			value.SetUint(val)
+			value.SetUint(readUint(8))
 		case reflect.String:
-			var len uint16
-			binary.Read(r, binary.LittleEndian, &len)
-			var str []byte = make([]byte, len)
-			binary.Read(r, binary.LittleEndian, &str)
+			if !read(scratch[:2], true) {
+				break
+			}
+			var str []byte = make([]byte, binary.LittleEndian.Uint16(scratch[:2]))
+			if !read(str, false) {
+				break
+			}
+			if value.Type() == textType && !utf8.Valid(str) {
+				err = fmt.Errorf("Invalid UTF-8 text %x", str)
+				break
+			}
 			value.SetString(string(str))
 		case reflect.Slice:
 			switch kind := value.Type().Elem().Kind(); kind {
 			case reflect.Uint8:
-				var len uint16
-				binary.Read(r, binary.LittleEndian, &len)
-				var data []byte = make([]byte, len)
-				binary.Read(r, binary.LittleEndian, &data)
+				if !read(scratch[:2], true) {
+					break
+				}
+				var data []byte = make([]byte, binary.LittleEndian.Uint16(scratch[:2]))
+				if !read(data, false) {
+					break
+				}
 				value.SetBytes(data)
 			default:
-				var len uint32
-				binary.Read(r, binary.LittleEndian, &len)
+				len := uint32(readUint(4))
+				if err != nil || eof {
+					break
+				}
+				if err = CheckSliceLength(len, value.Type().Elem().Size(), r); err != nil {
+					break
+				}
 				value.Set(reflect.MakeSlice(value.Type(), int(len), int(len)))
 			}
 		default:
-			Panicf("Unimplemented %v", kind)
+			err = fmt.Errorf("Unimplemented %v", kind)
 		}
+		return !eof && err == nil
 	})
+
+	return err
+}
+
+func deserializeCustom(serializable Serializable, r io.Reader) error {
+	if err := serializable.Deserialize(r); err != nil {
+		return fmt.Errorf("Custom type deserialization failed: %v", err)
+	}
 	return nil
 }
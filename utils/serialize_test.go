@@ -0,0 +1,468 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+Greatly inspired by Kurt Rose's python implementation
+https://gist.github.com/kurtbrose/4423605
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+type testMessage struct {
+	Height  uint32
+	Payload []byte
+	Agent   string
+	Extra   uint64
+}
+
+type testMessageLegacy struct {
+	Height  uint32
+	Payload []byte
+}
+
+func TestDeserializeOptionalTail(t *testing.T) {
+	data := Serialize(&testMessageLegacy{
+		Height:  7,
+		Payload: []byte{1, 2, 3},
+	})
+
+	var message testMessage
+	if err := DeserializeOptionalTail(&message, bytes.NewBuffer(data)); err != nil {
+		t.Fatal(err)
+	}
+	if message.Height != 7 || !bytes.Equal(message.Payload, []byte{1, 2, 3}) || message.Agent != "" || message.Extra != 0 {
+		t.Fatalf("%v", message)
+	}
+
+	full := testMessage{
+		Height:  7,
+		Payload: []byte{1, 2, 3},
+		Agent:   "agent",
+		Extra:   9,
+	}
+	message = testMessage{}
+	if err := DeserializeOptionalTail(&message, bytes.NewBuffer(Serialize(&full))); err != nil {
+		t.Fatal(err)
+	}
+	if message.Agent != full.Agent || message.Extra != full.Extra {
+		t.Fatalf("%v", message)
+	}
+}
+
+func TestDeserializeOptionalTailTruncated(t *testing.T) {
+	data := Serialize(&testMessage{
+		Height:  7,
+		Payload: []byte{1, 2, 3},
+		Agent:   "agent",
+	})
+
+	var message testMessage
+	if err := DeserializeOptionalTail(&message, bytes.NewBuffer(data[:len(data)-10])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("%v", err)
+	}
+	if err := DeserializeOptionalTail(&message, bytes.NewBuffer(data[:5])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestDeserializeStrict(t *testing.T) {
+	data := Serialize(&testMessageLegacy{
+		Height:  7,
+		Payload: []byte{1, 2, 3},
+	})
+
+	var message testMessageLegacy
+	if err := DeserializeStrict(&message, bytes.NewBuffer(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeserializeStrict(&message, bytes.NewBuffer(append(data, 0))); err == nil {
+		t.FailNow()
+	}
+}
+
+type testLayoutItem struct {
+	Id   uint16
+	Data []byte
+}
+
+type testLayout struct {
+	Small   uint8
+	Medium  uint16
+	Regular uint32
+	Large   uint64
+	Name    string
+	Data    []byte
+	Nested  testMessageLegacy
+	Items   []testLayoutItem
+	Numbers []uint32
+	Raw     BytesWithoutLengthPrefix
+	Custom  Serializable
+}
+
+func getTestLayout() testLayout {
+	return testLayout{
+		Small:   1,
+		Medium:  0x0203,
+		Regular: 0x04050607,
+		Large:   0x08090A0B0C0D0E0F,
+		Name:    "name",
+		Data:    []byte{0xAA, 0xBB},
+		Nested: testMessageLegacy{
+			Height:  9,
+			Payload: []byte{0xCC},
+		},
+		Items: []testLayoutItem{
+			{Id: 1, Data: []byte{0xDD}},
+			{Id: 2, Data: []byte{}},
+		},
+		Numbers: []uint32{3, 4},
+		Raw:     BytesWithoutLengthPrefix{Bytes: []byte{0xEE, 0xFF}},
+		Custom:  &BytesWithoutLengthPrefix{Bytes: []byte{0x11}},
+	}
+}
+
+const testLayoutSerialized = "010302070605040f0e0d0c0b0a090804006e616d650200aabb090000000100cc0200000001000100dd02000000020000000300000004000000eeff11"
+
+func TestSerializeLayout(t *testing.T) {
+	layout := getTestLayout()
+	if serialized := hex.EncodeToString(Serialize(&layout)); serialized != testLayoutSerialized {
+		t.Fatalf("%s", serialized)
+	}
+}
+
+func TestDeserializeLayout(t *testing.T) {
+	data, err := hex.DecodeString(testLayoutSerialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Custom is the trailing byte, interfaces can't be deserialized
+	var layout struct {
+		Small   uint8
+		Medium  uint16
+		Regular uint32
+		Large   uint64
+		Name    string
+		Data    []byte
+		Nested  testMessageLegacy
+		Items   []testLayoutItem
+		Numbers []uint32
+		Raw     BytesWithoutLengthPrefix
+	}
+	layout.Raw.Bytes = make([]byte, 2)
+	reader := bytes.NewBuffer(data[:len(data)-1])
+	if err := Deserialize(&layout, reader); err != nil {
+		t.Fatal(err)
+	}
+	if reader.Len() != 0 || layout.Large != 0x08090A0B0C0D0E0F || layout.Name != "name" || len(layout.Items) != 2 || layout.Items[0].Data[0] != 0xDD {
+		t.Fatalf("%v", layout)
+	}
+	if serialized := Serialize(&layout); !bytes.Equal(serialized, data[:len(data)-1]) {
+		t.Fatalf("%x", serialized)
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	message := testMessage{
+		Height:  7,
+		Payload: make([]byte, 32),
+		Agent:   "agent",
+		Extra:   9,
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Serialize(&message)
+	}
+}
+
+func BenchmarkDeserialize(b *testing.B) {
+	data := Serialize(&testMessage{
+		Height:  7,
+		Payload: make([]byte, 32),
+		Agent:   "agent",
+		Extra:   9,
+	})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var message testMessage
+		Deserialize(&message, bytes.NewReader(data))
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	message := testMessageLegacy{
+		Height:  7,
+		Payload: []byte{1, 2, 3},
+	}
+	expected := "00000000 Height                           07000000\n" +
+		"00000004 Payload                          0300010203\n"
+	if dump := DebugDump(&message); dump != expected {
+		t.Fatalf("%s", dump)
+	}
+
+	layout := getTestLayout()
+	dump := DebugDump(&layout)
+	for _, line := range []string{
+		"00000019 Nested.Height                    09000000\n",
+		"00000020 Items                            02000000\n",
+		"00000026 Items[0].Data                    0100dd\n",
+		"00000039 Raw                              eeff\n",
+	} {
+		if !strings.Contains(dump, line) {
+			t.Fatalf("%s", dump)
+		}
+	}
+}
+
+func TestSerializePointers(t *testing.T) {
+	type pointers struct {
+		Items  []*testLayoutItem
+		Nested *testMessageLegacy
+	}
+	type values struct {
+		Items  []testLayoutItem
+		Nested testMessageLegacy
+	}
+
+	expected := Serialize(&values{
+		Items:  []testLayoutItem{{Id: 1, Data: []byte{0xDD}}, {Id: 2, Data: []byte{}}},
+		Nested: testMessageLegacy{Height: 9, Payload: []byte{0xCC}},
+	})
+	serialized := Serialize(&pointers{
+		Items:  []*testLayoutItem{{Id: 1, Data: []byte{0xDD}}, {Id: 2, Data: []byte{}}},
+		Nested: &testMessageLegacy{Height: 9, Payload: []byte{0xCC}},
+	})
+	if !bytes.Equal(serialized, expected) {
+		t.Fatalf("%x != %x", serialized, expected)
+	}
+
+	var decoded pointers
+	if err := DeserializeStrict(&decoded, bytes.NewBuffer(serialized)); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Items) != 2 || decoded.Items[0].Id != 1 || decoded.Items[0].Data[0] != 0xDD || decoded.Items[1].Id != 2 {
+		t.Fatalf("%v", decoded)
+	}
+	if decoded.Nested == nil || decoded.Nested.Height != 9 || decoded.Nested.Payload[0] != 0xCC {
+		t.Fatalf("%v", decoded.Nested)
+	}
+
+	// Interface elements are serialized with their dynamic type
+	serialized = Serialize(&struct{ Items []interface{} }{
+		Items: []interface{}{testLayoutItem{Id: 1, Data: []byte{0xDD}}, &testLayoutItem{Id: 2, Data: []byte{}}},
+	})
+	if !bytes.Equal(serialized, expected[:len(serialized)]) {
+		t.Fatalf("%x", serialized)
+	}
+}
+
+func TestSerializedSize(t *testing.T) {
+	layout := getTestLayout()
+	if size := SerializedSize(&layout); size != len(Serialize(&layout)) {
+		t.Fatalf("%d != %d", size, len(Serialize(&layout)))
+	}
+
+	// Values Serialize refuses to encode can't be sized either
+	defer func() {
+		if recover() == nil {
+			t.FailNow()
+		}
+	}()
+	SerializedSize(&struct{ Data []byte }{make([]byte, math.MaxUint16+1)})
+}
+
+func TestSerializeBool(t *testing.T) {
+	type flags struct {
+		Enabled  bool
+		Disabled bool
+		Height   uint32
+	}
+	message := flags{Enabled: true, Disabled: false, Height: 7}
+	serialized := Serialize(&message)
+	if !bytes.Equal(serialized, []byte{1, 0, 7, 0, 0, 0}) || SerializedSize(&message) != len(serialized) {
+		t.Fatalf("%x", serialized)
+	}
+
+	var decoded flags
+	if err := DeserializeStrict(&decoded, bytes.NewBuffer([]byte{2, 0, 7, 0, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != message {
+		t.Fatalf("%+v", decoded)
+	}
+}
+
+func TestDeserializeText(t *testing.T) {
+	invalid := []byte{3, 0, 'a', 0xff, 0xfe}
+
+	var opaque struct{ Value string }
+	if err := DeserializeStrict(&opaque, bytes.NewBuffer(invalid)); err != nil {
+		t.Fatal(err)
+	}
+	if opaque.Value != "a\xff\xfe" {
+		t.Fatalf("%x", opaque.Value)
+	}
+
+	var text struct{ Value Text }
+	if err := DeserializeStrict(&text, bytes.NewBuffer(invalid)); err == nil {
+		t.FailNow()
+	}
+	if err := DeserializeStrict(&text, bytes.NewBuffer([]byte{3, 0, 'a', 0xc3, 0xa9})); err != nil || text.Value != "aé" {
+		t.Fatalf("%v %q", err, text.Value)
+	}
+}
+
+type testFailing struct{}
+
+func (this *testFailing) Serialize(w io.Writer) error {
+	return nil
+}
+
+func (this *testFailing) Deserialize(r io.Reader) error {
+	return errors.New("failing")
+}
+
+func TestDeserializeTruncated(t *testing.T) {
+	type truncated struct {
+		Flag    bool
+		Small   uint8
+		Medium  uint16
+		Regular uint32
+		Large   uint64
+		Name    string
+		Text    Text
+		Data    []byte
+		Nested  *testMessageLegacy
+		Items   []testLayoutItem
+		Numbers []uint32
+		Raw     BytesWithoutLengthPrefix
+	}
+	layout := getTestLayout()
+	data := Serialize(&truncated{
+		Flag:    true,
+		Name:    layout.Name,
+		Text:    "text",
+		Data:    layout.Data,
+		Nested:  &layout.Nested,
+		Items:   layout.Items,
+		Numbers: layout.Numbers,
+		Raw:     layout.Raw,
+	})
+
+	for size := 0; size < len(data); size++ {
+		decoded := truncated{Raw: BytesWithoutLengthPrefix{Bytes: make([]byte, 2)}}
+		if err := Deserialize(&decoded, bytes.NewBuffer(data[:size])); err == nil {
+			t.Fatalf("%d", size)
+		}
+	}
+	decoded := truncated{Raw: BytesWithoutLengthPrefix{Bytes: make([]byte, 2)}}
+	if err := DeserializeStrict(&decoded, bytes.NewBuffer(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var custom struct{ Value testFailing }
+	if err := Deserialize(&custom, bytes.NewBuffer(data)); err == nil {
+		t.FailNow()
+	}
+	var unallocated struct{ Value Serializable }
+	if err := Deserialize(&unallocated, bytes.NewBuffer(data)); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestDeserializeSliceLength(t *testing.T) {
+	var numbers struct{ Numbers []uint32 }
+	if err := Deserialize(&numbers, bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.FailNow()
+	}
+	if err := Deserialize(&numbers, bytes.NewBuffer([]byte{2, 0, 0, 0, 1})); err == nil {
+		t.FailNow()
+	}
+
+	// Readers of unknown size are bounded by MaxSliceLength only
+	defer func(max uint32) { MaxSliceLength = max }(MaxSliceLength)
+	MaxSliceLength = 2
+	data := Serialize(&struct{ Numbers []uint32 }{[]uint32{1, 2, 3}})
+	if err := Deserialize(&numbers, io.MultiReader(bytes.NewBuffer(data))); err == nil {
+		t.FailNow()
+	}
+	MaxSliceLength = 3
+	if err := Deserialize(&numbers, io.MultiReader(bytes.NewBuffer(data))); err != nil || len(numbers.Numbers) != 3 {
+		t.Fatal(err)
+	}
+}
+
+func TestDeserializeSliceTruncatedLength(t *testing.T) {
+	type msg struct {
+		A     uint32
+		Items []uint32
+	}
+	data := Serialize(&msg{1, []uint32{2}})
+	for size := 4; size < 8; size++ {
+		var value msg
+		if err := Deserialize(&value, bytes.NewBuffer(data[:size])); err == nil {
+			t.Fatalf("%d bytes decoded", size)
+		}
+		if err := DeserializeStrict(&value, bytes.NewBuffer(data[:size])); err == nil {
+			t.Fatalf("%d bytes decoded", size)
+		}
+	}
+}
+
+func TestDeserializeSliceBytes(t *testing.T) {
+	var numbers struct{ Numbers []uint64 }
+	data := Serialize(&struct{ Numbers []uint64 }{[]uint64{1, 2, 3}})
+
+	defer func(max uint64) { MaxSliceBytes = max }(MaxSliceBytes)
+	MaxSliceBytes = 16
+	if err := Deserialize(&numbers, io.MultiReader(bytes.NewBuffer(data))); err == nil {
+		t.FailNow()
+	}
+	MaxSliceBytes = 24
+	if err := Deserialize(&numbers, io.MultiReader(bytes.NewBuffer(data))); err != nil || len(numbers.Numbers) != 3 {
+		t.Fatal(err)
+	}
+}
+
+func TestSerializeBytesLimit(t *testing.T) {
+	data := bytes.Repeat([]byte{0xAB}, 0xFFFF)
+	serialized, err := SerializeBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serialized[:2], []byte{0xFF, 0xFF}) || len(serialized) != 2+len(data) {
+		t.Fatalf("%x", serialized[:2])
+	}
+	decoded, err := DeserializeBytes(bytes.NewBuffer(serialized))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatal(err)
+	}
+
+	if _, err := SerializeBytes(append(data, 0xAB)); err == nil {
+		t.FailNow()
+	}
+}
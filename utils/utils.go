@@ -81,6 +81,20 @@ func MaxUint64(a uint64, b uint64) uint64 {
 	return b
 }
 
+func AddUint64(a uint64, b uint64) (uint64, error) {
+	if a > 0xFFFFFFFFFFFFFFFF-b {
+		return 0, errors.New("Uint64 overflow")
+	}
+	return a + b, nil
+}
+
+func SubUint64(a uint64, b uint64) (uint64, error) {
+	if a < b {
+		return 0, errors.New("Uint64 underflow")
+	}
+	return a - b, nil
+}
+
 
 func TimeTrack(start time.Time, format string) {
 	elapsed := time.Since(start)
@@ -135,7 +149,7 @@ func formatf(format string, a ...interface{}) string {
 }
 
 func Tracef(format string, a ...interface{}) {
-	fmt.Printf(formatf(format, a...))
+	fmt.Print(formatf(format, a...))
 }
 
 func Panicf(format string, a ...interface{}) {